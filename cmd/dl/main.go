@@ -189,7 +189,18 @@ func LoadSources(logger *slog.Logger, cacheDir string) ([]*model.Proxy, error) {
 	layers := make([]*model.Proxy, 0, len(res))
 
 	for _, l := range res {
-		p := model.NewProxy(l, logger, cacheDir)
+		// composites and multilayers have no upstream to download from
+		if !l.IsProxy() {
+			continue
+		}
+
+		p, err := model.NewProxy(l, logger, cacheDir)
+
+		if err != nil {
+			logger.Error("invalid layer "+l.Key, "error", err)
+			continue
+		}
+
 		layers = append(layers, p)
 	}
 
@@ -222,20 +233,15 @@ func (app *App) worker(i int, wg *sync.WaitGroup, ch chan string, fnchan chan fu
 		x, _ := strconv.Atoi(d[1])
 		y, _ := strconv.Atoi(d[2])
 
-		_, data, err := app.layer.GetTile(ctx, z, x, y)
+		t, err := app.layer.GetTile(ctx, z, x, y)
 
 		if err != nil {
 			logger.Error("error", "error", err)
 			continue
 		}
 
-		if data == nil {
-			logger.Error("nil data")
-			continue
-		}
-
 		fnchan <- func(db *sql.DB) {
-			if err := putData(db, z, x, y, data); err != nil {
+			if err := putData(db, z, x, y, t.Data); err != nil {
 				logger.Error("save error", "error", err)
 			}
 		}
@@ -294,6 +300,15 @@ func putMeta(db *sql.DB, meta map[string]string) error {
 }
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "overviews" {
+		if err := runOverviews(os.Args[2:]); err != nil {
+			fmt.Printf("error: %s\n", err.Error())
+			os.Exit(1)
+		}
+
+		return
+	}
+
 	var dir = flag.String("path", ".", "mbtiles path")
 	var layer = flag.String("layer", "", "layer")
 	var mapName = flag.String("map_name", "", "")
@@ -328,7 +343,7 @@ func main() {
 		return
 	}
 
-	var proxy model.Source
+	var proxy *model.Proxy
 
 	for _, s := range layers {
 		if s.GetKey() == *layer {
@@ -342,6 +357,8 @@ func main() {
 		return
 	}
 
+	defer proxy.Close()
+
 	title := *flagTitle
 
 	if title == "" {
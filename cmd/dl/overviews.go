@@ -0,0 +1,42 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/schollz/progressbar/v3"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+// runOverviews is "dl overviews" subcommand, it builds low zoom tiles of the mbtiles file from its higher zoom tiles.
+func runOverviews(args []string) error {
+	fs := flag.NewFlagSet("overviews", flag.ExitOnError)
+	minZoom := fs.Int("min-zoom", 0, "min zoom to build")
+
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "usage: %s overviews [-min-zoom N] file.mbtiles\n", os.Args[0])
+		fs.PrintDefaults()
+	}
+
+	if err := fs.Parse(args); err != nil {
+		return err
+	}
+
+	if fs.NArg() != 1 {
+		fs.Usage()
+		os.Exit(2)
+	}
+
+	var bar *progressbar.ProgressBar
+
+	return model.BuildOverviews(context.Background(), fs.Arg(0), *minZoom, func(z, n, total int) {
+		if n == 1 {
+			bar = progressbar.Default(int64(total), fmt.Sprintf("zoom %d", z))
+		}
+
+		_ = bar.Add(1)
+	})
+}
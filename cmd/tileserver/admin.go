@@ -0,0 +1,98 @@
+package main
+
+import (
+	"crypto/subtle"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+// adminAuth checks the admin token given as "Authorization: Bearer <token>", requests without it get 401
+// and ones with a wrong token get 403. Admin endpoints are disabled if there is no token.
+func adminAuth(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if app.adminToken == "" {
+			return fiber.NewError(fiber.StatusForbidden, "admin endpoints are disabled, set -admin-token")
+		}
+
+		token, ok := strings.CutPrefix(c.Get(fiber.HeaderAuthorization), "Bearer ")
+
+		if !ok {
+			c.Set(fiber.HeaderWWWAuthenticate, "Bearer")
+
+			return fiber.NewError(fiber.StatusUnauthorized, "admin token is required")
+		}
+
+		if subtle.ConstantTimeCompare([]byte(token), []byte(app.adminToken)) != 1 {
+			return fiber.NewError(fiber.StatusForbidden, "invalid admin token")
+		}
+
+		return c.Next()
+	}
+}
+
+func (app *App) getProxy(c *fiber.Ctx) (*model.Proxy, error) {
+	name, _ := url.QueryUnescape(c.Params("name"))
+
+	layer, _ := app.layers.Get(name)
+
+	if layer == nil {
+		return nil, fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("layer %s is not found", name))
+	}
+
+	p, ok := model.Unwrap(layer).(*model.Proxy)
+
+	if !ok {
+		return nil, fiber.NewError(fiber.StatusBadRequest, fmt.Sprintf("layer %s is not a proxy", name))
+	}
+
+	return p, nil
+}
+
+func purgeNotFoundHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		p, err := app.getProxy(c)
+
+		if err != nil {
+			return err
+		}
+
+		n, err := p.PurgeNotFound()
+
+		if err != nil {
+			app.logger.Error("purge error", "layer", p.GetKey(), "error", err)
+			return fiber.NewError(fiber.StatusInternalServerError, "purge error")
+		}
+
+		app.logger.Info(fmt.Sprintf("%s: %d not found markers removed", p.GetKey(), n))
+
+		return c.JSON(fiber.Map{"removed": n})
+	}
+}
+
+func setModeHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		p, err := app.getProxy(c)
+
+		if err != nil {
+			return err
+		}
+
+		m, err := model.ParseMode(c.Params("mode"))
+
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		p.SetMode(m)
+		app.logger.Info(fmt.Sprintf("%s: mode is set to %s", p.GetKey(), m))
+
+		mode, state := p.State()
+
+		return c.JSON(fiber.Map{"mode": mode, "state": state})
+	}
+}
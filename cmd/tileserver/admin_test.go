@@ -0,0 +1,185 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+// newProxyApp returns the app with the proxy layer "osm" of the upstream that is never asked.
+func newProxyApp(t *testing.T, token string) (*App, *model.Proxy) {
+	return newLayerApp(t, token, &model.LayerDescription{
+		Key:      "osm",
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      "http://127.0.0.1:1/{z}/{x}/{y}.png",
+	})
+}
+
+// newLayerApp returns the app with the proxy layer l and the file layer "file".
+func newLayerApp(t *testing.T, token string, l *model.LayerDescription) (*App, *model.Proxy) {
+	app, _ := newTestApp(t, pngSource(t, "file"))
+	app.adminToken = token
+	app.cacheDir = t.TempDir()
+
+	src, err := app.addProxy(l)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p := model.Unwrap(src).(*model.Proxy)
+	t.Cleanup(func() { _ = p.Close() })
+
+	return app, p
+}
+
+func adminRequest(method, target, token string) *http.Request {
+	req := httptest.NewRequest(method, target, nil)
+
+	if token != "" {
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	return req
+}
+
+func TestAdminAuth(t *testing.T) {
+	app, p := newProxyApp(t, "secret")
+	f := NewHttp(app)
+
+	tests := []struct {
+		name   string
+		req    *http.Request
+		status int
+	}{
+		{name: "no token", req: adminRequest(http.MethodPut, "/admin/layers/osm/mode/offline", ""), status: http.StatusUnauthorized},
+		{name: "basic auth", req: httptest.NewRequest(http.MethodPut, "/admin/layers/osm/mode/offline", nil), status: http.StatusUnauthorized},
+		{name: "wrong token", req: adminRequest(http.MethodPut, "/admin/layers/osm/mode/offline", "wrong"), status: http.StatusForbidden},
+		{name: "unknown layer", req: adminRequest(http.MethodPut, "/admin/layers/other/mode/offline", "secret"), status: http.StatusNotFound},
+		{name: "not a proxy", req: adminRequest(http.MethodPut, "/admin/layers/file/mode/offline", "secret"), status: http.StatusBadRequest},
+		{name: "unknown mode", req: adminRequest(http.MethodPut, "/admin/layers/osm/mode/sleep", "secret"), status: http.StatusBadRequest},
+	}
+
+	tests[1].req.SetBasicAuth("admin", "secret")
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, _ := doRequest(t, f, tt.req)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, must be %d", resp.StatusCode, tt.status)
+			}
+
+			if tt.status == http.StatusUnauthorized && resp.Header.Get("WWW-Authenticate") != "Bearer" {
+				t.Errorf("got WWW-Authenticate %q", resp.Header.Get("WWW-Authenticate"))
+			}
+		})
+	}
+
+	if mode, _ := p.State(); mode != model.ModeAuto {
+		t.Fatalf("mode is changed to %s by rejected requests", mode)
+	}
+
+	resp, body := doRequest(t, f, adminRequest(http.MethodPut, "/admin/layers/osm/mode/offline", "secret"))
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	var res map[string]any
+
+	if err := json.Unmarshal(body, &res); err != nil || res["mode"] != "offline" {
+		t.Errorf("got %s, %v", body, err)
+	}
+
+	if resp, _ := get(t, f, "/tiles/osm/1/0/0"); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Errorf("offline layer: got status %d, must be 503", resp.StatusCode)
+	}
+
+	resp, body = doRequest(t, f, adminRequest(http.MethodDelete, "/admin/layers/osm/notfound", "secret"))
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"removed":0}` {
+		t.Errorf("got status %d, %s", resp.StatusCode, body)
+	}
+}
+
+func TestAdminDisabled(t *testing.T) {
+	app, _ := newProxyApp(t, "")
+
+	resp, _ := doRequest(t, NewHttp(app), adminRequest(http.MethodPut, "/admin/layers/osm/mode/offline", "secret"))
+
+	if resp.StatusCode != http.StatusForbidden {
+		t.Errorf("got status %d, must be 403", resp.StatusCode)
+	}
+}
+
+func TestAdminCORS(t *testing.T) {
+	app, _ := newProxyApp(t, "secret")
+	f := NewHttp(app)
+
+	for target, allowed := range map[string]bool{
+		"/tiles/file/1/0/0":             true,
+		"/layers":                       true,
+		"/admin/layers/osm/notfound":    false,
+		"/ADMIN/layers/osm/mode/online": false,
+	} {
+		req := httptest.NewRequest(http.MethodOptions, target, nil)
+		req.Header.Set("Origin", "https://example.com")
+		req.Header.Set("Access-Control-Request-Method", http.MethodDelete)
+
+		resp, _ := doRequest(t, f, req)
+
+		if got := resp.Header.Get("Access-Control-Allow-Origin") != ""; got != allowed {
+			t.Errorf("%s: cors allowed is %v, must be %v", target, got, allowed)
+		}
+	}
+}
+
+func TestPurgeNotFound(t *testing.T) {
+	var hits atomic.Int32
+
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.WriteHeader(http.StatusNotFound)
+	}))
+	defer upstream.Close()
+
+	app, _ := newLayerApp(t, "secret", &model.LayerDescription{
+		Key:             "topo",
+		MaxZoom:         17,
+		TileType:        "png",
+		Url:             upstream.URL + "/{z}/{x}/{y}.png",
+		NotFoundTimeout: time.Hour,
+	})
+	f := NewHttp(app)
+
+	// the upstream is asked once, then the marker answers
+	for range 3 {
+		if resp, _ := get(t, f, "/tiles/topo/10/1/1"); resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("got status %d, must be 404", resp.StatusCode)
+		}
+	}
+
+	if h := hits.Load(); h != 1 {
+		t.Errorf("upstream hits: got %d, must be 1", h)
+	}
+
+	resp, body := doRequest(t, f, adminRequest(http.MethodDelete, "/admin/layers/topo/notfound", "secret"))
+
+	if resp.StatusCode != http.StatusOK || string(body) != `{"removed":1}` {
+		t.Fatalf("got status %d, %s", resp.StatusCode, body)
+	}
+
+	if resp, _ := get(t, f, "/tiles/topo/10/1/1"); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("got status %d, must be 404", resp.StatusCode)
+	}
+
+	if h := hits.Load(); h != 2 {
+		t.Errorf("upstream hits: got %d, must be 2", h)
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+func etag(t *model.TileData) string {
+	return `"` + t.Hash + `"`
+}
+
+func (app *App) setCacheHeaders(c *fiber.Ctx, t *model.TileData) {
+	maxAge := app.maxAge
+
+	if !t.Expires.IsZero() {
+		maxAge = max(time.Until(t.Expires), 0)
+	}
+
+	c.Set(fiber.HeaderETag, etag(t))
+	c.Set(fiber.HeaderCacheControl, fmt.Sprintf("public, max-age=%d", int(maxAge.Seconds())))
+
+	if !t.ModTime.IsZero() {
+		c.Set(fiber.HeaderLastModified, t.ModTime.UTC().Format(http.TimeFormat))
+	}
+}
+
+// notModified checks conditional request headers, If-None-Match takes precedence over If-Modified-Since.
+func notModified(c *fiber.Ctx, t *model.TileData) bool {
+	if inm := c.Get(fiber.HeaderIfNoneMatch); inm != "" {
+		tag := etag(t)
+
+		for _, s := range strings.Split(inm, ",") {
+			s = strings.TrimSpace(s)
+
+			if s == "*" || strings.TrimPrefix(s, "W/") == tag {
+				return true
+			}
+		}
+
+		return false
+	}
+
+	if ims := c.Get(fiber.HeaderIfModifiedSince); ims != "" && !t.ModTime.IsZero() {
+		tm, err := http.ParseTime(ims)
+
+		return err == nil && !t.ModTime.Truncate(time.Second).After(tm)
+	}
+
+	return false
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestTileCacheHeaders(t *testing.T) {
+	s := pngSource(t, "test")
+	_, f := newTestApp(t, s)
+
+	resp, body := get(t, f, "/tiles/test/1/0/0")
+
+	if resp.StatusCode != http.StatusOK || len(body) == 0 {
+		t.Fatalf("got status %d", resp.StatusCode)
+	}
+
+	tag := resp.Header.Get("ETag")
+
+	if tag == "" || tag[0] != '"' {
+		t.Errorf("wrong etag %q", tag)
+	}
+
+	if cc := resp.Header.Get("Cache-Control"); cc != "public, max-age=3600" {
+		t.Errorf("wrong cache control %q", cc)
+	}
+
+	if lm := resp.Header.Get("Last-Modified"); lm != "Tue, 02 Jan 2024 03:04:05 GMT" {
+		t.Errorf("wrong last modified %q", lm)
+	}
+
+	tests := []struct {
+		name    string
+		headers map[string]string
+		status  int
+	}{
+		{name: "etag", headers: map[string]string{"If-None-Match": tag}, status: http.StatusNotModified},
+		{name: "weak etag", headers: map[string]string{"If-None-Match": `"other", W/` + tag}, status: http.StatusNotModified},
+		{name: "any etag", headers: map[string]string{"If-None-Match": "*"}, status: http.StatusNotModified},
+		{name: "other etag", headers: map[string]string{"If-None-Match": `"other"`}, status: http.StatusOK},
+		{name: "not modified since", headers: map[string]string{"If-Modified-Since": "Tue, 02 Jan 2024 03:04:05 GMT"}, status: http.StatusNotModified},
+		{name: "modified since", headers: map[string]string{"If-Modified-Since": "Tue, 02 Jan 2024 03:04:04 GMT"}, status: http.StatusOK},
+		// If-None-Match takes precedence
+		{name: "etag and date", headers: map[string]string{"If-None-Match": `"other"`, "If-Modified-Since": "Tue, 02 Jan 2024 03:04:05 GMT"}, status: http.StatusOK},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(http.MethodGet, "/tiles/test/1/0/0", nil)
+
+			for k, v := range tt.headers {
+				req.Header.Set(k, v)
+			}
+
+			resp, body := doRequest(t, f, req)
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, must be %d", resp.StatusCode, tt.status)
+			}
+
+			if tt.status == http.StatusNotModified && len(body) > 0 {
+				t.Errorf("got %d bytes of 304 body", len(body))
+			}
+
+			if resp.Header.Get("ETag") != tag {
+				t.Errorf("wrong etag %q", resp.Header.Get("ETag"))
+			}
+		})
+	}
+}
@@ -1,11 +1,14 @@
 package main
 
 import (
+	"context"
 	"embed"
+	"errors"
 	"fmt"
 	"net/http"
 	"net/url"
 	"slices"
+	"strconv"
 	"strings"
 
 	"github.com/gofiber/fiber/v2"
@@ -38,8 +41,12 @@ func NewHttp(app *App) *fiber.App {
 		Format: "[${ip}]:${port} ${status} - ${locals:username} ${method} ${path} ${queryParams}\n",
 	}))
 
+	// admin endpoints are not allowed from other sites
 	f.Use(cors.New(cors.Config{
 		AllowOrigins: "*",
+		Next: func(c *fiber.Ctx) bool {
+			return strings.HasPrefix(strings.ToLower(c.Path()), "/admin/")
+		},
 	}))
 
 	f.Use(redirect.New(redirect.Config{
@@ -51,8 +58,22 @@ func NewHttp(app *App) *fiber.App {
 
 	f.Get("/", getIndexHandler(app))
 	f.Get("/layers", getLayersHandler(app))
+	f.Get("/tiles/:name.json", getTileJSONHandler(app))
+	f.Get("/tilejson/:name", getTileJSONHandler(app))
 	f.Get("/tiles/:name/:zoom/:x/:y", getTileHandler(app))
 
+	f.Get("/wms", getWMSHandler(app))
+	f.Get("/wmts", getWMTSHandler(app))
+	f.Get("/wmts/1.0.0/WMTSCapabilities.xml", getWMTSCapabilitiesHandler(app))
+	f.Get("/wmts/1.0.0/:name/:style/:set/:matrix/:row/:col", getWMTSTileHandler(app))
+
+	f.Get("/static/:layer", getStaticMapHandler(app))
+	f.Post("/static/:layer", getStaticMapHandler(app))
+
+	admin := f.Group("/admin", adminAuth(app))
+	admin.Delete("/layers/:name/notfound", purgeNotFoundHandler(app))
+	admin.Put("/layers/:name/mode/:mode", setModeHandler(app))
+
 	f.Use("/static", filesystem.New(filesystem.Config{
 		Root:       http.FS(embedDirStatic),
 		PathPrefix: "static",
@@ -82,12 +103,32 @@ func (app *App) getLayers(base string) []map[string]any {
 	r := make([]map[string]any, 0)
 
 	app.layers.All(func(c model.Source) bool {
+		if strings.HasSuffix(c.GetKey(), model.RetinaSuffix) {
+			return true
+		}
+
 		ld := make(map[string]any)
-		ld["url"] = base + "/tiles/" + url.QueryEscape(c.GetKey()) + "/{z}/{x}/{y}"
+		ld["url"] = tilesUrl(base, c, "")
+		ld["tilejson"] = base + "/tiles/" + url.QueryEscape(c.GetKey()) + ".json"
+
+		if _, ok := app.layers.Get(c.GetKey() + model.RetinaSuffix); ok {
+			ld["url_2x"] = tilesUrl(base, c, model.RetinaSuffix)
+		}
 		ld["min_zoom"] = c.GetMinZoom()
 		ld["max_zoom"] = c.GetMaxZoom()
 		ld["name"] = c.GetName()
 		ld["file"] = c.IsFile()
+
+		if m, ok := c.(*model.MemCache); ok {
+			ld["mem_hits"], ld["mem_misses"], ld["mem_size"] = m.Stats()
+		}
+
+		if p, ok := model.Unwrap(c).(*model.Proxy); ok {
+			ld["pending_refresh"] = p.PendingRefreshes()
+			ld["mode"], ld["state"] = p.State()
+			ld["cache_size"] = p.CacheSize()
+		}
+
 		r = append(r, ld)
 
 		return true
@@ -115,33 +156,137 @@ func getTileHandler(app *App) func(c *fiber.Ctx) error {
 			return fiber.NewError(fiber.StatusBadRequest, "error: invalid x value")
 		}
 
-		if y, err = c.ParamsInt("y"); err != nil {
+		ys, ext, hasExt := strings.Cut(c.Params("y"), ".")
+		ys, retina := strings.CutSuffix(ys, model.RetinaSuffix)
+
+		if y, err = strconv.Atoi(ys); err != nil {
 			return fiber.NewError(fiber.StatusBadRequest, "error: invalid y value")
 		}
 
+		var format string
+
+		if hasExt {
+			if format = extFormat(ext); format == "" {
+				return fiber.NewError(fiber.StatusBadRequest, "error: unsupported format "+ext)
+			}
+		}
+
+		if retina {
+			name += model.RetinaSuffix
+		}
+
 		layer, _ := app.layers.Get(name)
 
 		if layer == nil {
 			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("layer %s is not found", name))
 		}
 
-		ct, data, err := layer.GetTile(c.Context(), zoom, x, y)
+		return app.sendTile(c, layer, zoom, x, y, format, !hasExt && app.negotiate)
+	}
+}
+
+// sendTile sends the tile transcoded to the format, or to the format picked by the Accept header if negotiate is set.
+func (app *App) sendTile(c *fiber.Ctx, layer model.Source, zoom, x, y int, format string, negotiate bool) error {
+	t, err := layer.GetTile(c.Context(), zoom, x, y)
+
+	if err != nil {
+		return app.tileError(c, err)
+	}
+
+	if negotiate {
+		c.Vary(fiber.HeaderAccept)
+		format = acceptFormat(c, t)
+	}
+
+	if format != "" {
+		if t, err = app.transcoder.Transcode(t, format); err != nil {
+			return app.tileError(c, err)
+		}
+	}
+
+	app.setCacheHeaders(c, t)
+
+	if notModified(c, t) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.Set("Content-Type", t.ContentType)
+	_, err1 := c.Write(t.Data)
+	if err1 != nil {
+		app.logger.Error("error writing response", "error", err1)
+	}
+
+	return err1
+}
+
+// extFormat returns the tile format for the file extension, or empty string if it is not supported.
+func extFormat(ext string) string {
+	switch strings.ToLower(ext) {
+	case "jpg", "jpeg":
+		return "jpeg"
+	case "png":
+		return "png"
+	case "webp":
+		return "webp"
+	default:
+		return ""
+	}
+}
+
+// acceptFormat returns the format to transcode the tile to if the Accept header does not allow the tile format,
+// wildcards allow any format, so browsers get tiles as is.
+func acceptFormat(c *fiber.Ctx, t *model.TileData) string {
+	if c.Accepts(t.ContentType) != "" {
+		return ""
+	}
+
+	var offers []string
 
-		if err != nil {
-			app.logger.Error("error getting tile", "error", err)
-			return fiber.NewError(fiber.StatusNotFound, "error getting tile")
+	for _, f := range []string{"webp", "png", "jpeg"} {
+		if ct := model.ImageFormats[f]; ct != t.ContentType {
+			offers = append(offers, ct)
 		}
+	}
 
-		if data != nil {
-			c.Set("Content-Type", ct)
-			_, err1 := c.Write(data)
-			if err1 != nil {
-				app.logger.Error("error writing response", "error", err1)
-			}
+	ct := c.Accepts(offers...)
 
-			return err1
+	for f, v := range model.ImageFormats {
+		if v == ct {
+			return f
 		}
+	}
+
+	return ""
+}
+
+// statusClientClosed is the nginx status of requests canceled by the client.
+const statusClientClosed = 499
+
+// tileError maps an error from Source.GetTile to the http status.
+func (app *App) tileError(c *fiber.Ctx, err error) error {
+	var upErr *model.UpstreamError
+
+	if errors.As(err, &upErr) && upErr.Status != 0 {
+		c.Set("X-Upstream-Status", strconv.Itoa(upErr.Status))
+	}
 
+	switch {
+	case errors.Is(err, context.Canceled):
+		// the client is gone, nobody reads the answer
+		return c.SendStatus(statusClientClosed)
+	case errors.Is(err, model.ErrNotFound):
 		return fiber.ErrNotFound
+	case errors.Is(err, model.ErrOutOfBounds):
+		return c.SendStatus(fiber.StatusNoContent)
+	case errors.Is(err, model.ErrOutOfRange):
+		return fiber.NewError(fiber.StatusBadRequest, err.Error())
+	case errors.Is(err, model.ErrOffline):
+		return fiber.NewError(fiber.StatusServiceUnavailable, err.Error())
+	case upErr != nil:
+		app.logger.Warn("upstream error", "error", err)
+		return fiber.NewError(fiber.StatusBadGateway, err.Error())
+	default:
+		app.logger.Error("error getting tile", "error", err)
+		return fiber.NewError(fiber.StatusInternalServerError, "error getting tile")
 	}
 }
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/jpeg"
+	"image/png"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/gofiber/fiber/v2"
+	_ "golang.org/x/image/webp"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+// testSource returns the same tile for any coordinates, or the error if it is set.
+type testSource struct {
+	key     string
+	ct      string
+	data    []byte
+	err     error
+	modTime time.Time
+	minZoom int
+}
+
+func (s *testSource) GetTile(_ context.Context, _, _, _ int) (*model.TileData, error) {
+	if s.err != nil {
+		return nil, s.err
+	}
+
+	return model.NewTileData(s.ct, s.data, s.modTime), nil
+}
+
+func (s *testSource) GetMinZoom() int        { return s.minZoom }
+func (s *testSource) GetMaxZoom() int        { return 18 }
+func (s *testSource) GetKey() string         { return s.key }
+func (s *testSource) GetName() string        { return s.key }
+func (s *testSource) IsTms() bool            { return false }
+func (s *testSource) IsFile() bool           { return true }
+func (s *testSource) GetContentType() string { return s.ct }
+
+func solidPNG(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// pngSource is a layer of red png tiles.
+func pngSource(t *testing.T, key string) *testSource {
+	return &testSource{
+		key:     key,
+		ct:      "image/png",
+		data:    solidPNG(t, color.RGBA{R: 255, A: 255}),
+		modTime: time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC),
+	}
+}
+
+// newTestApp returns the http server with the layers, as it is set up by main with default flags.
+func newTestApp(t *testing.T, layers ...model.Source) (*App, *fiber.App) {
+	app := NewApp("")
+	app.maxAge = time.Hour
+	app.logger = slog.New(slog.NewTextHandler(io.Discard, nil))
+	app.transcoder = model.NewTranscoder(85, 1<<20)
+	app.staticMaps = model.NewStaticMaps(app.transcoder, 1<<20, time.Hour)
+	app.janitor = model.NewCacheJanitor(0, app.logger)
+
+	t.Cleanup(app.janitor.Close)
+
+	for _, l := range layers {
+		app.layers.Add(l)
+	}
+
+	return app, NewHttp(app)
+}
+
+func doRequest(t *testing.T, f *fiber.App, req *http.Request) (*http.Response, []byte) {
+	resp, err := f.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return resp, body
+}
+
+func get(t *testing.T, f *fiber.App, target string) (*http.Response, []byte) {
+	return doRequest(t, f, httptest.NewRequest(http.MethodGet, target, nil))
+}
+
+func TestTileErrors(t *testing.T) {
+	tests := []struct {
+		err      error
+		status   int
+		upstream string
+	}{
+		{err: context.Canceled, status: statusClientClosed},
+		{err: model.ErrNotFound, status: http.StatusNotFound},
+		{err: &model.UpstreamError{Url: "http://up", Status: 404}, status: http.StatusNotFound, upstream: "404"},
+		{err: model.ErrOutOfBounds, status: http.StatusNoContent},
+		{err: model.ErrOutOfRange, status: http.StatusBadRequest},
+		{err: model.ErrOffline, status: http.StatusServiceUnavailable},
+		{err: &model.UpstreamError{Url: "http://up", Status: 500}, status: http.StatusBadGateway, upstream: "500"},
+		{err: &model.UpstreamError{Url: "http://up", Err: errors.New("connection refused")}, status: http.StatusBadGateway},
+		{err: errors.New("disk error"), status: http.StatusInternalServerError},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.err.Error(), func(t *testing.T) {
+			_, f := newTestApp(t, &testSource{key: "test", ct: "image/png", err: tt.err})
+
+			resp, _ := get(t, f, "/tiles/test/1/0/0")
+
+			if resp.StatusCode != tt.status {
+				t.Errorf("got status %d, must be %d", resp.StatusCode, tt.status)
+			}
+
+			if s := resp.Header.Get("X-Upstream-Status"); s != tt.upstream {
+				t.Errorf("got upstream status %q, must be %q", s, tt.upstream)
+			}
+		})
+	}
+}
+
+func TestTileRequestErrors(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "test"))
+
+	for target, status := range map[string]int{
+		"/tiles/test/1/0/0":     http.StatusOK,
+		"/tiles/other/1/0/0":    http.StatusNotFound,
+		"/tiles/test/z/0/0":     http.StatusBadRequest,
+		"/tiles/test/1/x/0":     http.StatusBadRequest,
+		"/tiles/test/1/0/y":     http.StatusBadRequest,
+		"/tiles/test/1/0/0.gif": http.StatusBadRequest,
+	} {
+		if resp, _ := get(t, f, target); resp.StatusCode != status {
+			t.Errorf("%s: got status %d, must be %d", target, resp.StatusCode, status)
+		}
+	}
+}
+
+func TestTileFormats(t *testing.T) {
+	app, f := newTestApp(t, pngSource(t, "test"))
+
+	tests := []struct {
+		target string
+		accept string
+		ct     string
+	}{
+		{target: "/tiles/test/1/0/0", ct: "image/png"},
+		{target: "/tiles/test/1/0/0.png", ct: "image/png"},
+		{target: "/tiles/test/1/0/0.jpg", ct: "image/jpeg"},
+		{target: "/tiles/test/1/0/0.jpeg", ct: "image/jpeg"},
+		{target: "/tiles/test/1/0/0.webp", ct: "image/webp"},
+		// the extension wins over the Accept header
+		{target: "/tiles/test/1/0/0.jpg", accept: "image/webp", ct: "image/jpeg"},
+		// tiles without extension are sent as is without -negotiate
+		{target: "/tiles/test/1/0/0", accept: "image/webp", ct: "image/png"},
+	}
+
+	for _, tt := range tests {
+		req := httptest.NewRequest(http.MethodGet, tt.target, nil)
+		req.Header.Set("Accept", tt.accept)
+
+		resp, body := doRequest(t, f, req)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", tt.target, resp.StatusCode)
+		}
+
+		if ct := resp.Header.Get("Content-Type"); ct != tt.ct {
+			t.Errorf("%s: got %s, must be %s", tt.target, ct, tt.ct)
+		}
+
+		if _, format, err := image.Decode(bytes.NewReader(body)); err != nil || "image/"+format != tt.ct {
+			t.Errorf("%s: got %s image, %v", tt.target, format, err)
+		}
+
+		if v := resp.Header.Get("Vary"); v != "" {
+			t.Errorf("%s: got vary %q without -negotiate", tt.target, v)
+		}
+	}
+
+	app.negotiate = true
+
+	for accept, ct := range map[string]string{
+		"":                             "image/png",
+		"*/*":                          "image/png",
+		"image/*":                      "image/png",
+		"image/webp,*/*;q=0.8":         "image/png",
+		"image/webp":                   "image/webp",
+		"image/jpeg":                   "image/jpeg",
+		"image/jpeg;q=0.5, image/webp": "image/webp",
+	} {
+		req := httptest.NewRequest(http.MethodGet, "/tiles/test/1/0/0", nil)
+		req.Header.Set("Accept", accept)
+
+		resp, _ := doRequest(t, f, req)
+
+		if got := resp.Header.Get("Content-Type"); got != ct {
+			t.Errorf("accept %q: got %s, must be %s", accept, got, ct)
+		}
+
+		if v := resp.Header.Get("Vary"); v != "Accept" {
+			t.Errorf("accept %q: got vary %q", accept, v)
+		}
+	}
+
+	// tiles with extension are not negotiated
+	req := httptest.NewRequest(http.MethodGet, "/tiles/test/1/0/0.jpg", nil)
+	req.Header.Set("Accept", "image/webp")
+
+	if resp, _ := doRequest(t, f, req); resp.Header.Get("Content-Type") != "image/jpeg" || resp.Header.Get("Vary") != "" {
+		t.Errorf("got %s, vary %q", resp.Header.Get("Content-Type"), resp.Header.Get("Vary"))
+	}
+}
@@ -35,23 +35,34 @@ func (h *Layers) Add(c model.Source) {
 		return
 	}
 
-	h.data.Store(c.GetKey(), c)
+	if old, ok := h.data.Swap(c.GetKey(), c); ok {
+		invalidate(old)
+	}
 }
 
 func (h *Layers) Remove(key string) {
-	h.data.Delete(key)
+	if old, ok := h.data.LoadAndDelete(key); ok {
+		invalidate(old)
+	}
 }
 
 func (h *Layers) RemoveFiles() {
 	h.All(func(c model.Source) bool {
 		if c.IsFile() {
-			h.data.Delete(c.GetKey())
+			h.Remove(c.GetKey())
 		}
 
 		return true
 	})
 }
 
+// invalidate drops in-memory cached tiles of the replaced or removed source.
+func invalidate(v any) {
+	if c, ok := v.(interface{ Invalidate() }); ok {
+		c.Invalidate()
+	}
+}
+
 func (h *Layers) All(f func(c model.Source) bool) {
 	h.data.Range(func(_, value any) bool {
 		if c, ok := value.(model.Source); ok {
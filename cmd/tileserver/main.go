@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
+	"errors"
 	"flag"
 	"fmt"
+	"io"
 	"log/slog"
 	"net"
 	"os"
@@ -10,27 +13,60 @@ import (
 	"path"
 	"slices"
 	"strings"
+	"sync"
 	"syscall"
+	"time"
 
+	"github.com/dustin/go-humanize"
 	"github.com/fsnotify/fsnotify"
+	"github.com/gofiber/fiber/v2"
 	"gopkg.in/yaml.v3"
 
 	"github.com/kdudkov/tileproxy/pkg/model"
 )
 
+// closeTimeout is how long the server waits on exit for running requests and background tile refreshes.
+const closeTimeout = 10 * time.Second
+
+// defaultCompositeCache is the size of rendered tiles cache of composite layers without memCacheSize.
+const defaultCompositeCache = 64 << 20
+
+// defaultUnderzoomCache is the size of downsampled tiles cache of file layers without -mem-cache. Without it
+// every tile below the min zoom is made from 4^levels source tiles again.
+const defaultUnderzoomCache = 64 << 20
+
 type App struct {
-	addr     string
-	filesDir string
-	cacheDir string
-	logger   *slog.Logger
-	layers   *Layers
+	addr       string
+	filesDir   string
+	cacheDir   string
+	maxAge     time.Duration
+	adminToken string
+	memCache   int64
+	overzoom   int
+	underzoom  int
+	negotiate  bool
+	logger     *slog.Logger
+	transcoder *model.Transcoder
+	staticMaps *model.StaticMaps
+	layers     *Layers
+	// sources are layers without over-, underzoom and memory cache, multilayers are made of them
+	sources *Layers
+	janitor *model.CacheJanitor
+	srv     *fiber.App
+
+	// multis are multilayers from layers.yml, they are made again when files are reloaded
+	multis []*model.LayerDescription
+	// infos are TileJSON fields of composites and multilayers from layers.yml
+	infos map[string]model.LayerInfo
 }
 
 func NewApp(addr string) *App {
 	return &App{
-		layers: NewLayers(),
-		logger: slog.Default(),
-		addr:   addr,
+		layers:  NewLayers(),
+		sources: NewLayers(),
+		infos:   make(map[string]model.LayerInfo),
+		logger:  slog.Default(),
+		addr:    addr,
 	}
 }
 
@@ -47,14 +83,137 @@ func (app *App) addDefaultSources() error {
 		return err
 	}
 
+	var composites []*model.LayerDescription
+
 	for _, l := range res {
-		p := model.NewProxy(l, app.logger, app.cacheDir)
-		app.layers.Add(p)
+		switch strings.ToLower(l.Type) {
+		case "", model.LayerProxy:
+		case model.LayerComposite:
+			composites = append(composites, l)
+			app.infos[l.Key], app.infos[l.Key+model.RetinaSuffix] = l.Info(), l.Info()
+			continue
+		case model.LayerMulti:
+			app.multis = append(app.multis, l)
+			app.infos[l.Key], app.infos[l.Key+model.RetinaSuffix] = l.Info(), l.Info()
+			continue
+		default:
+			app.logger.Error("invalid layer "+l.Key, "error", "unknown type "+l.Type)
+			continue
+		}
+
+		src, err := app.addProxy(l)
+
+		if err != nil {
+			app.logger.Error("invalid layer "+l.Key, "error", err)
+			continue
+		}
+
+		// 2x tiles are fetched from upstream if it supports them, or stitched from 1x tiles
+		if l.HasRetina() {
+			if _, err := app.addProxy(l.Retina()); err != nil {
+				app.logger.Error("invalid layer "+l.Key+model.RetinaSuffix, "error", err)
+			}
+		} else {
+			app.layers.Add(withMemCache(model.NewRetina(src), int64(l.MemCacheSize)))
+			app.sources.Add(model.NewRetina(model.Unwrap(src)))
+		}
+	}
+
+	if err := compositeCycle(composites); err != nil {
+		return err
+	}
+
+	for _, l := range composites {
+		if err := app.addComposite(l); err != nil {
+			app.logger.Error("invalid layer "+l.Key, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// addComposite adds the composite layer and its 2x variant made of 2x variants of the layers.
+// Layers are looked up on every request, so they may be proxies, files or other composites.
+func (app *App) addComposite(l *model.LayerDescription) error {
+	size := int64(l.MemCacheSize)
+
+	if size == 0 {
+		size = defaultCompositeCache
+	}
+
+	c, err := model.NewComposite(l.Key, l.Name, l.Layers, app.layers.Get, size)
+
+	if err != nil {
+		return err
+	}
+
+	app.layers.Add(c)
+	app.layers.Add(c.Retina())
+
+	return nil
+}
+
+// compositeCycle checks that composites do not refer to each other in a loop.
+func compositeCycle(composites []*model.LayerDescription) error {
+	refs := make(map[string][]string)
+
+	for _, l := range composites {
+		for _, r := range l.Layers {
+			refs[l.Key] = append(refs[l.Key], r.Key)
+		}
+	}
+
+	// 1 - being visited, 2 - done
+	state := make(map[string]int)
+
+	var visit func(key string) error
+
+	visit = func(key string) error {
+		switch state[key] {
+		case 1:
+			return fmt.Errorf("composite layer %s refers to itself", key)
+		case 2:
+			return nil
+		}
+
+		state[key] = 1
+
+		for _, k := range refs[key] {
+			if err := visit(k); err != nil {
+				return err
+			}
+		}
+
+		state[key] = 2
+
+		return nil
+	}
+
+	for _, l := range composites {
+		if err := visit(l.Key); err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+func (app *App) addProxy(l *model.LayerDescription) (model.Source, error) {
+	p, err := model.NewProxy(l, app.logger, app.cacheDir)
+
+	if err != nil {
+		return nil, err
+	}
+
+	app.janitor.Add(p)
+	app.sources.Add(p)
+
+	src := withMemCache(withOverzoom(p, l.Overzoom), int64(l.MemCacheSize))
+	app.layers.Add(src)
+
+	return src, nil
+}
+
 func (app *App) addFileSources() error {
 	files, err := os.ReadDir(app.filesDir)
 	if err != nil {
@@ -62,6 +221,7 @@ func (app *App) addFileSources() error {
 	}
 
 	app.layers.RemoveFiles()
+	app.sources.RemoveFiles()
 
 	for _, f := range files {
 		p := path.Join(app.filesDir, f.Name())
@@ -85,20 +245,94 @@ func (app *App) addFileSources() error {
 			continue
 		}
 
-		app.layers.Add(l)
+		app.addFileSource(l)
 		app.logger.Info(fmt.Sprintf("loaded file %s, %s", f.Name(), l.String()))
 	}
 
+	for _, l := range app.multis {
+		if err := app.addMultiLayer(l); err != nil {
+			app.logger.Error("invalid layer "+l.Key, "error", err)
+		}
+	}
+
+	return nil
+}
+
+// addMultiLayer adds the multilayer from layers.yml, its layers are looked up in order, each ref may be a glob.
+func (app *App) addMultiLayer(l *model.LayerDescription) error {
+	var layers []model.Source
+
+	for _, r := range l.Layers {
+		matched := app.matchLayers(r.Key, l.Key)
+
+		if len(matched) == 0 {
+			app.logger.Warn(fmt.Sprintf("layer %s: no layers match %s", l.Key, r.Key))
+			continue
+		}
+
+		for _, s := range matched {
+			layers = append(layers, r.Limit(s))
+		}
+	}
+
+	if len(layers) == 0 {
+		return errors.New("no layers")
+	}
+
+	name := l.Name
+
+	if name == "" {
+		name = l.Key
+	}
+
+	app.addFileSource(model.NewMultilayer(l.Key, name, layers))
+	app.logger.Info(fmt.Sprintf("loaded multilayer %s, %d layers", l.Key, len(layers)))
+
 	return nil
 }
 
+// matchLayers returns the source with the key, or sources matching the glob sorted by key.
+// 2x layers match only a glob ending with @2x. The sources are not wrapped, as the multilayer gets
+// its own over-, underzoom and memory cache.
+func (app *App) matchLayers(pattern, self string) []model.Source {
+	if !strings.ContainsAny(pattern, "*?[") {
+		if s, ok := app.sources.Get(pattern); ok {
+			return []model.Source{s}
+		}
+
+		return nil
+	}
+
+	var res []model.Source
+
+	app.sources.All(func(s model.Source) bool {
+		k := s.GetKey()
+
+		if k == self || strings.HasSuffix(k, model.RetinaSuffix) != strings.HasSuffix(pattern, model.RetinaSuffix) {
+			return true
+		}
+
+		if ok, _ := path.Match(pattern, k); ok {
+			res = append(res, s)
+		}
+
+		return true
+	})
+
+	slices.SortFunc(res, func(a, b model.Source) int {
+		return strings.Compare(a.GetKey(), b.GetKey())
+	})
+
+	return res
+}
+
 func (app *App) addMultiFiles(name, dpath string) error {
 	files, err := os.ReadDir(dpath)
 	if err != nil {
 		return err
 	}
 
-	layers := make([]*model.Layer, 0)
+	layers := make([]model.Source, 0)
 
 	for _, f := range files {
 		p := path.Join(dpath, f.Name())
@@ -125,16 +359,53 @@ func (app *App) addMultiFiles(name, dpath string) error {
 		return nil
 	}
 
-	slices.SortFunc(layers, func(l1, l2 *model.Layer) int {
+	slices.SortFunc(layers, func(l1, l2 model.Source) int {
 		return strings.Compare(l1.GetName(), l2.GetName())
 	})
 
-	app.layers.Add(model.NewMultilayer(name, name, layers))
+	app.addFileSource(model.NewMultilayer(name, name, layers))
 	app.logger.Info(fmt.Sprintf("loaded multilayer %s, %d files", name, len(layers)))
 
 	return nil
 }
 
+// addFileSource adds the file layer with under- and overzoom and memory cache, and its 2x variant.
+func (app *App) addFileSource(s model.Source) {
+	app.sources.Add(s)
+	app.sources.Add(model.NewRetina(s))
+
+	if app.underzoom > 0 {
+		size := app.memCache
+
+		if size <= 0 {
+			size = defaultUnderzoomCache
+		}
+
+		s = model.NewUnderzoom(s, app.underzoom, size)
+	}
+
+	s = withMemCache(withOverzoom(s, app.overzoom), app.memCache)
+
+	app.layers.Add(s)
+	app.layers.Add(withMemCache(model.NewRetina(s), app.memCache))
+}
+
+func withMemCache(s model.Source, size int64) model.Source {
+	if size <= 0 {
+		return s
+	}
+
+	return model.NewMemCache(s, size)
+}
+
+func withOverzoom(s model.Source, levels int) model.Source {
+	if levels <= 0 {
+		return s
+	}
+
+	return model.NewOverzoom(s, levels)
+}
+
 func (app *App) Run() {
 	if err := os.MkdirAll(app.cacheDir, 0777); err != nil {
 		panic(err)
@@ -150,12 +421,14 @@ func (app *App) Run() {
 		panic(err)
 	}
 
-	http := NewHttp(app)
+	app.janitor.Start()
+
+	app.srv = NewHttp(app)
 
 	app.logger.Info("listening on " + app.addr)
 
 	go func() {
-		if err := http.Listen(app.addr); err != nil {
+		if err := app.srv.Listen(app.addr); err != nil {
 			panic(err)
 		}
 	}()
@@ -203,8 +476,50 @@ func (app *App) watch(watcher *fsnotify.Watcher) {
 	}
 }
 
+// close stops the http server and closes the layers within closeTimeout. Wrapped layers are closed once
+// through the source they wrap, all at once, so proxies wait for their background refreshes together.
 func (app *App) close() {
+	ctx, cancel := context.WithTimeout(context.Background(), closeTimeout)
+	defer cancel()
+
+	if err := app.srv.ShutdownWithContext(ctx); err != nil {
+		app.logger.Error("http shutdown error", slog.Any("error", err))
+	}
+
+	app.janitor.Close()
+
+	closed := make(map[model.Source]bool)
+
+	var wg sync.WaitGroup
+
+	app.layers.All(func(c model.Source) bool {
+		s := model.Unwrap(c)
+
+		if closed[s] {
+			return true
+		}
+
+		closed[s] = true
+
+		wg.Go(func() {
+			var err error
+
+			switch s := s.(type) {
+			case *model.Proxy:
+				err = s.Shutdown(ctx)
+			case io.Closer:
+				err = s.Close()
+			}
+
+			if err != nil {
+				app.logger.Error("close error", "layer", s.GetKey(), "error", err)
+			}
+		})
+
+		return true
+	})
 
+	wg.Wait()
 }
 
 func (app *App) loop() {
@@ -234,6 +549,16 @@ func main() {
 	var filesDir = flag.String("files", "./data", "mbtiles path")
 	var cacheDir = flag.String("cache", "./data", "cache path")
 	var addr = flag.String("addr", ":8888", "listen address")
+	var maxAge = flag.Duration("max-age", time.Hour, "max-age for tiles that never expire")
+	var cacheSize = flag.String("cache-size", "", "total proxy cache quota, e.g. 50GB")
+	var memCache = flag.String("mem-cache", "", "in-memory tile cache size for each file layer, e.g. 64MB")
+	var overzoom = flag.Int("overzoom", 0, "zoom levels above max zoom of file layers made by upscaling")
+	var underzoom = flag.Int("underzoom", 0, "zoom levels below min zoom of file layers made by downsampling")
+	var jpegQuality = flag.Int("jpeg-quality", 85, "quality of tiles transcoded to jpeg, 1-100")
+	var negotiate = flag.Bool("negotiate", false, "transcode tiles without an extension to a format from the Accept header if it does not accept the layer format")
+	var transcodeCache = flag.String("transcode-cache", "64MB", "in-memory cache size for transcoded tiles")
+	var staticCache = flag.String("static-cache", "64MB", "in-memory cache size for static maps")
+	var adminToken = flag.String("admin-token", os.Getenv("ADMIN_TOKEN"), "token for /admin endpoints, they are disabled without it")
 	var debug = flag.Bool("debug", false, "")
 
 	flag.Parse()
@@ -247,8 +572,56 @@ func main() {
 
 	slog.SetDefault(slog.New(h))
 
+	var maxCacheSize, memCacheSize uint64
+
+	if *cacheSize != "" {
+		var err error
+
+		if maxCacheSize, err = humanize.ParseBytes(*cacheSize); err != nil {
+			fmt.Printf("invalid cache size: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *memCache != "" {
+		var err error
+
+		if memCacheSize, err = humanize.ParseBytes(*memCache); err != nil {
+			fmt.Printf("invalid memory cache size: %s\n", err)
+			os.Exit(1)
+		}
+	}
+
+	if *jpegQuality < 1 || *jpegQuality > 100 {
+		fmt.Printf("invalid jpeg quality: %d\n", *jpegQuality)
+		os.Exit(1)
+	}
+
+	transcodeCacheSize, err := humanize.ParseBytes(*transcodeCache)
+
+	if err != nil {
+		fmt.Printf("invalid transcode cache size: %s\n", err)
+		os.Exit(1)
+	}
+
+	staticCacheSize, err := humanize.ParseBytes(*staticCache)
+
+	if err != nil {
+		fmt.Printf("invalid static map cache size: %s\n", err)
+		os.Exit(1)
+	}
+
 	app := NewApp(*addr)
 	app.filesDir = *filesDir
 	app.cacheDir = *cacheDir
+	app.maxAge = *maxAge
+	app.adminToken = *adminToken
+	app.memCache = int64(memCacheSize)
+	app.overzoom = *overzoom
+	app.underzoom = *underzoom
+	app.negotiate = *negotiate
+	app.transcoder = model.NewTranscoder(*jpegQuality, int64(transcodeCacheSize))
+	app.staticMaps = model.NewStaticMaps(app.transcoder, int64(staticCacheSize), *maxAge)
+	app.janitor = model.NewCacheJanitor(int64(maxCacheSize), app.logger)
 	app.Run()
 }
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+const (
+	staticMaxSize     = 2048
+	staticDefaultSize = 512
+	staticMaxZoom     = 24
+)
+
+// getStaticMapHandler renders /static/:layer?center=lat,lon&zoom=z or ?bbox=minlon,minlat,maxlon,maxlat maps,
+// other /static requests are left to the static files.
+func getStaticMapHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		if c.Query("center") == "" && c.Query("bbox") == "" {
+			if c.Method() == fiber.MethodPost {
+				return fiber.NewError(fiber.StatusBadRequest, "center or bbox is required")
+			}
+
+			return c.Next()
+		}
+
+		name, _ := url.QueryUnescape(c.Params("layer"))
+
+		layer, _ := app.layers.Get(name)
+
+		if layer == nil {
+			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("layer %s is not found", name))
+		}
+
+		m, err := staticMap(c)
+
+		if err != nil {
+			return fiber.NewError(fiber.StatusBadRequest, err.Error())
+		}
+
+		if c.Method() == fiber.MethodPost && len(c.Body()) > 0 {
+			overlays, err := model.ParseGeoJSON(c.Body())
+
+			if err != nil {
+				return fiber.NewError(fiber.StatusBadRequest, err.Error())
+			}
+
+			m.Overlays = append(m.Overlays, overlays...)
+		}
+
+		t, err := app.staticMaps.Render(c.Context(), layer, m)
+
+		if err != nil {
+			return app.tileError(c, err)
+		}
+
+		app.setCacheHeaders(c, t)
+
+		if notModified(c, t) {
+			return c.SendStatus(fiber.StatusNotModified)
+		}
+
+		c.Set(fiber.HeaderContentType, t.ContentType)
+
+		return c.Send(t.Data)
+	}
+}
+
+// staticMap parses the map query parameters.
+func staticMap(c *fiber.Ctx) (*model.StaticMap, error) {
+	width, height := staticDefaultSize, staticDefaultSize
+
+	if s := c.Query("size"); s != "" {
+		w, h, _ := strings.Cut(strings.ToLower(s), "x")
+
+		var err1, err2 error
+		width, err1 = strconv.Atoi(w)
+		height, err2 = strconv.Atoi(h)
+
+		if err1 != nil || err2 != nil || width < 1 || height < 1 || width > staticMaxSize || height > staticMaxSize {
+			return nil, fmt.Errorf("invalid size %s", s)
+		}
+	}
+
+	m := &model.StaticMap{Format: extFormat(c.Query("format", "png"))}
+
+	if m.Format != "png" && m.Format != "jpeg" {
+		return nil, fmt.Errorf("unsupported format %s", c.Query("format"))
+	}
+
+	if s := c.Query("center"); s != "" {
+		p, ok := parseLatLon(s)
+
+		if !ok {
+			return nil, fmt.Errorf("invalid center %s", s)
+		}
+
+		zoom, err := strconv.Atoi(c.Query("zoom"))
+
+		if err != nil || zoom < 0 || zoom > staticMaxZoom {
+			return nil, fmt.Errorf("invalid zoom %s", c.Query("zoom"))
+		}
+
+		m.Map = model.CenterMap(p[1], p[0], zoom, width, height)
+	} else {
+		b, ok := parseBBox(c.Query("bbox"))
+
+		if !ok || b[0] >= b[2] || b[1] >= b[3] || b[1] < -90 || b[3] > 90 {
+			return nil, fmt.Errorf("invalid bbox %s", c.Query("bbox"))
+		}
+
+		m.Map = model.BoundsMap(b, width, height)
+	}
+
+	args := c.Request().URI().QueryArgs()
+
+	for _, v := range args.PeekMulti("markers") {
+		o, err := parseOverlay(model.OverlayMarker, string(v))
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.Overlays = append(m.Overlays, o)
+	}
+
+	for _, v := range args.PeekMulti("path") {
+		o, err := parseOverlay(model.OverlayLine, string(v))
+
+		if err != nil {
+			return nil, err
+		}
+
+		m.Overlays = append(m.Overlays, o)
+	}
+
+	return m, nil
+}
+
+// parseOverlay parses markers=color:red|size:8|lat,lon|lat,lon or path=color:blue|weight:3|fillcolor:0x3388ff40|lat,lon|...
+// style and points. A path with fillcolor is a polygon.
+func parseOverlay(kind, s string) (model.Overlay, error) {
+	o := model.NewOverlay(kind)
+	fill := false
+
+	for _, part := range strings.Split(s, "|") {
+		k, v, ok := strings.Cut(part, ":")
+
+		if !ok {
+			p, ok := parseLatLon(part)
+
+			if !ok {
+				return o, fmt.Errorf("invalid %s point %s", kind, part)
+			}
+
+			o.Points = append(o.Points, p)
+
+			continue
+		}
+
+		var err error
+
+		switch k {
+		case "color":
+			o.Color, ok = model.ParseColor(v)
+		case "fillcolor":
+			o.Fill, ok = model.ParseColor(v)
+			fill = true
+		case "size":
+			o.Size, err = strconv.ParseFloat(v, 64)
+			ok = err == nil && o.Size > 0 && o.Size <= 50
+		case "weight":
+			o.Width, err = strconv.ParseFloat(v, 64)
+			ok = err == nil && o.Width >= 0 && o.Width <= 50
+		default:
+			ok = false
+		}
+
+		if !ok {
+			return o, fmt.Errorf("invalid %s style %s", kind, part)
+		}
+	}
+
+	if kind == model.OverlayLine && fill {
+		o.Kind = model.OverlayPolygon
+	}
+
+	return o, nil
+}
+
+// parseLatLon parses lat,lon and returns it as lon, lat.
+func parseLatLon(s string) ([2]float64, bool) {
+	lat, lon, ok := strings.Cut(s, ",")
+
+	if !ok {
+		return [2]float64{}, false
+	}
+
+	y, err1 := strconv.ParseFloat(strings.TrimSpace(lat), 64)
+	x, err2 := strconv.ParseFloat(strings.TrimSpace(lon), 64)
+
+	if err1 != nil || err2 != nil || y < -90 || y > 90 || x < -360 || x > 360 {
+		return [2]float64{}, false
+	}
+
+	return [2]float64{x, y}, true
+}
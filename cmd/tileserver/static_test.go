@@ -0,0 +1,118 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStaticMap(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "osm"))
+
+	tests := []struct {
+		target string
+		status int
+		ct     string
+		size   image.Point
+	}{
+		{target: "/static/osm?center=55.75,37.62&zoom=10", status: http.StatusOK, ct: "image/png", size: image.Pt(512, 512)},
+		{target: "/static/osm?center=55.75,37.62&zoom=10&size=300x200&format=jpg", status: http.StatusOK, ct: "image/jpeg", size: image.Pt(300, 200)},
+		{target: "/static/osm?bbox=37,55,38,56&size=400x300", status: http.StatusOK, ct: "image/png", size: image.Pt(400, 300)},
+		{target: "/static/osm?center=55.75,37.62&zoom=10&markers=color:blue|55.75,37.62&path=weight:3|55.7,37.5|55.8,37.7", status: http.StatusOK, ct: "image/png", size: image.Pt(512, 512)},
+		{target: "/static/other?center=55.75,37.62&zoom=10", status: http.StatusNotFound},
+		{target: "/static/osm?center=95,37.62&zoom=10", status: http.StatusBadRequest},
+		{target: "/static/osm?center=55.75,37.62", status: http.StatusBadRequest},
+		{target: "/static/osm?center=55.75,37.62&zoom=10&size=3000x200", status: http.StatusBadRequest},
+		{target: "/static/osm?center=55.75,37.62&zoom=10&format=gif", status: http.StatusBadRequest},
+		{target: "/static/osm?bbox=38,55,37,56", status: http.StatusBadRequest},
+		{target: "/static/osm?center=55.75,37.62&zoom=10&markers=color:nope|55.75,37.62", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		resp, body := get(t, f, tt.target)
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, must be %d", tt.target, resp.StatusCode, tt.status)
+			continue
+		}
+
+		if tt.status != http.StatusOK {
+			continue
+		}
+
+		if ct := resp.Header.Get("Content-Type"); ct != tt.ct {
+			t.Errorf("%s: got %s, must be %s", tt.target, ct, tt.ct)
+		}
+
+		if resp.Header.Get("ETag") == "" {
+			t.Errorf("%s: no etag", tt.target)
+		}
+
+		img, _, err := image.Decode(bytes.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if img.Bounds().Size() != tt.size {
+			t.Errorf("%s: got size %v, must be %v", tt.target, img.Bounds().Size(), tt.size)
+		}
+	}
+}
+
+func TestStaticMapGeoJSON(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "osm"))
+
+	const polygon = `{"type": "Feature", "properties": {"fill": "#0000ff", "fill-opacity": 1},
+		"geometry": {"type": "Polygon", "coordinates": [[[-1, -1], [1, -1], [1, 1], [-1, 1], [-1, -1]]]}}`
+
+	post := func(target, body string) (*http.Response, []byte) {
+		req := httptest.NewRequest(http.MethodPost, target, strings.NewReader(body))
+		req.Header.Set("Content-Type", "application/geo+json")
+
+		return doRequest(t, f, req)
+	}
+
+	resp, body := post("/static/osm?center=0,0&zoom=6&size=200x200", polygon)
+
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("got status %d: %s", resp.StatusCode, body)
+	}
+
+	img, _, err := image.Decode(bytes.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the polygon covers the center, the corners are the red tiles
+	if r, _, b, _ := img.At(100, 100).RGBA(); r>>8 > 5 || b>>8 < 250 {
+		t.Errorf("got center color %v, must be blue", img.At(100, 100))
+	}
+
+	if r, _, b, _ := img.At(2, 2).RGBA(); r>>8 < 250 || b>>8 > 5 {
+		t.Errorf("got corner color %v, must be red", img.At(2, 2))
+	}
+
+	for _, tt := range []struct{ target, body string }{
+		{target: "/static/osm?center=0,0&zoom=6", body: `{"type": "Feature"`},
+		{target: "/static/osm?center=0,0&zoom=6", body: `{"type": "Circle", "coordinates": [0, 0]}`},
+		{target: "/static/osm?zoom=6", body: polygon},
+	} {
+		if resp, _ := post(tt.target, tt.body); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("%s %s: got status %d", tt.target, tt.body, resp.StatusCode)
+		}
+	}
+}
+
+func TestStaticFiles(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "osm"))
+
+	// /static requests without map parameters are the static files
+	resp, body := get(t, f, "/static/map.html")
+
+	if resp.StatusCode != http.StatusOK || !bytes.Contains(body, []byte("<html")) {
+		t.Errorf("got status %d", resp.StatusCode)
+	}
+}
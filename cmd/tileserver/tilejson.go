@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+// TileJSON is the TileJSON 3.0.0 document, https://github.com/mapbox/tilejson-spec/tree/master/3.0.0
+type TileJSON struct {
+	TileJSON     string          `json:"tilejson"`
+	Tiles        []string        `json:"tiles"`
+	Name         string          `json:"name,omitempty"`
+	Description  string          `json:"description,omitempty"`
+	Attribution  string          `json:"attribution,omitempty"`
+	Scheme       string          `json:"scheme"`
+	MinZoom      int             `json:"minzoom"`
+	MaxZoom      int             `json:"maxzoom"`
+	Bounds       []float64       `json:"bounds,omitempty"`
+	Center       []float64       `json:"center,omitempty"`
+	Format       string          `json:"format,omitempty"`
+	VectorLayers json.RawMessage `json:"vector_layers,omitempty"`
+}
+
+func getTileJSONHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		name, _ := url.QueryUnescape(c.Params("name"))
+
+		layer, _ := app.layers.Get(name)
+
+		if layer == nil {
+			return fiber.NewError(fiber.StatusNotFound, fmt.Sprintf("layer %s is not found", name))
+		}
+
+		return c.JSON(app.tileJSON(c.BaseURL(), layer))
+	}
+}
+
+func (app *App) tileJSON(base string, s model.Source) *TileJSON {
+	info := app.layerInfo(s)
+
+	return &TileJSON{
+		TileJSON:    "3.0.0",
+		Tiles:       []string{tilesUrl(base, s, "")},
+		Name:        s.GetName(),
+		Description: info.Description,
+		Attribution: info.Attribution,
+		// tiles are always served in xyz numbering, whatever the file or upstream one is
+		Scheme:       "xyz",
+		MinZoom:      s.GetMinZoom(),
+		MaxZoom:      s.GetMaxZoom(),
+		Bounds:       info.Bounds,
+		Center:       info.Center,
+		Format:       tileFormat(s.GetContentType()),
+		VectorLayers: info.VectorLayers,
+	}
+}
+
+// layerInfo returns the source info with the fields set in layers.yml.
+func (app *App) layerInfo(s model.Source) model.LayerInfo {
+	info := model.GetLayerInfo(s)
+
+	if i, ok := app.infos[s.GetKey()]; ok {
+		info = info.With(i)
+	}
+
+	return info
+}
+
+// tilesUrl returns the tile url template of the source, the y suffix is for retina tiles. Image tiles get the
+// extension of the layer format, so they are served in the format declared in TileJSON.
+func tilesUrl(base string, s model.Source, suffix string) string {
+	u := base + "/tiles/" + url.QueryEscape(s.GetKey()) + "/{z}/{x}/{y}" + suffix
+
+	if f := tileFormat(s.GetContentType()); extFormat(f) != "" {
+		u += "." + f
+	}
+
+	return u
+}
+
+// tileFormat returns mbtiles format for the content type.
+func tileFormat(ct string) string {
+	switch ct {
+	case "":
+		return ""
+	case "image/jpeg":
+		return "jpg"
+	default:
+		return strings.TrimPrefix(ct, "image/")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"testing"
+)
+
+func TestTileJSON(t *testing.T) {
+	jpg := pngSource(t, "sat")
+	jpg.ct = "image/jpeg"
+
+	// multilayers don't know the format of their tiles
+	multi := pngSource(t, "multi")
+	multi.ct = ""
+
+	_, f := newTestApp(t, pngSource(t, "osm map"), jpg, multi)
+
+	tests := []struct {
+		target string
+		tiles  string
+		format string
+	}{
+		{target: "/tiles/osm+map.json", tiles: "http://example.com/tiles/osm+map/{z}/{x}/{y}.png", format: "png"},
+		{target: "/tilejson/osm%20map", tiles: "http://example.com/tiles/osm+map/{z}/{x}/{y}.png", format: "png"},
+		{target: "/tiles/sat.json", tiles: "http://example.com/tiles/sat/{z}/{x}/{y}.jpg", format: "jpg"},
+		{target: "/tilejson/multi", tiles: "http://example.com/tiles/multi/{z}/{x}/{y}"},
+	}
+
+	for _, tt := range tests {
+		resp, body := get(t, f, tt.target)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", tt.target, resp.StatusCode)
+		}
+
+		var tj TileJSON
+
+		if err := json.Unmarshal(body, &tj); err != nil {
+			t.Fatal(err)
+		}
+
+		if tj.TileJSON != "3.0.0" || tj.Scheme != "xyz" || tj.MinZoom != 0 || tj.MaxZoom != 18 {
+			t.Errorf("%s: wrong tilejson %s", tt.target, body)
+		}
+
+		if len(tj.Tiles) != 1 || tj.Tiles[0] != tt.tiles {
+			t.Errorf("%s: got tiles %v, must be %s", tt.target, tj.Tiles, tt.tiles)
+		}
+
+		if tj.Format != tt.format {
+			t.Errorf("%s: got format %s, must be %s", tt.target, tj.Format, tt.format)
+		}
+	}
+
+	for _, target := range []string{"/tiles/other.json", "/tilejson/other"} {
+		if resp, _ := get(t, f, target); resp.StatusCode != http.StatusNotFound {
+			t.Errorf("%s: got status %d, must be 404", target, resp.StatusCode)
+		}
+	}
+
+	// the template serves tiles of the declared format
+	if resp, _ := get(t, f, "/tiles/sat/1/0/0.jpg"); resp.Header.Get("Content-Type") != "image/jpeg" {
+		t.Errorf("got %s tile", resp.Header.Get("Content-Type"))
+	}
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+	"golang.org/x/image/draw"
+
+	"github.com/kdudkov/tileproxy/pkg/mapper"
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+const (
+	wmsMaxSize = 4096
+	// latitude limit of web mercator
+	wmsMaxLat = 85.0511287798
+)
+
+// wmsCapabilities is WMT_MS_Capabilities of WMS 1.1.1 or WMS_Capabilities of WMS 1.3.0, named by XMLName.
+type wmsCapabilities struct {
+	XMLName    xml.Name
+	Xmlns      string        `xml:"xmlns,attr,omitempty"`
+	XmlnsXlink string        `xml:"xmlns:xlink,attr"`
+	Version    string        `xml:"version,attr"`
+	Service    wmsService    `xml:"Service"`
+	Capability wmsCapability `xml:"Capability"`
+}
+
+type wmsService struct {
+	Name           string `xml:"Name"`
+	Title          string `xml:"Title"`
+	OnlineResource xlink  `xml:"OnlineResource"`
+}
+
+type wmsCapability struct {
+	GetCapabilities wmsOperation `xml:"Request>GetCapabilities"`
+	GetMap          wmsOperation `xml:"Request>GetMap"`
+	Exceptions      []string     `xml:"Exception>Format"`
+	Layer           wmsLayer     `xml:"Layer"`
+}
+
+type wmsOperation struct {
+	Formats []string `xml:"Format"`
+	Get     xlink    `xml:"DCPType>HTTP>Get>OnlineResource"`
+}
+
+type wmsLayer struct {
+	Name          string            `xml:"Name,omitempty"`
+	Title         string            `xml:"Title"`
+	Abstract      string            `xml:"Abstract,omitempty"`
+	CRS           []string          `xml:"CRS"`
+	SRS           []string          `xml:"SRS"`
+	Geographic    *wmsGeographicBox `xml:"EX_GeographicBoundingBox"`
+	LatLon        *wmsBBox          `xml:"LatLonBoundingBox"`
+	BoundingBoxes []wmsBBox         `xml:"BoundingBox"`
+	Layers        []wmsLayer        `xml:"Layer"`
+}
+
+type wmsGeographicBox struct {
+	West  float64 `xml:"westBoundLongitude"`
+	East  float64 `xml:"eastBoundLongitude"`
+	South float64 `xml:"southBoundLatitude"`
+	North float64 `xml:"northBoundLatitude"`
+}
+
+type wmsBBox struct {
+	CRS  string  `xml:"CRS,attr,omitempty"`
+	SRS  string  `xml:"SRS,attr,omitempty"`
+	MinX float64 `xml:"minx,attr"`
+	MinY float64 `xml:"miny,attr"`
+	MaxX float64 `xml:"maxx,attr"`
+	MaxY float64 `xml:"maxy,attr"`
+}
+
+type wmsExceptionReport struct {
+	XMLName   xml.Name     `xml:"ServiceExceptionReport"`
+	Xmlns     string       `xml:"xmlns,attr,omitempty"`
+	Version   string       `xml:"version,attr"`
+	Exception wmsException `xml:"ServiceException"`
+}
+
+type wmsException struct {
+	Code string `xml:"code,attr,omitempty"`
+	Text string `xml:",chardata"`
+}
+
+// wmsCRS are the supported coordinate systems, EPSG:900913 is an old name of EPSG:3857.
+var wmsCRS = []string{"EPSG:3857", "EPSG:900913", "EPSG:4326", "CRS:84"}
+
+// wmsError sends OGC ServiceExceptionReport of the version.
+func wmsError(c *fiber.Ctx, version string, status int, code, text string) error {
+	if version == "1.1.1" {
+		return sendXMLType(c, status, "application/vnd.ogc.se_xml", &wmsExceptionReport{
+			Version:   version,
+			Exception: wmsException{Code: code, Text: text},
+		})
+	}
+
+	return sendXMLType(c, status, "text/xml; charset=utf-8", &wmsExceptionReport{
+		Xmlns:     "http://www.opengis.net/ogc",
+		Version:   "1.3.0",
+		Exception: wmsException{Code: code, Text: text},
+	})
+}
+
+func getWMSHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		p := kvpParams(c)
+
+		// 1.3.0 is the default, clients of 1.1.1 always send the version
+		version := "1.3.0"
+
+		if p["version"] == "1.1.1" || p["wmtver"] == "1.0.0" {
+			version = "1.1.1"
+		}
+
+		if s := p["service"]; s != "" && !strings.EqualFold(s, "WMS") {
+			return wmsError(c, version, fiber.StatusBadRequest, "", "service must be WMS")
+		}
+
+		switch strings.ToLower(p["request"]) {
+		case "getcapabilities", "capabilities":
+			ct := "text/xml; charset=utf-8"
+
+			if version == "1.1.1" {
+				ct = "application/vnd.ogc.wms_xml"
+			}
+
+			return sendXMLType(c, fiber.StatusOK, ct, app.wmsCapabilities(c.BaseURL(), version))
+		case "getmap", "map":
+			return app.wmsGetMap(c, p, version)
+		case "":
+			return wmsError(c, version, fiber.StatusBadRequest, "MissingParameterValue", "request is missing")
+		default:
+			return wmsError(c, version, fiber.StatusBadRequest, "OperationNotSupported", "unsupported request "+p["request"])
+		}
+	}
+}
+
+func (app *App) wmsGetMap(c *fiber.Ctx, p map[string]string, version string) error {
+	crsParam := "crs"
+	crsCode := "InvalidCRS"
+
+	if version == "1.1.1" {
+		crsParam, crsCode = "srs", "InvalidSRS"
+	}
+
+	for _, k := range []string{"layers", crsParam, "bbox", "width", "height", "format"} {
+		if p[k] == "" {
+			return wmsError(c, version, fiber.StatusBadRequest, "MissingParameterValue", k+" is missing")
+		}
+	}
+
+	var layers []model.Source
+
+	for _, name := range strings.Split(p["layers"], ",") {
+		layer, _ := app.layers.Get(name)
+
+		if layer == nil {
+			return wmsError(c, version, fiber.StatusBadRequest, "LayerNotDefined", "unknown layer "+name)
+		}
+
+		layers = append(layers, layer)
+	}
+
+	format, _, _ := strings.Cut(p["format"], ";")
+	format = mimeFormat(strings.TrimSpace(format))
+
+	if format != "png" && format != "jpeg" {
+		return wmsError(c, version, fiber.StatusBadRequest, "InvalidFormat", "unsupported format "+p["format"])
+	}
+
+	req := model.MapRequest{}
+
+	var err error
+
+	req.Width, err = strconv.Atoi(p["width"])
+
+	if err != nil || req.Width < 1 || req.Width > wmsMaxSize {
+		return wmsError(c, version, fiber.StatusBadRequest, "", "invalid width "+p["width"])
+	}
+
+	req.Height, err = strconv.Atoi(p["height"])
+
+	if err != nil || req.Height < 1 || req.Height > wmsMaxSize {
+		return wmsError(c, version, fiber.StatusBadRequest, "", "invalid height "+p["height"])
+	}
+
+	bbox, ok := parseBBox(p["bbox"])
+
+	if !ok {
+		return wmsError(c, version, fiber.StatusBadRequest, "", "invalid bbox "+p["bbox"])
+	}
+
+	switch strings.ToUpper(p[crsParam]) {
+	case "EPSG:3857", "EPSG:900913":
+		req.BBox = bbox
+	case "EPSG:4326":
+		req.BBox, req.Geographic = bbox, true
+
+		// 1.3.0 follows the EPSG axis order, latitude first
+		if version == "1.3.0" {
+			req.BBox = [4]float64{bbox[1], bbox[0], bbox[3], bbox[2]}
+		}
+	case "CRS:84":
+		req.BBox, req.Geographic = bbox, true
+	default:
+		return wmsError(c, version, fiber.StatusBadRequest, crsCode, "unsupported coordinate system "+p[crsParam])
+	}
+
+	if req.BBox[0] >= req.BBox[2] || req.BBox[1] >= req.BBox[3] {
+		return wmsError(c, version, fiber.StatusBadRequest, "", "invalid bbox "+p["bbox"])
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, req.Width, req.Height))
+
+	// jpeg has no alpha, so it always gets the background
+	if format == "jpeg" || !strings.EqualFold(p["transparent"], "true") {
+		bg, ok := color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: 0xff}, true
+
+		if p["bgcolor"] != "" {
+			bg, ok = model.ParseColor(p["bgcolor"])
+		}
+
+		if !ok {
+			return wmsError(c, version, fiber.StatusBadRequest, "", "invalid bgcolor "+p["bgcolor"])
+		}
+
+		draw.Draw(dst, dst.Bounds(), image.NewUniform(bg), image.Point{}, draw.Src)
+	}
+
+	skipped := 0
+
+	for _, layer := range layers {
+		img, n, err := model.RenderMap(c.Context(), layer, req)
+
+		var upErr *model.UpstreamError
+
+		switch {
+		case errors.Is(err, model.ErrTooLarge):
+			return wmsError(c, version, fiber.StatusBadRequest, "", err.Error())
+		case errors.Is(err, model.ErrOffline):
+			return wmsError(c, version, fiber.StatusServiceUnavailable, "", err.Error())
+		case errors.As(err, &upErr):
+			app.logger.Warn("wms upstream error", "layer", layer.GetKey(), "error", err)
+			return wmsError(c, version, fiber.StatusBadGateway, "", err.Error())
+		case err != nil:
+			app.logger.Error("wms render error", "layer", layer.GetKey(), "error", err)
+			return wmsError(c, version, fiber.StatusInternalServerError, "", err.Error())
+		}
+
+		skipped += n
+		draw.Draw(dst, dst.Bounds(), img, image.Point{}, draw.Over)
+	}
+
+	t, err := app.transcoder.Encode(dst, format)
+
+	if err != nil {
+		return wmsError(c, version, fiber.StatusInternalServerError, "", err.Error())
+	}
+
+	t = model.Partial(t, skipped)
+
+	app.setCacheHeaders(c, t)
+
+	if notModified(c, t) {
+		return c.SendStatus(fiber.StatusNotModified)
+	}
+
+	c.Set(fiber.HeaderContentType, t.ContentType)
+
+	return c.Send(t.Data)
+}
+
+func parseBBox(s string) ([4]float64, bool) {
+	var res [4]float64
+
+	parts := strings.Split(s, ",")
+
+	if len(parts) != 4 {
+		return res, false
+	}
+
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+
+		if err != nil {
+			return res, false
+		}
+
+		res[i] = v
+	}
+
+	return res, true
+}
+
+func (app *App) wmsCapabilities(base, version string) *wmsCapabilities {
+	href := xlink{Href: base + "/wms?"}
+
+	caps := &wmsCapabilities{
+		XMLName:    xml.Name{Local: "WMS_Capabilities"},
+		Xmlns:      "http://www.opengis.net/wms",
+		XmlnsXlink: "http://www.w3.org/1999/xlink",
+		Version:    version,
+		Service:    wmsService{Name: "WMS", Title: "tileproxy", OnlineResource: href},
+		Capability: wmsCapability{
+			GetCapabilities: wmsOperation{Formats: []string{"text/xml"}, Get: href},
+			GetMap:          wmsOperation{Formats: []string{"image/png", "image/jpeg"}, Get: href},
+			Exceptions:      []string{"XML"},
+			Layer:           wmsLayer{Title: "tileproxy"},
+		},
+	}
+
+	world := []float64{-180, -wmsMaxLat, 180, wmsMaxLat}
+
+	if version == "1.1.1" {
+		caps.XMLName.Local = "WMT_MS_Capabilities"
+		caps.Xmlns = ""
+		caps.Service.Name = "OGC:WMS"
+		caps.Capability.GetCapabilities.Formats = []string{"application/vnd.ogc.wms_xml"}
+		caps.Capability.Exceptions = []string{"application/vnd.ogc.se_xml"}
+		caps.Capability.Layer.SRS = wmsCRS[:3]
+	} else {
+		caps.Capability.Layer.CRS = wmsCRS
+	}
+
+	wmsBounds(&caps.Capability.Layer, version, world)
+
+	app.layers.All(func(s model.Source) bool {
+		// 2x tiles would only make the map heavier
+		if strings.HasSuffix(s.GetKey(), model.RetinaSuffix) {
+			return true
+		}
+
+		l := wmsLayer{Name: s.GetKey(), Title: s.GetName()}
+		info := app.layerInfo(s)
+		l.Abstract = info.Description
+
+		if len(info.Bounds) == 4 {
+			wmsBounds(&l, version, info.Bounds)
+		} else {
+			wmsBounds(&l, version, world)
+		}
+
+		caps.Capability.Layer.Layers = append(caps.Capability.Layer.Layers, l)
+
+		return true
+	})
+
+	slices.SortFunc(caps.Capability.Layer.Layers, func(a, b wmsLayer) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	return caps
+}
+
+// wmsBounds sets geographic and EPSG:3857 bounding boxes of the layer for minlon, minlat, maxlon, maxlat bounds.
+func wmsBounds(l *wmsLayer, version string, b []float64) {
+	minLat, maxLat := max(b[1], -wmsMaxLat), min(b[3], wmsMaxLat)
+
+	x0, y0 := mapper.LatLon2Mercator(minLat, b[0])
+	x1, y1 := mapper.LatLon2Mercator(maxLat, b[2])
+
+	if version == "1.1.1" {
+		l.LatLon = &wmsBBox{MinX: b[0], MinY: minLat, MaxX: b[2], MaxY: maxLat}
+		l.BoundingBoxes = []wmsBBox{
+			{SRS: "EPSG:4326", MinX: b[0], MinY: minLat, MaxX: b[2], MaxY: maxLat},
+			{SRS: "EPSG:3857", MinX: x0, MinY: y0, MaxX: x1, MaxY: y1},
+		}
+
+		return
+	}
+
+	l.Geographic = &wmsGeographicBox{West: b[0], East: b[2], South: minLat, North: maxLat}
+	l.BoundingBoxes = []wmsBBox{
+		{CRS: "CRS:84", MinX: b[0], MinY: minLat, MaxX: b[2], MaxY: maxLat},
+		{CRS: "EPSG:4326", MinX: minLat, MinY: b[0], MaxX: maxLat, MaxY: b[2]},
+		{CRS: "EPSG:3857", MinX: x0, MinY: y0, MaxX: x1, MaxY: y1},
+	}
+}
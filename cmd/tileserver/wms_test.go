@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"image"
+	"net/http"
+	"testing"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+func TestWMSCapabilities(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "osm"), pngSource(t, "osm@2x"))
+
+	for target, root := range map[string]string{
+		"/wms?SERVICE=WMS&REQUEST=GetCapabilities":               "WMS_Capabilities",
+		"/wms?SERVICE=WMS&VERSION=1.1.1&REQUEST=GetCapabilities": "WMT_MS_Capabilities",
+	} {
+		resp, body := get(t, f, target)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", target, resp.StatusCode)
+		}
+
+		var caps struct {
+			XMLName xml.Name
+			Layers  []string `xml:"Capability>Layer>Layer>Name"`
+		}
+
+		if err := xml.Unmarshal(body, &caps); err != nil {
+			t.Fatal(err)
+		}
+
+		if caps.XMLName.Local != root || len(caps.Layers) != 1 || caps.Layers[0] != "osm" {
+			t.Errorf("%s: got %s with layers %v", target, caps.XMLName.Local, caps.Layers)
+		}
+	}
+}
+
+func TestWMSGetMap(t *testing.T) {
+	deep := pngSource(t, "deep")
+	deep.minZoom = 12
+
+	down := &testSource{key: "down", ct: "image/png", err: model.ErrOffline}
+
+	_, f := newTestApp(t, pngSource(t, "osm"), deep, down)
+
+	const world = "-20037508.34,-20037508.34,20037508.34,20037508.34"
+
+	tests := []struct {
+		name   string
+		query  string
+		status int
+		ct     string
+		code   string
+	}{
+		{name: "png", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusOK, ct: "image/png"},
+		{name: "jpeg", query: "VERSION=1.3.0&LAYERS=osm&CRS=CRS:84&BBOX=-180,-80,180,80&WIDTH=300&HEIGHT=200&FORMAT=image/jpeg", status: http.StatusOK, ct: "image/jpeg"},
+		{name: "lat lon order", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:4326&BBOX=-80,-180,80,180&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusOK, ct: "image/png"},
+		{name: "1.1.1", query: "VERSION=1.1.1&LAYERS=osm&SRS=EPSG:4326&BBOX=-180,-80,180,80&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusOK, ct: "image/png"},
+		{name: "large", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=4096&HEIGHT=4096&FORMAT=image/png", status: http.StatusOK, ct: "image/png"},
+		{name: "bad crs", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:32637&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest, code: "InvalidCRS"},
+		{name: "bad srs", query: "VERSION=1.1.1&LAYERS=osm&SRS=EPSG:32637&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest, code: "InvalidSRS"},
+		{name: "bad bbox", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=1,2,3&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest},
+		{name: "empty bbox", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=10,0,0,10&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest},
+		{name: "unknown layer", query: "VERSION=1.3.0&LAYERS=other&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest, code: "LayerNotDefined"},
+		{name: "bad format", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/gif", status: http.StatusBadRequest, code: "InvalidFormat"},
+		{name: "too wide", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=5000&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest},
+		{name: "no height", query: "VERSION=1.3.0&LAYERS=osm&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=300&FORMAT=image/png", status: http.StatusBadRequest, code: "MissingParameterValue"},
+		{name: "offline", query: "VERSION=1.3.0&LAYERS=down&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusServiceUnavailable},
+		// the world needs too many tiles of the layer min zoom
+		{name: "too many tiles", query: "VERSION=1.3.0&LAYERS=deep&CRS=EPSG:3857&BBOX=" + world + "&WIDTH=300&HEIGHT=200&FORMAT=image/png", status: http.StatusBadRequest},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			resp, body := get(t, f, "/wms?SERVICE=WMS&REQUEST=GetMap&"+tt.query)
+
+			if resp.StatusCode != tt.status {
+				t.Fatalf("got status %d, must be %d: %s", resp.StatusCode, tt.status, body)
+			}
+
+			if tt.status != http.StatusOK {
+				var res struct {
+					XMLName   xml.Name
+					Exception testException `xml:"ServiceException"`
+				}
+
+				if err := xml.Unmarshal(body, &res); err != nil || res.XMLName.Local != "ServiceExceptionReport" {
+					t.Fatalf("got %s, must be the service exception", body)
+				}
+
+				if res.Exception.WMSCode != tt.code {
+					t.Errorf("got code %q, must be %q", res.Exception.WMSCode, tt.code)
+				}
+
+				return
+			}
+
+			if ct := resp.Header.Get("Content-Type"); ct != tt.ct {
+				t.Errorf("got %s, must be %s", ct, tt.ct)
+			}
+
+			img, _, err := image.Decode(bytes.NewReader(body))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			b := img.Bounds()
+
+			if r, g, _, a := img.At(b.Dx()/2, b.Dy()/2).RGBA(); r>>8 < 250 || g>>8 > 5 || a>>8 != 255 {
+				t.Errorf("wrong map color %v", img.At(b.Dx()/2, b.Dy()/2))
+			}
+		})
+	}
+}
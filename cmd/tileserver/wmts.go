@@ -0,0 +1,370 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/gofiber/fiber/v2"
+
+	"github.com/kdudkov/tileproxy/pkg/model"
+)
+
+const (
+	wmtsMatrixSet = "GoogleMapsCompatible"
+	// scale denominator of zoom 0 tile matrix of GoogleMapsCompatible set
+	wmtsScale0  = 559082264.0287178
+	mercatorMax = 20037508.3427892
+)
+
+type owsExceptionReport struct {
+	XMLName   xml.Name     `xml:"ows:ExceptionReport"`
+	XmlnsOws  string       `xml:"xmlns:ows,attr"`
+	Version   string       `xml:"version,attr"`
+	Exception owsException `xml:"ows:Exception"`
+}
+
+type owsException struct {
+	Code    string `xml:"exceptionCode,attr"`
+	Locator string `xml:"locator,attr,omitempty"`
+	Text    string `xml:"ows:ExceptionText"`
+}
+
+type wmtsCapabilities struct {
+	XMLName        xml.Name         `xml:"Capabilities"`
+	Xmlns          string           `xml:"xmlns,attr"`
+	XmlnsOws       string           `xml:"xmlns:ows,attr"`
+	XmlnsXlink     string           `xml:"xmlns:xlink,attr"`
+	Version        string           `xml:"version,attr"`
+	Title          string           `xml:"ows:ServiceIdentification>ows:Title"`
+	ServiceType    string           `xml:"ows:ServiceIdentification>ows:ServiceType"`
+	ServiceVersion string           `xml:"ows:ServiceIdentification>ows:ServiceTypeVersion"`
+	Operations     []owsOp          `xml:"ows:OperationsMetadata>ows:Operation"`
+	Layers         []wmtsLayer      `xml:"Contents>Layer"`
+	MatrixSet      wmtsMatrixSetXML `xml:"Contents>TileMatrixSet"`
+	MetadataURL    xlink            `xml:"ServiceMetadataURL"`
+}
+
+type owsOp struct {
+	Name string `xml:"name,attr"`
+	Get  owsGet `xml:"ows:DCP>ows:HTTP>ows:Get"`
+}
+
+type owsGet struct {
+	Href       string        `xml:"xlink:href,attr"`
+	Constraint owsConstraint `xml:"ows:Constraint"`
+}
+
+type owsConstraint struct {
+	Name  string `xml:"name,attr"`
+	Value string `xml:"ows:AllowedValues>ows:Value"`
+}
+
+type xlink struct {
+	Href string `xml:"xlink:href,attr"`
+}
+
+type wmtsLayer struct {
+	Title        string         `xml:"ows:Title"`
+	Abstract     string         `xml:"ows:Abstract,omitempty"`
+	LowerCorner  string         `xml:"ows:WGS84BoundingBox>ows:LowerCorner"`
+	UpperCorner  string         `xml:"ows:WGS84BoundingBox>ows:UpperCorner"`
+	Identifier   string         `xml:"ows:Identifier"`
+	Style        wmtsStyle      `xml:"Style"`
+	Formats      []string       `xml:"Format"`
+	MatrixSet    string         `xml:"TileMatrixSetLink>TileMatrixSet"`
+	Limits       []wmtsLimits   `xml:"TileMatrixSetLink>TileMatrixSetLimits>TileMatrixLimits"`
+	ResourceURLs []wmtsResource `xml:"ResourceURL"`
+}
+
+type wmtsStyle struct {
+	IsDefault  bool   `xml:"isDefault,attr"`
+	Identifier string `xml:"ows:Identifier"`
+}
+
+type wmtsLimits struct {
+	Matrix int `xml:"TileMatrix"`
+	MinRow int `xml:"MinTileRow"`
+	MaxRow int `xml:"MaxTileRow"`
+	MinCol int `xml:"MinTileCol"`
+	MaxCol int `xml:"MaxTileCol"`
+}
+
+type wmtsResource struct {
+	Format   string `xml:"format,attr"`
+	Type     string `xml:"resourceType,attr"`
+	Template string `xml:"template,attr"`
+}
+
+type wmtsMatrixSetXML struct {
+	Identifier string       `xml:"ows:Identifier"`
+	CRS        string       `xml:"ows:SupportedCRS"`
+	ScaleSet   string       `xml:"WellKnownScaleSet"`
+	Matrices   []wmtsMatrix `xml:"TileMatrix"`
+}
+
+type wmtsMatrix struct {
+	Identifier string  `xml:"ows:Identifier"`
+	Scale      float64 `xml:"ScaleDenominator"`
+	TopLeft    string  `xml:"TopLeftCorner"`
+	TileWidth  int     `xml:"TileWidth"`
+	TileHeight int     `xml:"TileHeight"`
+	Width      int     `xml:"MatrixWidth"`
+	Height     int     `xml:"MatrixHeight"`
+}
+
+// kvpParams returns query parameters with lowercase names, as OGC parameter names are case-insensitive.
+func kvpParams(c *fiber.Ctx) map[string]string {
+	res := make(map[string]string)
+
+	c.Request().URI().QueryArgs().VisitAll(func(k, v []byte) {
+		res[strings.ToLower(string(k))] = string(v)
+	})
+
+	return res
+}
+
+func sendXML(c *fiber.Ctx, status int, v any) error {
+	return sendXMLType(c, status, "application/xml; charset=utf-8", v)
+}
+
+func sendXMLType(c *fiber.Ctx, status int, contentType string, v any) error {
+	b, err := xml.MarshalIndent(v, "", "  ")
+
+	if err != nil {
+		return err
+	}
+
+	c.Set(fiber.HeaderContentType, contentType)
+
+	return c.Status(status).Send(append([]byte(xml.Header), b...))
+}
+
+func owsError(c *fiber.Ctx, status int, code, locator, text string) error {
+	return sendXML(c, status, &owsExceptionReport{
+		XmlnsOws:  "http://www.opengis.net/ows/1.1",
+		Version:   "1.0.0",
+		Exception: owsException{Code: code, Locator: locator, Text: text},
+	})
+}
+
+func getWMTSHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		p := kvpParams(c)
+
+		if s := p["service"]; s != "" && !strings.EqualFold(s, "WMTS") {
+			return owsError(c, fiber.StatusBadRequest, "InvalidParameterValue", "service", "service must be WMTS")
+		}
+
+		switch strings.ToLower(p["request"]) {
+		case "getcapabilities":
+			return sendXML(c, fiber.StatusOK, app.wmtsCapabilities(c.BaseURL()))
+		case "gettile":
+			return app.wmtsKVPTile(c, p)
+		case "":
+			return owsError(c, fiber.StatusBadRequest, "MissingParameterValue", "request", "request is missing")
+		default:
+			return owsError(c, fiber.StatusBadRequest, "OperationNotSupported", "request", "unsupported request "+p["request"])
+		}
+	}
+}
+
+func getWMTSCapabilitiesHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		return sendXML(c, fiber.StatusOK, app.wmtsCapabilities(c.BaseURL()))
+	}
+}
+
+// getWMTSTileHandler serves RESTful /wmts/1.0.0/{layer}/{style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.{ext}
+func getWMTSTileHandler(app *App) func(c *fiber.Ctx) error {
+	return func(c *fiber.Ctx) error {
+		name, _ := url.QueryUnescape(c.Params("name"))
+		col, ext, _ := strings.Cut(c.Params("col"), ".")
+
+		format := extFormat(ext)
+
+		if format == "" {
+			return owsError(c, fiber.StatusBadRequest, "InvalidParameterValue", "format", "unsupported format "+ext)
+		}
+
+		return app.wmtsTile(c, name, c.Params("set"), c.Params("matrix"), c.Params("row"), col, format)
+	}
+}
+
+func (app *App) wmtsKVPTile(c *fiber.Ctx, p map[string]string) error {
+	for _, k := range []string{"layer", "tilematrixset", "tilematrix", "tilerow", "tilecol", "format"} {
+		if p[k] == "" {
+			return owsError(c, fiber.StatusBadRequest, "MissingParameterValue", k, k+" is missing")
+		}
+	}
+
+	format := mimeFormat(p["format"])
+
+	if format == "" {
+		return owsError(c, fiber.StatusBadRequest, "InvalidParameterValue", "format", "unsupported format "+p["format"])
+	}
+
+	return app.wmtsTile(c, p["layer"], p["tilematrixset"], p["tilematrix"], p["tilerow"], p["tilecol"], format)
+}
+
+func (app *App) wmtsTile(c *fiber.Ctx, name, set, matrix, row, col, format string) error {
+	layer, _ := app.layers.Get(name)
+
+	if layer == nil {
+		return owsError(c, fiber.StatusBadRequest, "InvalidParameterValue", "layer", "unknown layer "+name)
+	}
+
+	if set != wmtsMatrixSet {
+		return owsError(c, fiber.StatusBadRequest, "InvalidParameterValue", "tilematrixset", "unknown tile matrix set "+set)
+	}
+
+	// some clients send the matrix as EPSG:3857:z
+	z, err := strconv.Atoi(matrix[strings.LastIndex(matrix, ":")+1:])
+
+	if err != nil || z < layer.GetMinZoom() || z > layer.GetMaxZoom() {
+		return owsError(c, fiber.StatusBadRequest, "InvalidParameterValue", "tilematrix", "invalid tile matrix "+matrix)
+	}
+
+	y, err := strconv.Atoi(row)
+
+	if err != nil || y < 0 || y >= 1<<z {
+		return owsError(c, fiber.StatusBadRequest, "TileOutOfRange", "tilerow", "invalid tile row "+row)
+	}
+
+	x, err := strconv.Atoi(col)
+
+	if err != nil || x < 0 || x >= 1<<z {
+		return owsError(c, fiber.StatusBadRequest, "TileOutOfRange", "tilecol", "invalid tile col "+col)
+	}
+
+	return app.sendTile(c, layer, z, x, y, format, false)
+}
+
+// mimeFormat returns the tile format for the mime type, or empty string if it is not supported.
+func mimeFormat(mime string) string {
+	for f, ct := range model.ImageFormats {
+		if strings.EqualFold(ct, mime) {
+			return f
+		}
+	}
+
+	return ""
+}
+
+// wmtsFormats returns the layer content type and the ones it can be transcoded to.
+func wmtsFormats(s model.Source) []string {
+	res := []string{s.GetContentType()}
+
+	if res[0] == "" {
+		res[0] = model.ImageFormats["png"]
+	}
+
+	for _, f := range []string{"png", "jpeg", "webp"} {
+		if ct := model.ImageFormats[f]; !slices.Contains(res, ct) {
+			res = append(res, ct)
+		}
+	}
+
+	return res
+}
+
+func (app *App) wmtsCapabilities(base string) *wmtsCapabilities {
+	caps := &wmtsCapabilities{
+		Xmlns:          "http://www.opengis.net/wmts/1.0",
+		XmlnsOws:       "http://www.opengis.net/ows/1.1",
+		XmlnsXlink:     "http://www.w3.org/1999/xlink",
+		Version:        "1.0.0",
+		Title:          "tileproxy",
+		ServiceType:    "OGC WMTS",
+		ServiceVersion: "1.0.0",
+		Operations: []owsOp{
+			{Name: "GetCapabilities", Get: kvpGet(base + "/wmts?")},
+			{Name: "GetTile", Get: kvpGet(base + "/wmts?")},
+		},
+		MetadataURL: xlink{Href: base + "/wmts/1.0.0/WMTSCapabilities.xml"},
+	}
+
+	maxZoom := 0
+
+	app.layers.All(func(s model.Source) bool {
+		// 512px tiles don't fit the tile matrix set
+		if strings.HasSuffix(s.GetKey(), model.RetinaSuffix) {
+			return true
+		}
+
+		caps.Layers = append(caps.Layers, app.wmtsLayer(base, s))
+		maxZoom = max(maxZoom, s.GetMaxZoom())
+
+		return true
+	})
+
+	slices.SortFunc(caps.Layers, func(a, b wmtsLayer) int {
+		return strings.Compare(a.Identifier, b.Identifier)
+	})
+
+	caps.MatrixSet = wmtsMatrixSetXML{
+		Identifier: wmtsMatrixSet,
+		CRS:        "urn:ogc:def:crs:EPSG::3857",
+		ScaleSet:   "urn:ogc:def:wkss:OGC:1.0:GoogleMapsCompatible",
+	}
+
+	for z := 0; z <= maxZoom; z++ {
+		caps.MatrixSet.Matrices = append(caps.MatrixSet.Matrices, wmtsMatrix{
+			Identifier: strconv.Itoa(z),
+			Scale:      wmtsScale0 / math.Pow(2, float64(z)),
+			TopLeft:    fmt.Sprintf("%.7f %.7f", -mercatorMax, mercatorMax),
+			TileWidth:  256,
+			TileHeight: 256,
+			Width:      1 << z,
+			Height:     1 << z,
+		})
+	}
+
+	return caps
+}
+
+func kvpGet(href string) owsGet {
+	return owsGet{Href: href, Constraint: owsConstraint{Name: "GetEncoding", Value: "KVP"}}
+}
+
+func (app *App) wmtsLayer(base string, s model.Source) wmtsLayer {
+	info := app.layerInfo(s)
+
+	bounds := info.Bounds
+
+	if len(bounds) != 4 {
+		bounds = []float64{-180, -85.0511287798, 180, 85.0511287798}
+	}
+
+	l := wmtsLayer{
+		Title:       s.GetName(),
+		Abstract:    info.Description,
+		LowerCorner: fmt.Sprintf("%g %g", bounds[0], bounds[1]),
+		UpperCorner: fmt.Sprintf("%g %g", bounds[2], bounds[3]),
+		Identifier:  s.GetKey(),
+		Style:       wmtsStyle{IsDefault: true, Identifier: "default"},
+		Formats:     wmtsFormats(s),
+		MatrixSet:   wmtsMatrixSet,
+	}
+
+	for z := s.GetMinZoom(); z <= s.GetMaxZoom(); z++ {
+		b := model.LonLatBounds(bounds[0], bounds[1], bounds[2], bounds[3], z)
+		l.Limits = append(l.Limits, wmtsLimits{Matrix: z, MinRow: b.YMin, MaxRow: b.YMax, MinCol: b.XMin, MaxCol: b.XMax})
+	}
+
+	for _, ct := range l.Formats {
+		ext := tileFormat(ct)
+
+		l.ResourceURLs = append(l.ResourceURLs, wmtsResource{
+			Format:   ct,
+			Type:     "tile",
+			Template: base + "/wmts/1.0.0/" + url.PathEscape(s.GetKey()) + "/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}." + ext,
+		})
+	}
+
+	return l
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http"
+	"testing"
+)
+
+type testCapabilities struct {
+	Layers []struct {
+		Identifier string   `xml:"Identifier"`
+		Formats    []string `xml:"Format"`
+		Resources  []struct {
+			Format   string `xml:"format,attr"`
+			Template string `xml:"template,attr"`
+		} `xml:"ResourceURL"`
+	} `xml:"Contents>Layer"`
+	Matrices []string `xml:"Contents>TileMatrixSet>TileMatrix>Identifier"`
+}
+
+type testException struct {
+	Code    string `xml:"exceptionCode,attr"`
+	WMSCode string `xml:"code,attr"`
+	Locator string `xml:"locator,attr"`
+}
+
+func TestWMTSCapabilities(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "osm"), pngSource(t, "osm@2x"))
+
+	for _, target := range []string{"/wmts?SERVICE=WMTS&REQUEST=GetCapabilities", "/wmts/1.0.0/WMTSCapabilities.xml"} {
+		resp, body := get(t, f, target)
+
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("%s: got status %d", target, resp.StatusCode)
+		}
+
+		var caps testCapabilities
+
+		if err := xml.Unmarshal(body, &caps); err != nil {
+			t.Fatal(err)
+		}
+
+		// 2x tiles don't fit the tile matrix set
+		if len(caps.Layers) != 1 || caps.Layers[0].Identifier != "osm" {
+			t.Fatalf("%s: wrong layers %+v", target, caps.Layers)
+		}
+
+		l := caps.Layers[0]
+
+		if len(l.Formats) != 3 || l.Formats[0] != "image/png" {
+			t.Errorf("wrong formats %v", l.Formats)
+		}
+
+		if len(l.Resources) != 3 || l.Resources[0].Template != "http://example.com/wmts/1.0.0/osm/{Style}/{TileMatrixSet}/{TileMatrix}/{TileRow}/{TileCol}.png" {
+			t.Errorf("wrong resources %+v", l.Resources)
+		}
+
+		if len(caps.Matrices) != 19 || caps.Matrices[18] != "18" {
+			t.Errorf("wrong tile matrices %v", caps.Matrices)
+		}
+	}
+}
+
+func TestWMTSGetTile(t *testing.T) {
+	_, f := newTestApp(t, pngSource(t, "osm"))
+
+	tests := []struct {
+		target  string
+		status  int
+		ct      string
+		locator string
+	}{
+		{target: "/wmts?SERVICE=WMTS&REQUEST=GetTile&LAYER=osm&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=3&TILEROW=2&TILECOL=1&FORMAT=image/png", status: http.StatusOK, ct: "image/png"},
+		{target: "/wmts?service=wmts&request=gettile&layer=osm&tilematrixset=GoogleMapsCompatible&tilematrix=EPSG:3857:3&tilerow=2&tilecol=1&format=image/jpeg", status: http.StatusOK, ct: "image/jpeg"},
+		{target: "/wmts/1.0.0/osm/default/GoogleMapsCompatible/3/2/1.png", status: http.StatusOK, ct: "image/png"},
+		{target: "/wmts/1.0.0/osm/default/GoogleMapsCompatible/3/2/1.webp", status: http.StatusOK, ct: "image/webp"},
+		{target: "/wmts?SERVICE=WMTS&REQUEST=GetTile&LAYER=osm&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=3&TILEROW=2&FORMAT=image/png", status: http.StatusBadRequest, locator: "tilecol"},
+		{target: "/wmts?SERVICE=WMTS&REQUEST=GetTile&LAYER=other&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=3&TILEROW=2&TILECOL=1&FORMAT=image/png", status: http.StatusBadRequest, locator: "layer"},
+		{target: "/wmts?SERVICE=WMTS&REQUEST=GetTile&LAYER=osm&TILEMATRIXSET=GoogleMapsCompatible&TILEMATRIX=3&TILEROW=2&TILECOL=1&FORMAT=image/gif", status: http.StatusBadRequest, locator: "format"},
+		{target: "/wmts/1.0.0/osm/default/WorldCRS84Quad/3/2/1.png", status: http.StatusBadRequest, locator: "tilematrixset"},
+		{target: "/wmts/1.0.0/osm/default/GoogleMapsCompatible/19/2/1.png", status: http.StatusBadRequest, locator: "tilematrix"},
+		{target: "/wmts/1.0.0/osm/default/GoogleMapsCompatible/3/8/1.png", status: http.StatusBadRequest, locator: "tilerow"},
+		{target: "/wmts/1.0.0/osm/default/GoogleMapsCompatible/3/2/-1.png", status: http.StatusBadRequest, locator: "tilecol"},
+		{target: "/wmts?SERVICE=WMS&REQUEST=GetTile", status: http.StatusBadRequest, locator: "service"},
+		{target: "/wmts?SERVICE=WMTS&REQUEST=GetFeatureInfo", status: http.StatusBadRequest, locator: "request"},
+	}
+
+	for _, tt := range tests {
+		resp, body := get(t, f, tt.target)
+
+		if resp.StatusCode != tt.status {
+			t.Errorf("%s: got status %d, must be %d", tt.target, resp.StatusCode, tt.status)
+			continue
+		}
+
+		if tt.ct != "" && resp.Header.Get("Content-Type") != tt.ct {
+			t.Errorf("%s: got %s, must be %s", tt.target, resp.Header.Get("Content-Type"), tt.ct)
+		}
+
+		if tt.locator == "" {
+			continue
+		}
+
+		var res struct {
+			Exception testException `xml:"Exception"`
+		}
+
+		if err := xml.Unmarshal(body, &res); err != nil || res.Exception.Locator != tt.locator || res.Exception.Code == "" {
+			t.Errorf("%s: got %s, must be exception of %s", tt.target, body, tt.locator)
+		}
+	}
+}
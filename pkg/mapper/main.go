@@ -1,9 +1,12 @@
-package main
+package mapper
 
 import (
 	"math"
 )
 
+// MercatorMax is the half of web mercator world size in meters.
+const MercatorMax = 20037508.342789244
+
 func radians(a float64) float64 {
 	return a / 180 * math.Pi
 }
@@ -12,6 +15,7 @@ func deg(a float64) float64 {
 	return a / math.Pi * 180
 }
 
+// TileSystem converts lat/lon to web mercator pixels and tiles and back.
 type TileSystem struct {
 	isTms    bool
 	tileSize int
@@ -20,27 +24,36 @@ type TileSystem struct {
 func NewTileSystem() *TileSystem {
 	return &TileSystem{
 		isTms:    false,
-		tileSize: 128,
+		tileSize: 256,
 	}
 }
-func (ts *TileSystem) latlon2xy(lat, lon float64, zoom int) (int, int) {
-	size := 1 << zoom * ts.tileSize
 
-	x := (lon + 180) / 360 * float64(size)
-	y := (1 - math.Log(math.Tan(radians(lat))+(1/math.Cos(radians(lat))))/math.Pi) / 2 * float64(size)
+func (ts *TileSystem) TileSize() int {
+	return ts.tileSize
+}
+
+// LatLon2XY returns the pixel coordinates of the point at the zoom.
+func (ts *TileSystem) LatLon2XY(lat, lon float64, zoom int) (float64, float64) {
+	size := float64(int(1) << zoom * ts.tileSize)
+
+	x := (lon + 180) / 360 * size
+	y := (1 - math.Log(math.Tan(radians(lat))+(1/math.Cos(radians(lat))))/math.Pi) / 2 * size
 	if ts.isTms {
-		y = float64(size) - y
+		y = size - y
 	}
-	return int(math.Round(x)), int(math.Round(y))
+	return x, y
 }
 
-func (ts *TileSystem) latlon2tilexy(lat, lon float64, zoom int) (int, int, int, int) {
-	x, y := ts.latlon2xy(lat, lon, zoom)
+// LatLon2TileXY returns the tile with the point at the zoom and the point pixel in the tile.
+func (ts *TileSystem) LatLon2TileXY(lat, lon float64, zoom int) (int, int, int, int) {
+	fx, fy := ts.LatLon2XY(lat, lon, zoom)
+	x, y := int(math.Round(fx)), int(math.Round(fy))
 
 	return x / ts.tileSize, y / ts.tileSize, x % ts.tileSize, y % ts.tileSize
 }
 
-func (ts *TileSystem) xy2latlon(x, y float64, zoom int) (float64, float64) {
+// XY2LatLon returns lat/lon of the pixel at the zoom.
+func (ts *TileSystem) XY2LatLon(x, y float64, zoom int) (float64, float64) {
 	size := 1 << zoom * ts.tileSize
 	if ts.isTms {
 		y = float64(size) - y
@@ -49,3 +62,25 @@ func (ts *TileSystem) xy2latlon(x, y float64, zoom int) (float64, float64) {
 	lat := deg(math.Atan(math.Sinh(math.Pi * (1 - 2*y/float64(size)))))
 	return lat, lon
 }
+
+// Mercator2XY returns the pixel coordinates of EPSG:3857 point at the zoom.
+func (ts *TileSystem) Mercator2XY(mx, my float64, zoom int) (float64, float64) {
+	size := float64(int(1) << zoom * ts.tileSize)
+
+	x := (mx + MercatorMax) / (2 * MercatorMax) * size
+	y := (MercatorMax - my) / (2 * MercatorMax) * size
+	if ts.isTms {
+		y = size - y
+	}
+	return x, y
+}
+
+// LatLon2Mercator returns EPSG:3857 coordinates of the point.
+func LatLon2Mercator(lat, lon float64) (float64, float64) {
+	return radians(lon) * MercatorMax / math.Pi, math.Log(math.Tan(math.Pi/4+radians(lat)/2)) * MercatorMax / math.Pi
+}
+
+// Mercator2LatLon returns lat/lon of EPSG:3857 point.
+func Mercator2LatLon(x, y float64) (float64, float64) {
+	return deg(2*math.Atan(math.Exp(y/MercatorMax*math.Pi)) - math.Pi/2), deg(x / MercatorMax * math.Pi)
+}
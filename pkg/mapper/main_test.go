@@ -1,7 +1,8 @@
-package main
+package mapper
 
 import (
 	"fmt"
+	"math"
 	"testing"
 )
 
@@ -31,8 +32,33 @@ func Test2(t *testing.T) {
 	ts := NewTileSystem()
 	lat, lon := 55.746819, 37.612228
 	zoom := 16
-	xt, yt, _, _ := ts.latlon2tilexy(lat, lon, zoom)
+	xt, yt, _, _ := ts.LatLon2TileXY(lat, lon, zoom)
 
 	fmt.Printf("https://a.tile.openstreetmap.org/%d/%d/%d.png'\n", zoom, xt, yt)
 
 }
+
+func TestMercator(t *testing.T) {
+	lat, lon := 55.746819, 37.612228
+
+	x, y := LatLon2Mercator(lat, lon)
+
+	if math.Abs(x-4186974.07) > 0.01 || math.Abs(y-7508178.69) > 0.01 {
+		t.Errorf("wrong mercator %f, %f", x, y)
+	}
+
+	lat1, lon1 := Mercator2LatLon(x, y)
+
+	if math.Abs(lat1-lat) > 1e-9 || math.Abs(lon1-lon) > 1e-9 {
+		t.Errorf("wrong lat/lon %f, %f", lat1, lon1)
+	}
+
+	ts := NewTileSystem()
+
+	px, py := ts.LatLon2XY(lat, lon, 10)
+	mx, my := ts.Mercator2XY(x, y, 10)
+
+	if math.Abs(px-mx) > 1e-6 || math.Abs(py-my) > 1e-6 {
+		t.Errorf("pixels differ: %f, %f and %f, %f", px, py, mx, my)
+	}
+}
@@ -0,0 +1,149 @@
+package model
+
+import (
+	"math"
+	"slices"
+)
+
+// maxLat is the latitude limit of web mercator tiles.
+const maxLat = 85.05112878
+
+// TileBounds is the inclusive xyz tile range at a zoom.
+type TileBounds struct {
+	XMin, YMin, XMax, YMax int
+}
+
+func worldBounds(z int) TileBounds {
+	return TileBounds{XMax: 1<<z - 1, YMax: 1<<z - 1}
+}
+
+func (b TileBounds) Contains(x, y int) bool {
+	return x >= b.XMin && x <= b.XMax && y >= b.YMin && y <= b.YMax
+}
+
+func (b TileBounds) intersects(o TileBounds) bool {
+	return b.XMin <= o.XMax && o.XMin <= b.XMax && b.YMin <= o.YMax && o.YMin <= b.YMax
+}
+
+func (b TileBounds) union(o TileBounds) TileBounds {
+	return TileBounds{XMin: min(b.XMin, o.XMin), YMin: min(b.YMin, o.YMin), XMax: max(b.XMax, o.XMax), YMax: max(b.YMax, o.YMax)}
+}
+
+// count returns the number of tiles in bounds.
+func (b TileBounds) count() int {
+	if b.XMin > b.XMax || b.YMin > b.YMax {
+		return 0
+	}
+
+	return (b.XMax - b.XMin + 1) * (b.YMax - b.YMin + 1)
+}
+
+// zoomIn returns bounds of the child tiles dz levels below.
+func (b TileBounds) zoomIn(dz int) TileBounds {
+	return TileBounds{XMin: b.XMin << dz, YMin: b.YMin << dz, XMax: (b.XMax+1)<<dz - 1, YMax: (b.YMax+1)<<dz - 1}
+}
+
+// zoomOut returns bounds of the parent tiles dz levels above.
+func (b TileBounds) zoomOut(dz int) TileBounds {
+	return TileBounds{XMin: b.XMin >> dz, YMin: b.YMin >> dz, XMax: b.XMax >> dz, YMax: b.YMax >> dz}
+}
+
+// LonLatBounds returns bounds of tiles covering the lon/lat box at the zoom.
+func LonLatBounds(minLon, minLat, maxLon, maxLat float64, z int) TileBounds {
+	x1, y1 := lonLatTile(minLon, maxLat, z)
+	x2, y2 := lonLatTile(maxLon, minLat, z)
+
+	return TileBounds{XMin: x1, YMin: y1, XMax: x2, YMax: y2}
+}
+
+func lonLatTile(lon, lat float64, z int) (int, int) {
+	n := float64(int(1) << z)
+	lat = max(-maxLat, min(maxLat, lat)) * math.Pi / 180
+
+	x := int((lon + 180) / 360 * n)
+	y := int((1 - math.Log(math.Tan(lat)+1/math.Cos(lat))/math.Pi) / 2 * n)
+
+	return max(0, min(x, 1<<z-1)), max(0, min(y, 1<<z-1))
+}
+
+// boundsSource is a source that knows where its tiles are.
+type boundsSource interface {
+	// Bounds returns xyz tile bounds at the zoom, false if there are no tiles. If bounds can't be found now,
+	// the error is returned with the whole world bounds.
+	Bounds(z int) (TileBounds, bool, error)
+}
+
+// sourceBounds returns the source tile bounds at the zoom, whole world for sources that don't know them.
+func sourceBounds(s Source, z int) (TileBounds, bool, error) {
+	if b, ok := s.(boundsSource); ok {
+		return b.Bounds(z)
+	}
+
+	return worldBounds(z), true, nil
+}
+
+// indexZoom is the zoom of bounds index cells, layers covering more than maxIndexCells cells are checked
+// for every tile.
+const (
+	indexZoom     = 8
+	maxIndexCells = 64
+)
+
+// boundsIndex finds the sources that may have the tile at one zoom.
+type boundsIndex struct {
+	// dz is the zoom difference between tiles and cells
+	dz     int
+	bounds map[int]TileBounds
+	cells  map[[2]int][]int
+	large  []int
+}
+
+func newBoundsIndex(z int) *boundsIndex {
+	return &boundsIndex{
+		dz:     max(0, z-indexZoom),
+		bounds: make(map[int]TileBounds),
+		cells:  make(map[[2]int][]int),
+	}
+}
+
+// add puts the source number i with the bounds to the index, sources must be added in order.
+func (idx *boundsIndex) add(i int, b TileBounds) {
+	idx.bounds[i] = b
+
+	c := b.zoomOut(idx.dz)
+
+	if (c.XMax-c.XMin+1)*(c.YMax-c.YMin+1) > maxIndexCells {
+		idx.large = append(idx.large, i)
+		return
+	}
+
+	for x := c.XMin; x <= c.XMax; x++ {
+		for y := c.YMin; y <= c.YMax; y++ {
+			idx.cells[[2]int{x, y}] = append(idx.cells[[2]int{x, y}], i)
+		}
+	}
+}
+
+// find returns numbers of the sources having the tile in its bounds, in order.
+func (idx *boundsIndex) find(x, y int) []int {
+	cell := idx.cells[[2]int{x >> idx.dz, y >> idx.dz}]
+	res := make([]int, 0, len(cell)+len(idx.large))
+
+	for _, i := range cell {
+		if idx.bounds[i].Contains(x, y) {
+			res = append(res, i)
+		}
+	}
+
+	for _, i := range idx.large {
+		if idx.bounds[i].Contains(x, y) {
+			res = append(res, i)
+		}
+	}
+
+	if len(cell) > 0 && len(idx.large) > 0 {
+		slices.Sort(res)
+	}
+
+	return res
+}
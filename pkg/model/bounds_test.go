@@ -0,0 +1,265 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"image/color"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestLayerBounds(t *testing.T) {
+	name := testMBTiles(t)
+
+	l, err := NewLayer("test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b, ok, _ := l.Bounds(2); !ok || b != (TileBounds{XMax: 1, YMax: 1}) {
+		t.Errorf("got bounds %v, must be 0,0 - 1,1", b)
+	}
+
+	if _, err := l.GetTile(context.Background(), 2, 3, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, must be ErrNotFound", err)
+	}
+
+	_ = l.Close()
+
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// wrong metadata: eastern hemisphere north of the equator
+	if _, err := db.Exec("INSERT INTO metadata (name, value) VALUES ('bounds', '0,0,180,85')"); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = db.Close()
+
+	l, err = NewLayer("test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	// the tiles are trusted over the metadata
+	if b, ok, _ := l.Bounds(2); !ok || b != (TileBounds{XMax: 1, YMax: 1}) {
+		t.Errorf("got bounds %v, must be 0,0 - 1,1", b)
+	}
+
+	if _, err := l.GetTile(context.Background(), 2, 0, 0); err != nil {
+		t.Errorf("tile outside of the metadata bounds: %v", err)
+	}
+
+	if _, ok, _ := l.Bounds(l.GetMaxZoom() + 1); ok {
+		t.Error("no bounds must be above max zoom")
+	}
+
+	// bounds are not queried again when the same file is reloaded
+	l2, err := NewLayer("test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l2.Close()
+
+	if l2.bounds != l.bounds {
+		t.Error("bounds of the reloaded file must be shared")
+	}
+}
+
+// boundsColorSource is a colorSource with tiles in the bounds at any zoom.
+type boundsColorSource struct {
+	*colorSource
+
+	b       TileBounds
+	queries atomic.Int32
+	fail    atomic.Bool
+}
+
+func (s *boundsColorSource) Bounds(z int) (TileBounds, bool, error) {
+	s.queries.Add(1)
+
+	if s.fail.Load() {
+		return worldBounds(z), true, errors.New("no bounds")
+	}
+
+	return s.b.zoomIn(z - 4), true, nil
+}
+
+func TestMultiLayerBounds(t *testing.T) {
+	var layers []Source
+	var sources []*boundsColorSource
+
+	// 16 z4 tiles in a row, each covered by its own source
+	for i := range 16 {
+		s := &boundsColorSource{
+			colorSource: newColorSource(t, "test", color.RGBA{R: uint8(i), A: 255}),
+			b:           TileBounds{XMin: i, YMin: 5, XMax: i, YMax: 5},
+		}
+
+		sources = append(sources, s)
+		layers = append(layers, NewZoomRange(s, 4, 16))
+	}
+
+	m := NewMultilayer("multi", "multi", layers)
+
+	// bounds are queried on first use of the zoom
+	for i, s := range sources {
+		if q := s.queries.Load(); q != 0 {
+			t.Errorf("source %d: got %d bounds queries, must be none", i, q)
+		}
+	}
+
+	td, err := m.GetTile(context.Background(), 10, 7<<6+3, 5<<6+60)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tileColor(t, td, 10, 10); got.R != 7 {
+		t.Errorf("got tile of source %d, must be 7", got.R)
+	}
+
+	if _, err := m.GetTile(context.Background(), 10, 3, 3); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, must be ErrNotFound", err)
+	}
+
+	// only the source covering the tile is queried
+	for i, s := range sources {
+		want := int32(0)
+
+		if i == 7 {
+			want = 1
+		}
+
+		if c := s.calls.Load(); c != want {
+			t.Errorf("source %d calls: got %d, must be %d", i, c, want)
+		}
+	}
+
+	if b, ok, _ := m.Bounds(4); !ok || b != (TileBounds{XMin: 0, YMin: 5, XMax: 15, YMax: 5}) {
+		t.Errorf("got bounds %v", b)
+	}
+
+	// the failed bounds query is kept for a while
+	sources[0].fail.Store(true)
+
+	for range 2 {
+		if _, _, err := m.Bounds(5); err == nil {
+			t.Error("bounds error must be returned")
+		}
+	}
+
+	sources[0].fail.Store(false)
+
+	if q := sources[0].queries.Load(); q != 3 {
+		t.Errorf("got %d bounds queries, must be 3 of zooms 10, 4 and 5", q)
+	}
+
+	m.mx.Lock()
+	m.index[5].expires = time.Now().Add(-time.Second)
+	m.mx.Unlock()
+
+	for range 2 {
+		if b, ok, err := m.Bounds(5); err != nil || !ok || b != (TileBounds{XMin: 0, YMin: 10, XMax: 31, YMax: 11}) {
+			t.Errorf("got bounds %v %v", b, err)
+		}
+	}
+
+	if q := sources[0].queries.Load(); q != 4 {
+		t.Errorf("got %d bounds queries, must be 4 of zooms 10, 4 and 5 twice", q)
+	}
+}
+
+// slowBoundsSource blocks bounds queries until release is closed.
+type slowBoundsSource struct {
+	*boundsColorSource
+
+	started chan struct{}
+	release chan struct{}
+}
+
+func (s *slowBoundsSource) Bounds(z int) (TileBounds, bool, error) {
+	s.started <- struct{}{}
+	<-s.release
+
+	return s.boundsColorSource.Bounds(z)
+}
+
+func TestMultiLayerIndexBuild(t *testing.T) {
+	slow := &slowBoundsSource{
+		boundsColorSource: &boundsColorSource{
+			colorSource: newColorSource(t, "slow", color.RGBA{R: 255, A: 255}),
+			b:           TileBounds{XMin: 1, YMin: 1, XMax: 1, YMax: 1},
+		},
+		started: make(chan struct{}, 8),
+		release: make(chan struct{}),
+	}
+
+	fast := &boundsColorSource{
+		colorSource: newColorSource(t, "fast", color.RGBA{B: 255, A: 255}),
+		b:           TileBounds{XMin: 2, YMin: 2, XMax: 2, YMax: 2},
+	}
+
+	m := NewMultilayer("multi", "multi", []Source{NewZoomRange(slow, 0, 4), fast})
+
+	var wg sync.WaitGroup
+
+	for range 8 {
+		wg.Go(func() {
+			if b, ok, err := m.Bounds(4); !ok || err != nil || b != (TileBounds{XMin: 1, YMin: 1, XMax: 2, YMax: 2}) {
+				t.Errorf("got bounds %v %v", b, err)
+			}
+		})
+	}
+
+	<-slow.started
+
+	// other zooms are not blocked by the index being built
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		if _, _, err := m.Bounds(5); err != nil {
+			t.Error(err)
+		}
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Error("the index of zoom 5 is blocked by zoom 4")
+	}
+
+	close(slow.release)
+	wg.Wait()
+
+	if q := slow.queries.Load(); q != 1 {
+		t.Errorf("got %d bounds queries, must be 1", q)
+	}
+}
+
+func TestBoundsIndex(t *testing.T) {
+	idx := newBoundsIndex(12)
+
+	idx.add(0, worldBounds(12))
+	idx.add(1, TileBounds{XMin: 100, YMin: 100, XMax: 120, YMax: 120})
+	idx.add(2, worldBounds(12))
+	idx.add(3, TileBounds{XMin: 110, YMin: 110, XMax: 110, YMax: 110})
+
+	if got := idx.find(110, 110); !slices.Equal(got, []int{0, 1, 2, 3}) {
+		t.Errorf("got %v", got)
+	}
+
+	if got := idx.find(121, 110); !slices.Equal(got, []int{0, 2}) {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,144 @@
+package model
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Mode is the operator override of the layer circuit breaker.
+type Mode string
+
+const (
+	ModeAuto    Mode = "auto"
+	ModeOnline  Mode = "online"
+	ModeOffline Mode = "offline"
+)
+
+func ParseMode(s string) (Mode, error) {
+	switch m := Mode(s); m {
+	case ModeAuto, ModeOnline, ModeOffline:
+		return m, nil
+	default:
+		return "", fmt.Errorf("invalid mode %s", s)
+	}
+}
+
+const (
+	stateClosed   = "closed"
+	stateOpen     = "open"
+	stateHalfOpen = "half-open"
+)
+
+// breaker switches the layer offline after threshold consecutive upstream failures.
+// After the cool-down it lets a single probe request through and closes again if it succeeds.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mx       sync.Mutex
+	mode     Mode
+	state    string
+	failures int
+	openedAt time.Time
+	probing  bool
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{
+		threshold: threshold,
+		cooldown:  cooldown,
+		mode:      ModeAuto,
+		state:     stateClosed,
+	}
+}
+
+// Allow reports whether an upstream request can be done now.
+// Every allowed request must be followed by Success, Failure or Release.
+func (b *breaker) Allow() bool {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	switch b.mode {
+	case ModeOnline:
+		return true
+	case ModeOffline:
+		return false
+	}
+
+	switch b.state {
+	case stateOpen:
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+
+		b.state = stateHalfOpen
+		b.probing = true
+
+		return true
+	case stateHalfOpen:
+		if b.probing {
+			return false
+		}
+
+		b.probing = true
+
+		return true
+	default:
+		return true
+	}
+}
+
+func (b *breaker) Success() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.failures = 0
+	b.probing = false
+	b.state = stateClosed
+}
+
+func (b *breaker) Failure() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.failures++
+	b.probing = false
+
+	if b.threshold == 0 {
+		return
+	}
+
+	if b.state == stateHalfOpen || (b.state == stateClosed && b.failures >= b.threshold) {
+		b.state = stateOpen
+		b.openedAt = time.Now()
+	}
+}
+
+// Release is called when the allowed request was not done, e.g. was canceled.
+func (b *breaker) Release() {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.probing = false
+}
+
+func (b *breaker) SetMode(m Mode) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	b.mode = m
+
+	if m == ModeAuto {
+		b.state = stateClosed
+		b.failures = 0
+		b.probing = false
+	}
+}
+
+func (b *breaker) State() (Mode, string) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+
+	return b.mode, b.state
+}
@@ -0,0 +1,417 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// Blend modes of composite layers.
+const (
+	BlendNormal   = "normal"
+	BlendMultiply = "multiply"
+	BlendScreen   = "screen"
+	BlendOverlay  = "overlay"
+	BlendDarken   = "darken"
+	BlendLighten  = "lighten"
+)
+
+var blendFuncs = map[string]func(b, s float64) float64{
+	BlendNormal:   func(_, s float64) float64 { return s },
+	BlendMultiply: func(b, s float64) float64 { return b * s },
+	BlendScreen:   func(b, s float64) float64 { return b + s - b*s },
+	BlendOverlay: func(b, s float64) float64 {
+		if b <= 0.5 {
+			return 2 * b * s
+		}
+
+		return 1 - 2*(1-b)*(1-s)
+	},
+	BlendDarken:  math.Min,
+	BlendLighten: math.Max,
+}
+
+// partialTileTTL is the lifetime of composite tiles and maps made without failed layers or tiles.
+const partialTileTTL = time.Minute
+
+var _ Source = &Composite{}
+
+// Composite renders tiles of several source layers on top of each other, the first layer is the bottom one.
+// Sources are looked up by key on every request, so they may be added or reloaded later.
+type Composite struct {
+	key     string
+	name    string
+	layers  []*LayerRef
+	blends  []func(b, s float64) float64
+	resolve func(key string) (Source, bool)
+	cache   *lruCache[string]
+}
+
+// NewComposite makes the composite of the layers looked up with resolve, rendered tiles are kept in memory cache
+// of cacheSize bytes.
+func NewComposite(key, name string, layers []*LayerRef, resolve func(key string) (Source, bool), cacheSize int64) (*Composite, error) {
+	if len(layers) == 0 {
+		return nil, fmt.Errorf("%s: no layers", key)
+	}
+
+	c := &Composite{key: key, name: name, layers: layers, resolve: resolve}
+
+	for _, l := range layers {
+		if l.Key == key {
+			return nil, fmt.Errorf("%s: layer refers to itself", key)
+		}
+
+		if l.Opacity < 0 || l.Opacity > 1 {
+			return nil, fmt.Errorf("%s: invalid opacity %v of %s", key, l.Opacity, l.Key)
+		}
+
+		blend := BlendNormal
+
+		if l.Blend != "" {
+			blend = strings.ToLower(l.Blend)
+		}
+
+		f, ok := blendFuncs[blend]
+
+		if !ok {
+			return nil, fmt.Errorf("%s: invalid blend mode %s of %s", key, l.Blend, l.Key)
+		}
+
+		c.blends = append(c.blends, f)
+	}
+
+	if cacheSize > 0 {
+		c.cache = newLRUCache[string](cacheSize)
+	}
+
+	return c, nil
+}
+
+// Retina returns the composite of 2x variants of the layers.
+func (c *Composite) Retina() *Composite {
+	r := *c
+	r.key = c.key + RetinaSuffix
+	r.name = c.name + " " + RetinaSuffix
+	r.layers = make([]*LayerRef, len(c.layers))
+
+	for i, l := range c.layers {
+		l2 := *l
+		l2.Key = l.Key + RetinaSuffix
+		r.layers[i] = &l2
+	}
+
+	if c.cache != nil {
+		r.cache = newLRUCache[string](c.cache.maxSize)
+	}
+
+	return &r
+}
+
+func (c *Composite) sources() []Source {
+	res := make([]Source, len(c.layers))
+
+	for i, l := range c.layers {
+		if s, ok := c.resolve(l.Key); ok {
+			res[i] = s
+		}
+	}
+
+	return res
+}
+
+func (c *Composite) GetKey() string {
+	return c.key
+}
+
+func (c *Composite) GetName() string {
+	return c.name
+}
+
+func (c *Composite) GetMinZoom() int {
+	res := -1
+
+	for i, s := range c.sources() {
+		if s == nil {
+			continue
+		}
+
+		if z, _ := c.layers[i].zoomRange(s); res == -1 || z < res {
+			res = z
+		}
+	}
+
+	return max(res, 0)
+}
+
+func (c *Composite) GetMaxZoom() int {
+	res := 0
+
+	for i, s := range c.sources() {
+		if s != nil {
+			_, z := c.layers[i].zoomRange(s)
+			res = max(res, z)
+		}
+	}
+
+	return res
+}
+
+func (c *Composite) IsTms() bool {
+	return false
+}
+
+func (c *Composite) IsFile() bool {
+	return false
+}
+
+// GetContentType returns jpeg if the bottom layer is opaque jpeg, as tiles are rendered over it, png otherwise.
+func (c *Composite) GetContentType() string {
+	if s, ok := c.resolve(c.layers[0].Key); ok && c.opacity(0) == 1 && s.GetContentType() == "image/jpeg" {
+		return "image/jpeg"
+	}
+
+	return "image/png"
+}
+
+func (c *Composite) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	if z < c.GetMinZoom() || z > c.GetMaxZoom() {
+		return nil, ErrOutOfRange
+	}
+
+	tiles, skipped, err := c.getTiles(ctx, z, x, y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ct := c.GetContentType()
+	h := sha256.New()
+	n := 0
+
+	_, _ = fmt.Fprintf(h, "%s;", ct)
+
+	for i, td := range tiles {
+		if td != nil {
+			n++
+			_, _ = fmt.Fprintf(h, "%d:%s;", i, td.Hash)
+		}
+	}
+
+	if n == 0 {
+		return nil, ErrNotFound
+	}
+
+	// the only tile with nothing to blend with, if it is of the composite type
+	if n == 1 {
+		for i, td := range tiles {
+			if td != nil && c.opacity(i) == 1 && td.ContentType == ct {
+				return Partial(td, skipped), nil
+			}
+		}
+	}
+
+	k := string(h.Sum(nil))
+
+	if c.cache != nil {
+		if td := c.cache.get(k); td != nil {
+			return Partial(td, skipped), nil
+		}
+	}
+
+	td, err := c.render(tiles, ct)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if c.cache != nil {
+		c.cache.put(k, td)
+	}
+
+	return Partial(td, skipped), nil
+}
+
+// getTiles gets the tiles of all layers at once. Missing tiles are nil, failed optional layers are nil too and
+// counted in skipped. The error is returned if a required layer fails, or if all the layers failed.
+func (c *Composite) getTiles(ctx context.Context, z, x, y int) ([]*TileData, int, error) {
+	tiles := make([]*TileData, len(c.layers))
+	errs := make([]error, len(c.layers))
+
+	var wg sync.WaitGroup
+
+	for i, s := range c.sources() {
+		if s == nil {
+			continue
+		}
+
+		if minZoom, maxZoom := c.layers[i].zoomRange(s); z < minZoom || z > maxZoom {
+			continue
+		}
+
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			td, err := s.GetTile(ctx, z, x, y)
+
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfRange) || errors.Is(err, ErrOutOfBounds) {
+				return
+			}
+
+			tiles[i], errs[i] = td, err
+		}()
+	}
+
+	wg.Wait()
+
+	var firstErr error
+
+	skipped := 0
+
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+
+		if !c.layers[i].Optional {
+			return nil, 0, err
+		}
+
+		if firstErr == nil {
+			firstErr = err
+		}
+
+		skipped++
+	}
+
+	if skipped > 0 && !slices.ContainsFunc(tiles, func(td *TileData) bool { return td != nil }) {
+		return nil, 0, firstErr
+	}
+
+	return tiles, skipped, nil
+}
+
+// Partial returns the tile or map made without some failed layers or tiles with short lifetime,
+// so clients ask for it again soon.
+func Partial(td *TileData, skipped int) *TileData {
+	if skipped == 0 {
+		return td
+	}
+
+	res := *td
+	exp := time.Now().Add(partialTileTTL)
+
+	if res.Expires.IsZero() || res.Expires.After(exp) {
+		res.Expires = exp
+	}
+
+	return &res
+}
+
+func (c *Composite) opacity(i int) float64 {
+	if c.layers[i].Opacity == 0 {
+		return 1
+	}
+
+	return c.layers[i].Opacity
+}
+
+// render blends the tiles bottom to top, tiles are scaled to the size of the bottom one.
+// The result is encoded as the content type of the composite.
+func (c *Composite) render(tiles []*TileData, ct string) (*TileData, error) {
+	var dst *image.NRGBA
+	var modTime, expires time.Time
+
+	format := "png"
+
+	if ct == "image/jpeg" {
+		format = "jpeg"
+	}
+
+	for i, td := range tiles {
+		if td == nil {
+			continue
+		}
+
+		img, _, err := decodeTile(td.Data)
+
+		if err != nil {
+			return nil, internalError(err)
+		}
+
+		if dst == nil {
+			dst = image.NewNRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		}
+
+		src := image.NewNRGBA(dst.Bounds())
+		draw.ApproxBiLinear.Scale(src, src.Bounds(), img, img.Bounds(), draw.Src, nil)
+
+		blend(dst, src, c.opacity(i), c.blends[i])
+
+		if td.ModTime.After(modTime) {
+			modTime = td.ModTime
+		}
+
+		if !td.Expires.IsZero() && (expires.IsZero() || td.Expires.Before(expires)) {
+			expires = td.Expires
+		}
+	}
+
+	data, ct, err := encodeTile(dst, format)
+
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	td := NewTileData(ct, data, modTime)
+	td.Expires = expires
+
+	return td, nil
+}
+
+// blend composes src over dst with the opacity and the separable blend function of backdrop and source colors.
+func blend(dst, src *image.NRGBA, opacity float64, f func(b, s float64) float64) {
+	for i := 0; i+3 < len(dst.Pix); i += 4 {
+		as := float64(src.Pix[i+3]) / 255 * opacity
+
+		if as == 0 {
+			continue
+		}
+
+		ab := float64(dst.Pix[i+3]) / 255
+		ao := as + ab*(1-as)
+
+		for j := range 3 {
+			cs := float64(src.Pix[i+j]) / 255
+			cb := float64(dst.Pix[i+j]) / 255
+			// the source color is blended where the backdrop is not transparent
+			cm := (1-ab)*cs + ab*f(cb, cs)
+			co := (as*cm + ab*(1-as)*cb) / ao
+			dst.Pix[i+j] = uint8(math.Round(co * 255))
+		}
+
+		dst.Pix[i+3] = uint8(math.Round(ao * 255))
+	}
+}
+
+// Info returns the info with attributions of all layers.
+func (c *Composite) Info() LayerInfo {
+	return LayerInfo{Attribution: joinAttributions(c.sources())}
+}
+
+// Invalidate drops rendered tiles.
+func (c *Composite) Invalidate() {
+	if c.cache != nil {
+		c.cache.Invalidate()
+	}
+}
@@ -0,0 +1,240 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+	"time"
+)
+
+// colorSource returns solid color png tiles.
+type colorSource struct {
+	testSource
+
+	key  string
+	data []byte
+}
+
+func newColorSource(t *testing.T, key string, c color.Color) *colorSource {
+	return &colorSource{key: key, data: solidPNG(t, c)}
+}
+
+func (s *colorSource) GetTile(_ context.Context, _, _, _ int) (*TileData, error) {
+	s.calls.Add(1)
+
+	return NewTileData("image/png", s.data, time.Now()), nil
+}
+
+func (s *colorSource) GetKey() string { return s.key }
+
+func TestComposite(t *testing.T) {
+	sources := map[string]Source{}
+
+	for _, s := range []*colorSource{
+		newColorSource(t, "red", color.RGBA{R: 255, A: 255}),
+		newColorSource(t, "blue", color.RGBA{B: 255, A: 255}),
+		newColorSource(t, "white", color.RGBA{R: 255, G: 255, B: 255, A: 255}),
+		newColorSource(t, "empty", color.RGBA{}),
+	} {
+		sources[s.key] = s
+	}
+
+	resolve := func(key string) (Source, bool) {
+		s, ok := sources[key]
+		return s, ok
+	}
+
+	for _, c := range []struct {
+		name   string
+		layers []*LayerRef
+		c      color.RGBA
+	}{
+		{
+			name:   "opacity",
+			layers: []*LayerRef{{Key: "red"}, {Key: "blue", Opacity: 0.5}},
+			c:      color.RGBA{R: 128, B: 128, A: 255},
+		},
+		{
+			name:   "multiply",
+			layers: []*LayerRef{{Key: "red"}, {Key: "white", Blend: BlendMultiply}},
+			c:      color.RGBA{R: 255, A: 255},
+		},
+		{
+			name:   "screen",
+			layers: []*LayerRef{{Key: "red"}, {Key: "blue", Blend: BlendScreen}},
+			c:      color.RGBA{R: 255, B: 255, A: 255},
+		},
+		{
+			name:   "transparent and missing",
+			layers: []*LayerRef{{Key: "blue"}, {Key: "empty"}, {Key: "unknown"}},
+			c:      color.RGBA{B: 255, A: 255},
+		},
+		{
+			name:   "over transparent",
+			layers: []*LayerRef{{Key: "empty"}, {Key: "red", Blend: BlendMultiply}},
+			c:      color.RGBA{R: 255, A: 255},
+		},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			comp, err := NewComposite("comp", "comp", c.layers, resolve, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			td, err := comp.GetTile(context.Background(), 1, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got := tileColor(t, td, 10, 10); got != c.c {
+				t.Errorf("got color %v, must be %v", got, c.c)
+			}
+
+			if td2, _ := comp.GetTile(context.Background(), 1, 0, 0); td2 != td {
+				t.Error("tile must be cached")
+			}
+		})
+	}
+
+	if _, err := NewComposite("comp", "comp", []*LayerRef{{Key: "red", Blend: "dodge"}}, resolve, 0); err == nil {
+		t.Error("unknown blend mode must fail")
+	}
+
+	comp, err := NewComposite("comp", "comp", []*LayerRef{{Key: "red"}, {Key: "blue"}}, resolve, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := comp.Retina()
+
+	if r.GetKey() != "comp"+RetinaSuffix || r.layers[1].Key != "blue"+RetinaSuffix || comp.layers[1].Key != "blue" {
+		t.Errorf("wrong retina composite %s %s", r.GetKey(), r.layers[1].Key)
+	}
+}
+
+func TestCompositeFailedLayers(t *testing.T) {
+	conc := &concurrency{}
+
+	sources := map[string]Source{
+		"red":     &slowSource{colorSource: newColorSource(t, "red", color.RGBA{R: 255, A: 255}), delay: time.Millisecond * 100, conc: conc},
+		"blue":    &slowSource{colorSource: newColorSource(t, "blue", color.RGBA{B: 255, A: 255}), delay: time.Millisecond * 100, conc: conc},
+		"offline": &errorSource{err: ErrOffline},
+	}
+
+	resolve := func(key string) (Source, bool) {
+		s, ok := sources[key]
+		return s, ok
+	}
+
+	c, err := NewComposite("c", "c", []*LayerRef{{Key: "red"}, {Key: "offline", Optional: true}, {Key: "blue", Opacity: 0.5}}, resolve, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	td, err := c.GetTile(context.Background(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := conc.max.Load(); n != 2 {
+		t.Errorf("layers are not fetched at once, %d concurrent requests", n)
+	}
+
+	if td.Expires.IsZero() || time.Until(td.Expires) > partialTileTTL {
+		t.Errorf("tile without failed layer must expire soon, expires %s", td.Expires)
+	}
+
+	c, err = NewComposite("c", "c", []*LayerRef{{Key: "red"}, {Key: "offline"}}, resolve, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GetTile(context.Background(), 1, 0, 0); !errors.Is(err, ErrOffline) {
+		t.Errorf("got error %v, required layer error expected", err)
+	}
+
+	c, err = NewComposite("c", "c", []*LayerRef{{Key: "offline", Optional: true}}, resolve, 1<<20)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := c.GetTile(context.Background(), 1, 0, 0); !errors.Is(err, ErrOffline) {
+		t.Errorf("got error %v, the only layer error expected", err)
+	}
+}
+
+// jpegSource returns solid color jpeg tiles.
+type jpegSource struct {
+	colorSource
+}
+
+func newJPEGSource(t *testing.T, key string, c color.Color) *jpegSource {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+	draw.Draw(img, img.Bounds(), image.NewUniform(c), image.Point{}, draw.Src)
+
+	data, _, err := encodeTile(img, "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &jpegSource{colorSource: colorSource{key: key, data: data}}
+}
+
+func (s *jpegSource) GetTile(_ context.Context, _, _, _ int) (*TileData, error) {
+	s.calls.Add(1)
+
+	return NewTileData("image/jpeg", s.data, time.Now()), nil
+}
+
+func (s *jpegSource) GetContentType() string { return "image/jpeg" }
+
+func TestCompositeContentType(t *testing.T) {
+	sources := map[string]Source{
+		"sat":   newJPEGSource(t, "sat", color.RGBA{G: 255, A: 255}),
+		"roads": newColorSource(t, "roads", color.RGBA{R: 255, A: 255}),
+		"empty": newColorSource(t, "empty", color.RGBA{}),
+	}
+
+	resolve := func(key string) (Source, bool) {
+		s, ok := sources[key]
+		return s, ok
+	}
+
+	for _, c := range []struct {
+		name   string
+		layers []*LayerRef
+		ct     string
+	}{
+		{name: "jpeg bottom", layers: []*LayerRef{{Key: "sat"}, {Key: "roads", Opacity: 0.5}}, ct: "image/jpeg"},
+		{name: "jpeg only", layers: []*LayerRef{{Key: "sat"}, {Key: "unknown"}}, ct: "image/jpeg"},
+		{name: "unknown bottom", layers: []*LayerRef{{Key: "unknown"}, {Key: "roads"}}, ct: "image/png"},
+		{name: "transparent jpeg bottom", layers: []*LayerRef{{Key: "sat", Opacity: 0.5}, {Key: "roads"}}, ct: "image/png"},
+		// the only jpeg tile is rendered as png
+		{name: "jpeg over png", layers: []*LayerRef{{Key: "unknown"}, {Key: "sat"}}, ct: "image/png"},
+		{name: "png bottom", layers: []*LayerRef{{Key: "empty"}, {Key: "sat"}}, ct: "image/png"},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			comp, err := NewComposite("comp", "comp", c.layers, resolve, 1<<20)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if ct := comp.GetContentType(); ct != c.ct {
+				t.Errorf("got content type %s, must be %s", ct, c.ct)
+			}
+
+			td, err := comp.GetTile(context.Background(), 1, 0, 0)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if _, f, err := image.Decode(bytes.NewReader(td.Data)); err != nil || td.ContentType != c.ct || "image/"+f != c.ct {
+				t.Errorf("got %s tile of %s, %v", td.ContentType, f, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,44 @@
+package model
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+)
+
+var (
+	ErrNotFound    = errors.New("tile not found")
+	ErrOutOfRange  = errors.New("zoom out of range")
+	ErrOutOfBounds = errors.New("tile is outside of layer bounds")
+	ErrOffline     = errors.New("layer is offline")
+	ErrInternal    = errors.New("internal error")
+	ErrTooLarge    = errors.New("map is too large")
+)
+
+// UpstreamError is returned when the upstream tile server fails or answers with a non 2xx status.
+type UpstreamError struct {
+	Url    string
+	Status int
+	Err    error
+}
+
+func (e *UpstreamError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("upstream %s: %s", e.Url, e.Err)
+	}
+
+	return fmt.Sprintf("upstream %s: status %d", e.Url, e.Status)
+}
+
+func (e *UpstreamError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports upstream 404 as ErrNotFound.
+func (e *UpstreamError) Is(target error) bool {
+	return target == ErrNotFound && e.Status == http.StatusNotFound
+}
+
+func internalError(err error) error {
+	return fmt.Errorf("%w: %w", ErrInternal, err)
+}
@@ -0,0 +1,612 @@
+package model
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// accessFile is the file in the store root with saved tile access times.
+const accessFile = ".access"
+
+const (
+	// maxForgotten is the number of forgotten tiles kept in memory before they are written to the access file
+	maxForgotten = 1024
+	// minCompactLines is the access file size in lines it is never compacted below
+	minCompactLines = 4096
+)
+
+var _ TileStore = &FileStore{}
+
+// FileStore keeps tiles as files in a directory tree. The tile upstream metadata is kept in the ".meta"
+// json file next to the tile, the "tile not exists" marker is an empty ".tne" file, as in SAS.Planet.
+// Access times of used tiles are appended to the ".access" file of the root, they are read by Iterate only,
+// the disk usage of the proxy keeps them in memory.
+type FileStore struct {
+	root   string
+	ext    string
+	tms    bool
+	layout keyLayout
+
+	mx sync.Mutex
+	// accessLog is the access file open for appending, it is opened on first save or if the file exists
+	accessLog *os.File
+	// checked is set when the access file is looked for
+	checked bool
+	// lines is the number of lines in the access file, live is the number of its tiles after the last compaction
+	lines, live int
+	// forgotten are replaced or removed tiles, their access times are dropped on the next write
+	forgotten map[Tile]struct{}
+}
+
+// keyLayout maps tiles to file names or object keys without the extension.
+type keyLayout struct {
+	format func(t Tile) string
+	parse  func(name string) (Tile, bool)
+}
+
+var (
+	sasLayout  = keyLayout{format: sasFormat, parse: sasParse}
+	flatLayout = keyLayout{format: flatFormat, parse: flatParse}
+)
+
+func getLayout(name string) (keyLayout, error) {
+	switch strings.ToLower(name) {
+	case "", StoreSASPlanet:
+		return sasLayout, nil
+	case StoreFlat:
+		return flatLayout, nil
+	default:
+		return keyLayout{}, fmt.Errorf("unknown layout %q", name)
+	}
+}
+
+// NewSASPlanetStore creates the store with SAS.Planet layout z{z}/{x/1024}/x{x}/{y/1024}/y{y}.ext.
+// With tms set the tiles are stored with TMS y.
+func NewSASPlanetStore(root, ext string, tms bool) *FileStore {
+	return &FileStore{
+		root:   root,
+		ext:    ext,
+		tms:    tms,
+		layout: sasLayout,
+	}
+}
+
+// NewFlatStore creates the store with {z}/{x}/{y}.ext layout.
+// With tms set the tiles are stored with TMS y.
+func NewFlatStore(root, ext string, tms bool) *FileStore {
+	return &FileStore{
+		root:   root,
+		ext:    ext,
+		tms:    tms,
+		layout: flatLayout,
+	}
+}
+
+func sasFormat(t Tile) string {
+	return fmt.Sprintf("z%d/%d/x%d/%d/y%d", t.Z, t.X/1024, t.X, t.Y/1024, t.Y)
+}
+
+func sasParse(name string) (Tile, bool) {
+	parts := strings.Split(name, "/")
+
+	if len(parts) != 5 {
+		return Tile{}, false
+	}
+
+	z, err1 := strconv.Atoi(strings.TrimPrefix(parts[0], "z"))
+	x, err2 := strconv.Atoi(strings.TrimPrefix(parts[2], "x"))
+	y, err3 := strconv.Atoi(strings.TrimPrefix(parts[4], "y"))
+
+	if err1 != nil || err2 != nil || err3 != nil {
+		return Tile{}, false
+	}
+
+	return Tile{X: x, Y: y, Z: z}, true
+}
+
+func flatFormat(t Tile) string {
+	return fmt.Sprintf("%d/%d/%d", t.Z, t.X, t.Y)
+}
+
+func flatParse(name string) (Tile, bool) {
+	parts := strings.Split(name, "/")
+
+	if len(parts) != 3 {
+		return Tile{}, false
+	}
+
+	z, err1 := strconv.Atoi(parts[0])
+	x, err2 := strconv.Atoi(parts[1])
+	y, err3 := strconv.Atoi(parts[2])
+
+	if err1 != nil || err2 != nil || err3 != nil {
+		return Tile{}, false
+	}
+
+	return Tile{X: x, Y: y, Z: z}, true
+}
+
+func (s *FileStore) baseName(t Tile) string {
+	if s.tms {
+		t = flipY(t)
+	}
+
+	return path.Join(s.root, s.layout.format(t))
+}
+
+// tileName returns the file name of the tile. It ends with a dot for layers without the tile type, as S3 keys do.
+func (s *FileStore) tileName(t Tile) string {
+	return s.baseName(t) + "." + s.ext
+}
+
+// tneName returns the name of the "tile not exists" marker file.
+func (s *FileStore) tneName(t Tile) string {
+	return s.baseName(t) + ".tne"
+}
+
+func metaName(name string) string {
+	return name + ".meta"
+}
+
+func (s *FileStore) Get(_ context.Context, t Tile) ([]byte, *TileInfo, error) {
+	name := s.tileName(t)
+
+	st, err := os.Stat(name)
+
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, nil, err
+		}
+
+		info, err := s.statMissing(t)
+
+		return nil, info, err
+	}
+
+	b, err := os.ReadFile(name)
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return b, &TileInfo{Size: int64(len(b)), ModTime: st.ModTime(), Meta: readMeta(name)}, nil
+}
+
+func (s *FileStore) Stat(_ context.Context, t Tile) (*TileInfo, error) {
+	name := s.tileName(t)
+
+	st, err := os.Stat(name)
+
+	if err != nil {
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+
+		return s.statMissing(t)
+	}
+
+	return &TileInfo{Size: st.Size(), ModTime: st.ModTime(), Meta: readMeta(name)}, nil
+}
+
+func (s *FileStore) statMissing(t Tile) (*TileInfo, error) {
+	st, err := os.Stat(s.tneName(t))
+
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil, ErrNotFound
+		}
+
+		return nil, err
+	}
+
+	return &TileInfo{ModTime: st.ModTime(), Missing: true}, nil
+}
+
+func (s *FileStore) Put(_ context.Context, t Tile, data []byte, meta TileMeta) error {
+	name := s.tileName(t)
+
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	// validators of the old tile must never be seen with the new one and vice versa, so the old meta goes first.
+	// A tile without meta is just downloaded again without conditional request.
+	if err := removeFile(metaName(name)); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(name, data, 0644); err != nil {
+		return err
+	}
+
+	if err := writeMeta(name, meta); err != nil {
+		return err
+	}
+
+	s.forgetAccess(t)
+
+	return removeFile(s.tneName(t))
+}
+
+func (s *FileStore) PutMissing(_ context.Context, t Tile) error {
+	name := s.tneName(t)
+
+	if err := os.MkdirAll(path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	if err := os.WriteFile(name, nil, 0644); err != nil {
+		return err
+	}
+
+	tile := s.tileName(t)
+	s.forgetAccess(t)
+
+	return errors.Join(removeFile(tile), removeFile(metaName(tile)))
+}
+
+func (s *FileStore) Touch(_ context.Context, t Tile) error {
+	now := time.Now()
+
+	err := os.Chtimes(s.tileName(t), now, now)
+
+	if errors.Is(err, fs.ErrNotExist) {
+		return ErrNotFound
+	}
+
+	return err
+}
+
+// SetAccessTimes appends access times of existing tiles to the access file.
+func (s *FileStore) SetAccessTimes(_ context.Context, times map[Tile]time.Time) error {
+	var buf bytes.Buffer
+
+	n := 0
+
+	for t, atime := range times {
+		if _, err := os.Stat(s.tileName(t)); err == nil {
+			writeAccess(&buf, t, atime.Unix())
+			n++
+		}
+	}
+
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if n == 0 && len(s.forgotten) == 0 {
+		return nil
+	}
+
+	if err := s.openAccess(true); err != nil {
+		return err
+	}
+
+	return s.appendAccess(buf.Bytes(), n)
+}
+
+func (s *FileStore) Delete(_ context.Context, t Tile) error {
+	name := s.tileName(t)
+	s.forgetAccess(t)
+
+	return errors.Join(removeFile(name), removeFile(metaName(name)), removeFile(s.tneName(t)))
+}
+
+func (s *FileStore) Iterate(ctx context.Context, fn func(t Tile, info *TileInfo) bool) error {
+	s.mx.Lock()
+	access := readAccessFile(filepath.Join(s.root, accessFile))
+
+	for t := range s.forgotten {
+		delete(access, t)
+	}
+
+	s.mx.Unlock()
+
+	err := filepath.WalkDir(s.root, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		if ctx.Err() != nil {
+			return fs.SkipAll
+		}
+
+		if d.IsDir() {
+			return nil
+		}
+
+		ext := filepath.Ext(name)
+
+		if ext != "."+s.ext && ext != ".tne" {
+			return nil
+		}
+
+		rel, err := filepath.Rel(s.root, strings.TrimSuffix(name, ext))
+
+		if err != nil {
+			return nil
+		}
+
+		t, ok := s.layout.parse(filepath.ToSlash(rel))
+
+		if !ok {
+			return nil
+		}
+
+		if s.tms {
+			t = flipY(t)
+		}
+
+		st, err := d.Info()
+
+		if err != nil {
+			if errors.Is(err, fs.ErrNotExist) {
+				return nil
+			}
+
+			return err
+		}
+
+		info := &TileInfo{Size: st.Size(), ModTime: st.ModTime(), Missing: ext == ".tne"}
+
+		if atime, ok := access[t]; ok && !info.Missing {
+			info.AccessTime = time.Unix(atime, 0)
+		}
+
+		if !fn(t, info) {
+			return fs.SkipAll
+		}
+
+		return nil
+	})
+
+	return err
+}
+
+// Close writes forgotten tiles and closes the access file.
+func (s *FileStore) Close() error {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	if s.accessLog == nil {
+		return nil
+	}
+
+	err := s.appendAccess(nil, 0)
+	err = errors.Join(err, s.accessLog.Close())
+	s.accessLog = nil
+	s.checked = false
+
+	return err
+}
+
+// openAccess opens the access file for appending, compacting it first. The file is created only with create set,
+// otherwise the missing file is left alone. The caller holds the lock.
+func (s *FileStore) openAccess(create bool) error {
+	if s.accessLog != nil || (s.checked && !create) {
+		return nil
+	}
+
+	s.checked = true
+
+	if _, err := os.Stat(filepath.Join(s.root, accessFile)); errors.Is(err, fs.ErrNotExist) && !create {
+		return nil
+	}
+
+	return s.compactAccess()
+}
+
+// forgetAccess drops the access time of the tile that is replaced or removed.
+func (s *FileStore) forgetAccess(t Tile) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+
+	// there is nothing to forget without the access file
+	if err := s.openAccess(false); err != nil || s.accessLog == nil {
+		return
+	}
+
+	if s.forgotten == nil {
+		s.forgotten = make(map[Tile]struct{})
+	}
+
+	s.forgotten[t] = struct{}{}
+
+	if len(s.forgotten) >= maxForgotten {
+		_ = s.appendAccess(nil, 0)
+	}
+}
+
+// appendAccess appends zero times of forgotten tiles and then n lines of data to the access file,
+// compacting it when most of its lines are overwritten. The caller holds the lock.
+func (s *FileStore) appendAccess(data []byte, n int) error {
+	var buf bytes.Buffer
+
+	for t := range s.forgotten {
+		writeAccess(&buf, t, 0)
+	}
+
+	buf.Write(data)
+
+	if buf.Len() == 0 {
+		return nil
+	}
+
+	if _, err := s.accessLog.Write(buf.Bytes()); err != nil {
+		return err
+	}
+
+	s.lines += n + len(s.forgotten)
+	clear(s.forgotten)
+
+	if s.lines > minCompactLines && s.lines > s.live*2 {
+		return s.compactAccess()
+	}
+
+	return nil
+}
+
+// compactAccess writes the access file with the last time of each tile and opens it for appending.
+// The caller holds the lock.
+func (s *FileStore) compactAccess() error {
+	name := filepath.Join(s.root, accessFile)
+	access := readAccessFile(name)
+
+	var buf bytes.Buffer
+
+	for t, atime := range access {
+		writeAccess(&buf, t, atime)
+	}
+
+	if err := os.MkdirAll(s.root, 0755); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(name, buf.Bytes(), 0644); err != nil {
+		return err
+	}
+
+	if s.accessLog != nil {
+		_ = s.accessLog.Close()
+		s.accessLog = nil
+	}
+
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644)
+
+	if err != nil {
+		return err
+	}
+
+	s.accessLog = f
+	s.lines, s.live = len(access), len(access)
+
+	return nil
+}
+
+func writeAccess(buf *bytes.Buffer, t Tile, atime int64) {
+	fmt.Fprintf(buf, "%d %d %d %d\n", t.Z, t.X, t.Y, atime)
+}
+
+// readAccessFile reads "z x y unixtime" lines, the last line of the tile wins and zero time drops it.
+// The missing or broken file just means no saved access times.
+func readAccessFile(name string) map[Tile]int64 {
+	res := make(map[Tile]int64)
+
+	f, err := os.Open(name)
+
+	if err != nil {
+		return res
+	}
+
+	defer f.Close()
+
+	sc := bufio.NewScanner(f)
+
+	for sc.Scan() {
+		var t Tile
+		var atime int64
+
+		if _, err := fmt.Sscan(sc.Text(), &t.Z, &t.X, &t.Y, &atime); err != nil {
+			continue
+		}
+
+		if atime == 0 {
+			delete(res, t)
+		} else {
+			res[t] = atime
+		}
+	}
+
+	return res
+}
+
+// readMeta returns upstream validators stored for the tile file, empty if there are none.
+func readMeta(name string) TileMeta {
+	var m TileMeta
+
+	b, err := os.ReadFile(metaName(name))
+
+	if err != nil {
+		return m
+	}
+
+	_ = json.Unmarshal(b, &m)
+
+	return m
+}
+
+func writeMeta(name string, m TileMeta) error {
+	if m.IsEmpty() {
+		return removeFile(metaName(name))
+	}
+
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		return err
+	}
+
+	return writeFileAtomic(metaName(name), b, 0644)
+}
+
+func removeFile(name string) error {
+	if err := os.Remove(name); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	return nil
+}
+
+// writeFileAtomic writes data to a temp file in the same directory and renames it to name,
+// so readers never see a partially written tile.
+func writeFileAtomic(name string, data []byte, perm os.FileMode) error {
+	f, err := os.CreateTemp(filepath.Dir(name), filepath.Base(name)+".tmp*")
+
+	if err != nil {
+		return err
+	}
+
+	tmp := f.Name()
+
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	if err := f.Close(); err != nil {
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	if err := os.Chmod(tmp, perm); err != nil {
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	if err := os.Rename(tmp, name); err != nil {
+		_ = os.Remove(tmp)
+
+		return err
+	}
+
+	return nil
+}
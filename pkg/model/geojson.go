@@ -0,0 +1,269 @@
+package model
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+)
+
+// maxOverlayPoints limits the number of points of GeoJSON overlays.
+const maxOverlayPoints = 100000
+
+type geoJSON struct {
+	Type        string          `json:"type"`
+	Features    []geoJSON       `json:"features"`
+	Geometry    *geoJSON        `json:"geometry"`
+	Geometries  []geoJSON       `json:"geometries"`
+	Properties  map[string]any  `json:"properties"`
+	Coordinates json.RawMessage `json:"coordinates"`
+}
+
+// ParseGeoJSON returns overlays of GeoJSON geometry, feature or feature collection. Features are styled with
+// simplestyle properties: marker-color, marker-size, stroke, stroke-width, stroke-opacity, fill and fill-opacity.
+func ParseGeoJSON(data []byte) ([]Overlay, error) {
+	var g geoJSON
+
+	if err := json.Unmarshal(data, &g); err != nil {
+		return nil, fmt.Errorf("invalid geojson: %w", err)
+	}
+
+	var res []Overlay
+
+	if err := g.overlays(nil, &res); err != nil {
+		return nil, err
+	}
+
+	n := 0
+
+	for _, o := range res {
+		n += len(o.Points)
+
+		for _, h := range o.Holes {
+			n += len(h)
+		}
+	}
+
+	if n > maxOverlayPoints {
+		return nil, fmt.Errorf("too many points: %d", n)
+	}
+
+	return res, nil
+}
+
+func (g *geoJSON) overlays(props map[string]any, res *[]Overlay) error {
+	switch g.Type {
+	case "FeatureCollection":
+		for _, f := range g.Features {
+			if err := f.overlays(nil, res); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case "Feature":
+		if g.Geometry == nil {
+			return nil
+		}
+
+		return g.Geometry.overlays(g.Properties, res)
+	case "GeometryCollection":
+		for _, geom := range g.Geometries {
+			if err := geom.overlays(props, res); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	case "Point":
+		var p []float64
+
+		return g.add(&p, func() error {
+			pt, err := position(p)
+
+			if err == nil {
+				*res = append(*res, styled(OverlayMarker, [][2]float64{pt}, nil, props))
+			}
+
+			return err
+		})
+	case "MultiPoint", "LineString":
+		var line [][]float64
+
+		return g.add(&line, func() error {
+			pts, err := positions(line)
+
+			if err != nil {
+				return err
+			}
+
+			if g.Type == "LineString" {
+				*res = append(*res, styled(OverlayLine, pts, nil, props))
+				return nil
+			}
+
+			for _, pt := range pts {
+				*res = append(*res, styled(OverlayMarker, [][2]float64{pt}, nil, props))
+			}
+
+			return nil
+		})
+	case "MultiLineString", "Polygon":
+		var lines [][][]float64
+
+		return g.add(&lines, func() error {
+			if g.Type == "Polygon" {
+				return addPolygon(lines, props, res)
+			}
+
+			for _, line := range lines {
+				pts, err := positions(line)
+
+				if err != nil {
+					return err
+				}
+
+				*res = append(*res, styled(OverlayLine, pts, nil, props))
+			}
+
+			return nil
+		})
+	case "MultiPolygon":
+		var polygons [][][][]float64
+
+		return g.add(&polygons, func() error {
+			for _, p := range polygons {
+				if err := addPolygon(p, props, res); err != nil {
+					return err
+				}
+			}
+
+			return nil
+		})
+	default:
+		return fmt.Errorf("unsupported geojson type %q", g.Type)
+	}
+}
+
+// add unmarshals the coordinates to v and calls f.
+func (g *geoJSON) add(v any, f func() error) error {
+	if err := json.Unmarshal(g.Coordinates, v); err != nil {
+		return fmt.Errorf("invalid %s coordinates: %w", g.Type, err)
+	}
+
+	return f()
+}
+
+func addPolygon(rings [][][]float64, props map[string]any, res *[]Overlay) error {
+	if len(rings) == 0 {
+		return nil
+	}
+
+	outer, err := positions(rings[0])
+
+	if err != nil {
+		return err
+	}
+
+	var holes [][][2]float64
+
+	for _, r := range rings[1:] {
+		h, err := positions(r)
+
+		if err != nil {
+			return err
+		}
+
+		holes = append(holes, h)
+	}
+
+	*res = append(*res, styled(OverlayPolygon, outer, holes, props))
+
+	return nil
+}
+
+func position(p []float64) ([2]float64, error) {
+	if len(p) < 2 || math.Abs(p[0]) > 360 || math.Abs(p[1]) > 90 {
+		return [2]float64{}, errors.New("invalid position")
+	}
+
+	return [2]float64{p[0], p[1]}, nil
+}
+
+func positions(ps [][]float64) ([][2]float64, error) {
+	res := make([][2]float64, len(ps))
+
+	for i, p := range ps {
+		pt, err := position(p)
+
+		if err != nil {
+			return nil, err
+		}
+
+		res[i] = pt
+	}
+
+	return res, nil
+}
+
+// styled returns the overlay with simplestyle properties applied.
+func styled(kind string, pts [][2]float64, holes [][][2]float64, props map[string]any) Overlay {
+	o := NewOverlay(kind)
+	o.Points, o.Holes = pts, holes
+
+	str := func(k string) string {
+		s, _ := props[k].(string)
+		return s
+	}
+
+	num := func(k string) (float64, bool) {
+		v, ok := props[k].(float64)
+		return v, ok
+	}
+
+	if kind == OverlayMarker {
+		if c, ok := ParseColor(str("marker-color")); ok {
+			o.Color = c
+		}
+
+		switch str("marker-size") {
+		case "small":
+			o.Size = 5
+		case "large":
+			o.Size = 12
+		}
+
+		return o
+	}
+
+	if c, ok := ParseColor(str("stroke")); ok {
+		o.Color = c
+	}
+
+	if v, ok := num("stroke-opacity"); ok {
+		o.Color.A = opacity(v)
+	}
+
+	if v, ok := num("stroke-width"); ok {
+		o.Width = max(0, min(v, 50))
+	}
+
+	if c, ok := ParseColor(str("fill")); ok {
+		// opaque fill would hide the map, fill-opacity sets it explicitly
+		if c.A == 0xff {
+			c.A = o.Fill.A
+		}
+
+		o.Fill = c
+	}
+
+	if v, ok := num("fill-opacity"); ok {
+		o.Fill.A = opacity(v)
+	}
+
+	return o
+}
+
+func opacity(v float64) uint8 {
+	return uint8(math.Round(max(0, min(v, 1)) * 255))
+}
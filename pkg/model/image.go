@@ -0,0 +1,49 @@
+package model
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"image/png"
+
+	"github.com/HugoSmits86/nativewebp"
+	_ "golang.org/x/image/webp"
+)
+
+const jpegQuality = 90
+
+// decodeTile decodes png, jpeg or webp tile image.
+func decodeTile(data []byte) (image.Image, string, error) {
+	return image.Decode(bytes.NewReader(data))
+}
+
+// encodeTile encodes the image in the format of the source tile and returns the data with its content type.
+func encodeTile(img image.Image, format string) ([]byte, string, error) {
+	return encodeImage(img, format, jpegQuality)
+}
+
+// encodeImage encodes the image as png, jpeg with the quality or webp. Webp is always lossless.
+func encodeImage(img image.Image, format string, quality int) ([]byte, string, error) {
+	var buf bytes.Buffer
+
+	switch format {
+	case "jpeg":
+		if err := jpeg.Encode(&buf, img, &jpeg.Options{Quality: quality}); err != nil {
+			return nil, "", err
+		}
+
+		return buf.Bytes(), "image/jpeg", nil
+	case "webp":
+		if err := nativewebp.Encode(&buf, img, nil); err != nil {
+			return nil, "", err
+		}
+
+		return buf.Bytes(), "image/webp", nil
+	default:
+		if err := png.Encode(&buf, img); err != nil {
+			return nil, "", err
+		}
+
+		return buf.Bytes(), "image/png", nil
+	}
+}
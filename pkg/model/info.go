@@ -0,0 +1,145 @@
+package model
+
+import (
+	"encoding/json"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+)
+
+// LayerInfo describes the layer for clients, e.g. in TileJSON.
+type LayerInfo struct {
+	Attribution string
+	Description string
+	// Bounds are minlon, minlat, maxlon, maxlat.
+	Bounds []float64
+	// Center is lon, lat, zoom.
+	Center []float64
+	// VectorLayers are vector_layers of mbtiles json metadata.
+	VectorLayers json.RawMessage
+}
+
+// infoSource is a source that knows its LayerInfo.
+type infoSource interface {
+	Info() LayerInfo
+}
+
+// With returns the info with the fields set in o replaced.
+func (i LayerInfo) With(o LayerInfo) LayerInfo {
+	if o.Attribution != "" {
+		i.Attribution = o.Attribution
+	}
+
+	if o.Description != "" {
+		i.Description = o.Description
+	}
+
+	if len(o.Bounds) == 4 {
+		i.Bounds = o.Bounds
+	}
+
+	if len(o.Center) == 3 {
+		i.Center = o.Center
+	}
+
+	if len(o.VectorLayers) > 0 {
+		i.VectorLayers = o.VectorLayers
+	}
+
+	return i
+}
+
+// GetLayerInfo returns the info of the source under wrappers. Missing bounds are taken from the tiles
+// at max zoom, missing center is the middle of bounds at min zoom.
+func GetLayerInfo(s Source) LayerInfo {
+	var info LayerInfo
+
+	for src := s; ; {
+		if i, ok := src.(infoSource); ok {
+			info = i.Info()
+			break
+		}
+
+		w, ok := src.(interface{ Unwrap() Source })
+
+		if !ok {
+			break
+		}
+
+		src = w.Unwrap()
+	}
+
+	if len(info.Bounds) != 4 {
+		if b, ok := s.(boundsSource); ok {
+			if tb, ok, err := b.Bounds(s.GetMaxZoom()); ok && err == nil {
+				info.Bounds = tb.lonLat(s.GetMaxZoom())
+			}
+		}
+	}
+
+	if len(info.Center) != 3 && len(info.Bounds) == 4 {
+		info.Center = []float64{
+			(info.Bounds[0] + info.Bounds[2]) / 2,
+			(info.Bounds[1] + info.Bounds[3]) / 2,
+			float64(s.GetMinZoom()),
+		}
+	}
+
+	return info
+}
+
+// lonLat returns minlon, minlat, maxlon, maxlat of the tiles.
+func (b TileBounds) lonLat(z int) []float64 {
+	n := float64(int(1) << z)
+
+	lon := func(x int) float64 {
+		return float64(x)/n*360 - 180
+	}
+
+	lat := func(y int) float64 {
+		return math.Atan(math.Sinh(math.Pi*(1-2*float64(y)/n))) * 180 / math.Pi
+	}
+
+	return []float64{lon(b.XMin), lat(b.YMax + 1), lon(b.XMax + 1), lat(b.YMin)}
+}
+
+// joinAttributions joins unique attributions of the sources.
+func joinAttributions(sources []Source) string {
+	var res []string
+
+	for _, s := range sources {
+		if s == nil {
+			continue
+		}
+
+		if a := GetLayerInfo(s).Attribution; a != "" && !slices.Contains(res, a) {
+			res = append(res, a)
+		}
+	}
+
+	return strings.Join(res, ", ")
+}
+
+// parseFloats parses comma separated numbers of mbtiles metadata.
+func parseFloats(s string, n int) ([]float64, bool) {
+	parts := strings.Split(s, ",")
+
+	if len(parts) != n {
+		return nil, false
+	}
+
+	res := make([]float64, n)
+
+	for i, p := range parts {
+		v, err := strconv.ParseFloat(strings.TrimSpace(p), 64)
+
+		if err != nil {
+			return nil, false
+		}
+
+		res[i] = v
+	}
+
+	return res, true
+}
@@ -0,0 +1,63 @@
+package model
+
+import (
+	"database/sql"
+	"math"
+	"testing"
+)
+
+func TestLayerInfo(t *testing.T) {
+	name := testMBTiles(t)
+
+	db, err := sql.Open("sqlite", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := db.Exec("INSERT INTO metadata (name, value) VALUES ('attribution', 'test maps'), ('json', '{\"vector_layers\":[{\"id\":\"roads\"}]}')"); err != nil {
+		t.Fatal(err)
+	}
+
+	_ = db.Close()
+
+	l, err := NewLayer("test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	info := GetLayerInfo(NewMemCache(l, 1000))
+
+	if info.Attribution != "test maps" {
+		t.Errorf("wrong attribution %s", info.Attribution)
+	}
+
+	if string(info.VectorLayers) != `[{"id":"roads"}]` {
+		t.Errorf("wrong vector layers %s", info.VectorLayers)
+	}
+
+	// z2 tiles 0,0 - 1,1 are the north-western quarter of the world
+	want := []float64{-180, 0, 0, 85.0511}
+
+	if len(info.Bounds) != 4 {
+		t.Fatalf("wrong bounds %v", info.Bounds)
+	}
+
+	for i, v := range want {
+		if math.Abs(info.Bounds[i]-v) > 0.001 {
+			t.Errorf("wrong bounds %v, must be %v", info.Bounds, want)
+			break
+		}
+	}
+
+	if len(info.Center) != 3 || info.Center[0] != -90 || info.Center[2] != 2 {
+		t.Errorf("wrong center %v", info.Center)
+	}
+
+	info = info.With(LayerInfo{Attribution: "other", Center: []float64{1, 2, 3}})
+
+	if info.Attribution != "other" || info.Center[0] != 1 || len(info.Bounds) != 4 {
+		t.Errorf("wrong info %+v", info)
+	}
+}
@@ -0,0 +1,431 @@
+package model
+
+import (
+	"container/heap"
+	"context"
+	"fmt"
+	"log/slog"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/dustin/go-humanize"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	janitorInterval = time.Minute
+	// caches are cleaned down to this share of the quota
+	lowWatermark = 0.9
+)
+
+// ByteSize is a size in bytes, in yaml it can be given as "64GB" or "500MiB".
+type ByteSize int64
+
+func (b *ByteSize) UnmarshalYAML(value *yaml.Node) error {
+	n, err := humanize.ParseBytes(value.Value)
+
+	if err != nil {
+		return err
+	}
+
+	*b = ByteSize(n)
+
+	return nil
+}
+
+// accessTimeStore keeps tile access times, so the least recently used order survives restarts.
+type accessTimeStore interface {
+	// SetAccessTimes saves access times of tiles, tiles that are not in the store are skipped.
+	SetAccessTimes(ctx context.Context, times map[Tile]time.Time) error
+}
+
+type usageEntry struct {
+	t     Tile
+	size  int64
+	atime int64
+	// index is the position in the usage heap
+	index int
+}
+
+// usageHeap orders entries by access time, the least recently used first.
+type usageHeap []*usageEntry
+
+func (h usageHeap) Len() int { return len(h) }
+
+func (h usageHeap) Less(i, j int) bool { return h[i].atime < h[j].atime }
+
+func (h usageHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *usageHeap) Push(x any) {
+	e := x.(*usageEntry)
+	e.index = len(*h)
+	*h = append(*h, e)
+}
+
+func (h *usageHeap) Pop() any {
+	old := *h
+	e := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+
+	return e
+}
+
+// diskUsage tracks sizes and access times of cached tiles.
+// Access times are kept in memory and saved to the store by the janitor, if the store can keep them.
+// All methods are no-op on nil diskUsage.
+type diskUsage struct {
+	mx      sync.Mutex
+	entries map[Tile]*usageEntry
+	lru     usageHeap
+	// touched are tiles with access times not saved yet
+	touched map[Tile]struct{}
+	size    int64
+	ready   bool
+}
+
+func newDiskUsage() *diskUsage {
+	return &diskUsage{entries: make(map[Tile]*usageEntry), touched: make(map[Tile]struct{})}
+}
+
+func (u *diskUsage) Touch(t Tile) {
+	if u == nil {
+		return
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	if e, ok := u.entries[t]; ok {
+		e.atime = time.Now().Unix()
+		heap.Fix(&u.lru, e.index)
+		u.touched[t] = struct{}{}
+	}
+}
+
+func (u *diskUsage) Add(t Tile, size int64, atime time.Time) {
+	if u == nil {
+		return
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	u.set(t, size, atime.Unix())
+}
+
+// addScanned adds the tile found by the initial scan, unless it is already known.
+func (u *diskUsage) addScanned(t Tile, size int64, atime time.Time) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	if _, ok := u.entries[t]; ok {
+		return
+	}
+
+	u.set(t, size, atime.Unix())
+}
+
+func (u *diskUsage) set(t Tile, size, atime int64) {
+	if e, ok := u.entries[t]; ok {
+		u.size += size - e.size
+		e.size, e.atime = size, atime
+		heap.Fix(&u.lru, e.index)
+
+		return
+	}
+
+	e := &usageEntry{t: t, size: size, atime: atime}
+	u.entries[t] = e
+	heap.Push(&u.lru, e)
+	u.size += size
+}
+
+func (u *diskUsage) Remove(t Tile) {
+	if u == nil {
+		return
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	e, ok := u.entries[t]
+
+	if !ok {
+		return
+	}
+
+	u.size -= e.size
+	heap.Remove(&u.lru, e.index)
+	delete(u.entries, t)
+	delete(u.touched, t)
+}
+
+func (u *diskUsage) Size() int64 {
+	if u == nil {
+		return 0
+	}
+
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	return u.size
+}
+
+func (u *diskUsage) isReady() bool {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	return u.ready
+}
+
+func (u *diskUsage) setReady() {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	u.ready = true
+}
+
+// oldest returns the least recently used tile.
+func (u *diskUsage) oldest() (usageEntry, bool) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	if len(u.lru) == 0 {
+		return usageEntry{}, false
+	}
+
+	return *u.lru[0], true
+}
+
+// takeTouched returns tiles used since the last call with their access times.
+func (u *diskUsage) takeTouched() map[Tile]time.Time {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	res := make(map[Tile]time.Time, len(u.touched))
+
+	for t := range u.touched {
+		res[t] = time.Unix(u.entries[t].atime, 0)
+	}
+
+	clear(u.touched)
+
+	return res
+}
+
+// CacheJanitor keeps proxy disk caches within the global and per-layer quotas,
+// removing least recently used tiles in background.
+type CacheJanitor struct {
+	logger  *slog.Logger
+	maxSize int64
+
+	mx      sync.Mutex
+	proxies []*Proxy
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+// NewCacheJanitor creates the janitor with global cache quota, 0 means no global limit.
+func NewCacheJanitor(maxSize int64, logger *slog.Logger) *CacheJanitor {
+	ctx, cancel := context.WithCancel(context.Background())
+
+	return &CacheJanitor{
+		logger:  logger,
+		maxSize: maxSize,
+		ctx:     ctx,
+		cancel:  cancel,
+	}
+}
+
+// Add starts tracking the proxy cache if there is the global or the layer quota,
+// existing tiles are scanned in background.
+func (j *CacheJanitor) Add(p *Proxy) {
+	if j.maxSize <= 0 && p.maxCacheSize <= 0 {
+		return
+	}
+
+	p.usage = newDiskUsage()
+
+	j.mx.Lock()
+	j.proxies = append(j.proxies, p)
+	j.mx.Unlock()
+
+	j.wg.Add(1)
+
+	go func() {
+		defer j.wg.Done()
+
+		start := time.Now()
+
+		if err := p.scanCache(j.ctx); err != nil && j.ctx.Err() == nil {
+			j.logger.Error("cache scan error", "layer", p.GetKey(), "error", err)
+		}
+
+		p.usage.setReady()
+		j.logger.Info(fmt.Sprintf("%s: cache size %s, scanned in %s", p.GetKey(),
+			humanize.IBytes(uint64(p.usage.Size())), time.Since(start).Round(time.Millisecond)))
+	}()
+}
+
+func (j *CacheJanitor) Start() {
+	j.mx.Lock()
+	n := len(j.proxies)
+	j.mx.Unlock()
+
+	if n == 0 {
+		return
+	}
+
+	j.wg.Add(1)
+
+	go func() {
+		defer j.wg.Done()
+
+		ticker := time.NewTicker(janitorInterval)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				j.Run()
+			case <-j.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// Close stops the janitor and saves access times of used tiles.
+func (j *CacheJanitor) Close() {
+	j.cancel()
+	j.wg.Wait()
+
+	for _, p := range j.tracked() {
+		p.saveAccessTimes(context.Background())
+	}
+}
+
+func (j *CacheJanitor) tracked() []*Proxy {
+	j.mx.Lock()
+	defer j.mx.Unlock()
+
+	return slices.Clone(j.proxies)
+}
+
+// Run does one eviction pass, first for layers over their own quotas, then for the global quota.
+// Access times of used tiles are saved too.
+func (j *CacheJanitor) Run() {
+	var total int64
+
+	proxies := j.tracked()
+	ready := make([]*Proxy, 0, len(proxies))
+
+	for _, p := range proxies {
+		if !p.usage.isReady() {
+			continue
+		}
+
+		ready = append(ready, p)
+		p.saveAccessTimes(j.ctx)
+
+		if p.maxCacheSize > 0 && p.usage.Size() > p.maxCacheSize {
+			j.evict([]*Proxy{p}, p.usage.Size()-int64(float64(p.maxCacheSize)*lowWatermark))
+		}
+
+		total += p.usage.Size()
+	}
+
+	if j.maxSize > 0 && total > j.maxSize {
+		j.evict(ready, total-int64(float64(j.maxSize)*lowWatermark))
+	}
+}
+
+// evict removes least recently used tiles of the proxies until excess bytes are freed.
+func (j *CacheJanitor) evict(proxies []*Proxy, excess int64) {
+	var freed int64
+	var n int
+
+	for freed < excess && j.ctx.Err() == nil {
+		var p *Proxy
+		var e usageEntry
+
+		for _, p1 := range proxies {
+			if e1, ok := p1.usage.oldest(); ok && (p == nil || e1.atime < e.atime) {
+				p, e = p1, e1
+			}
+		}
+
+		if p == nil {
+			break
+		}
+
+		// the tile is dropped from the usage even if it is not removed, so it is not tried again
+		if err := p.removeTile(e.t); err != nil {
+			j.logger.Error("evict error", "layer", p.GetKey(), "error", err)
+			continue
+		}
+
+		freed += e.size
+		n++
+	}
+
+	if n > 0 {
+		j.logger.Info(fmt.Sprintf("%d tiles evicted, %s freed", n, humanize.IBytes(uint64(freed))))
+	}
+}
+
+// CacheSize returns the size of cached tiles, 0 if the cache is not tracked.
+func (p *Proxy) CacheSize() int64 {
+	return p.usage.Size()
+}
+
+// Touch marks the cached tile as used, e.g. when it is served from memory.
+func (p *Proxy) Touch(t Tile) {
+	p.usage.Touch(t)
+}
+
+// removeTile removes the cached tile with its metadata.
+func (p *Proxy) removeTile(t Tile) error {
+	p.usage.Remove(t)
+
+	return p.store.Delete(context.Background(), t)
+}
+
+// saveAccessTimes saves access times of tiles used since the last call, if the store can keep them.
+func (p *Proxy) saveAccessTimes(ctx context.Context) {
+	s, ok := p.store.(accessTimeStore)
+
+	if !ok {
+		return
+	}
+
+	if err := s.SetAccessTimes(ctx, p.usage.takeTouched()); err != nil {
+		p.logger.Error("access time save error", "error", err)
+	}
+}
+
+// scanCache adds all tiles found in the cache store to the disk usage, with the saved access time,
+// or the fetch time if the store doesn't keep access times.
+func (p *Proxy) scanCache(ctx context.Context) error {
+	return p.store.Iterate(ctx, func(t Tile, info *TileInfo) bool {
+		atime := info.AccessTime
+
+		if atime.IsZero() {
+			atime = info.ModTime
+		}
+
+		if !info.Missing {
+			p.usage.addScanned(t, info.Size, atime)
+		}
+
+		return ctx.Err() == nil
+	})
+}
@@ -0,0 +1,215 @@
+package model
+
+import (
+	"context"
+	"log/slog"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func waitReady(t *testing.T, u *diskUsage) {
+	for range 100 {
+		if u.isReady() {
+			return
+		}
+
+		time.Sleep(time.Millisecond * 10)
+	}
+
+	t.Fatal("cache scan is not finished")
+}
+
+func TestJanitorEvict(t *testing.T) {
+	u := newUpstream(t, 0)
+	size := int64(len(pngTile))
+
+	p := mustProxy(t, &LayerDescription{
+		Key:          t.Name(),
+		MaxZoom:      19,
+		TileType:     "png",
+		Url:          u.URL + "/{z}/{x}/{y}.png",
+		MaxCacheSize: ByteSize(size * 3),
+	})
+
+	j := NewCacheJanitor(0, slog.Default())
+	j.Add(p)
+	waitReady(t, p.usage)
+
+	for i := range 5 {
+		if _, err := p.GetTile(context.Background(), 10, i, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		p.usage.Add(Tile{X: i, Y: 1, Z: 10}, size, time.Now().Add(-time.Minute*time.Duration(10-i)))
+	}
+
+	// tile 0 is the oldest one, but it is used now
+	if _, err := p.GetTile(context.Background(), 10, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if s := p.CacheSize(); s != size*5 {
+		t.Errorf("cache size: got %d, must be %d", s, size*5)
+	}
+
+	j.Run()
+
+	for i, exists := range []bool{true, false, false, false, true} {
+		_, err := p.store.Stat(context.Background(), Tile{X: i, Y: 1, Z: 10})
+
+		if exists != (err == nil) {
+			t.Errorf("tile %d: exists must be %v", i, exists)
+		}
+	}
+
+	if s := p.CacheSize(); s != size*2 {
+		t.Errorf("cache size: got %d, must be %d", s, size*2)
+	}
+
+	// the global quota with the cache scanned from disk
+	p2 := mustProxy(t, &LayerDescription{Key: t.Name() + "2", MaxZoom: 19, TileType: "png", Url: u.URL + "/{z}/{x}/{y}.png"})
+	p2.store = NewSASPlanetStore(cacheDir(p), "png", false)
+
+	j2 := NewCacheJanitor(size, slog.Default())
+	j2.Add(p2)
+	waitReady(t, p2.usage)
+
+	if s := p2.CacheSize(); s != size*2 {
+		t.Errorf("scanned cache size: got %d, must be %d", s, size*2)
+	}
+
+	j2.Run()
+
+	if s := p2.CacheSize(); s != 0 {
+		t.Errorf("cache size: got %d, must be 0", s)
+	}
+}
+
+func TestJanitorAccessTimes(t *testing.T) {
+	u := newUpstream(t, 0)
+
+	for store, name := range map[string]string{StoreMBTiles: "cache.mbtiles", StoreSASPlanet: "tiles"} {
+		t.Run(store, func(t *testing.T) {
+			testJanitorAccessTimes(t, u.URL, store, filepath.Join(t.TempDir(), name))
+		})
+	}
+
+	// caches without quotas are not tracked
+	j := NewCacheJanitor(0, slog.Default())
+	defer j.Close()
+
+	p := newTestProxy(t, u)
+	j.Add(p)
+
+	if p.usage != nil {
+		t.Error("cache without quota must not be tracked")
+	}
+}
+
+func testJanitorAccessTimes(t *testing.T, url, store, storePath string) {
+	size := int64(len(pngTile))
+
+	l := &LayerDescription{
+		Key:          t.Name(),
+		MaxZoom:      19,
+		TileType:     "png",
+		Url:          url + "/{z}/{x}/{y}.png",
+		Store:        store,
+		StorePath:    storePath,
+		MaxCacheSize: ByteSize(size * 2),
+	}
+
+	p := mustProxy(t, l)
+
+	j := NewCacheJanitor(0, slog.Default())
+	j.Add(p)
+	waitReady(t, p.usage)
+
+	for i := range 3 {
+		if _, err := p.GetTile(context.Background(), 10, i, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		// as if tiles were used hours ago by the previous run
+		atimes := map[Tile]time.Time{{X: i, Y: 1, Z: 10}: time.Now().Add(-time.Hour * time.Duration(4-i))}
+
+		if err := p.store.(accessTimeStore).SetAccessTimes(context.Background(), atimes); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// tile 0 is the oldest one, but it is used now
+	if _, err := p.GetTile(context.Background(), 10, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	j.Close()
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// the restarted janitor evicts by saved access times until the cache is under the quota
+	p2 := mustProxy(t, l)
+
+	j2 := NewCacheJanitor(0, slog.Default())
+	j2.Add(p2)
+	waitReady(t, p2.usage)
+	j2.Run()
+
+	for i, exists := range []bool{true, false, false} {
+		_, err := p2.store.Stat(context.Background(), Tile{X: i, Y: 1, Z: 10})
+
+		if exists != (err == nil) {
+			t.Errorf("tile %d: exists must be %v", i, exists)
+		}
+	}
+}
+
+func TestJanitorMemCacheHits(t *testing.T) {
+	u := newUpstream(t, 0)
+	size := int64(len(pngTile))
+
+	p := mustProxy(t, &LayerDescription{
+		Key:          t.Name(),
+		MaxZoom:      19,
+		TileType:     "png",
+		Url:          u.URL + "/{z}/{x}/{y}.png",
+		MaxCacheSize: ByteSize(size * 2),
+	})
+
+	j := NewCacheJanitor(0, slog.Default())
+	j.Add(p)
+	waitReady(t, p.usage)
+
+	// as the layer is made in tileserver
+	src := NewMemCache(NewOverzoom(p, 2), 1<<20)
+
+	for i := range 3 {
+		if _, err := src.GetTile(context.Background(), 10, i, 1); err != nil {
+			t.Fatal(err)
+		}
+
+		p.usage.Add(Tile{X: i, Y: 1, Z: 10}, size, time.Now().Add(-time.Minute*time.Duration(10-i)))
+	}
+
+	// tile 0 is the oldest one on disk, but it is used now from memory
+	if _, err := src.GetTile(context.Background(), 10, 0, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if hits, _, _ := src.Stats(); hits != 1 {
+		t.Fatalf("got %d memory cache hits, must be 1", hits)
+	}
+
+	j.Run()
+
+	for i, exists := range []bool{true, false, false} {
+		_, err := p.store.Stat(context.Background(), Tile{X: i, Y: 1, Z: 10})
+
+		if exists != (err == nil) {
+			t.Errorf("tile %d: exists must be %v", i, exists)
+		}
+	}
+}
@@ -3,17 +3,19 @@ package model
 import (
 	"context"
 	"database/sql"
+	"encoding/json"
 	"fmt"
 	"log/slog"
 	"os"
 	"strconv"
+	"sync"
 	"time"
 
 	_ "modernc.org/sqlite"
 )
 
 type Source interface {
-	GetTile(ctx context.Context, z, x, y int) (string, []byte, error)
+	GetTile(ctx context.Context, z, x, y int) (*TileData, error)
 	GetMinZoom() int
 	GetMaxZoom() int
 	GetKey() string
@@ -34,6 +36,10 @@ type Layer struct {
 	tms     bool
 	meta    map[string]string
 	modTime time.Time
+	// overviews is set if the file has the overviews table with tiles made from higher zoom tiles
+	overviews bool
+	// bounds are xyz tile bounds at each zoom, loaded when needed
+	bounds *zoomBounds
 }
 
 func NewLayer(key, path string) (*Layer, error) {
@@ -66,8 +72,6 @@ func NewLayer(key, path string) (*Layer, error) {
 		return nil, err
 	}
 
-	l.GetBorders()
-
 	if v, ok := l.meta["minzoom"]; ok {
 		if vv, err := strconv.Atoi(v); err == nil {
 			l.minZoom = vv
@@ -80,6 +84,10 @@ func NewLayer(key, path string) (*Layer, error) {
 		}
 	}
 
+	if err := l.checkOverviews(); err != nil {
+		return nil, err
+	}
+
 	if v, ok := l.meta["scheme"]; ok {
 		if v != "tms" {
 			l.tms = false
@@ -90,6 +98,8 @@ func NewLayer(key, path string) (*Layer, error) {
 		l.name = v
 	}
 
+	l.bounds = fileBounds(path, fileInfo)
+
 	return l, nil
 }
 
@@ -164,7 +174,7 @@ func (l *Layer) getMetadata() error {
 }
 
 func (l *Layer) getMinMaxZoom() (int, int, error) {
-	row, err := l.db.Query("SELECT min(zoom_level), max(zoom_level) FROM tiles")
+	row, err := l.db.Query("SELECT coalesce(min(zoom_level), 0), coalesce(max(zoom_level), 0) FROM tiles")
 	if err != nil {
 		return 0, 0, err
 	}
@@ -181,44 +191,182 @@ func (l *Layer) getMinMaxZoom() (int, int, error) {
 	return zmin, zmax, nil
 }
 
-func (l *Layer) GetBorders() {
-	m, _, err := l.getMinMaxZoom()
+// zoomBounds are tile bounds of the mbtiles file at each zoom. They are shared by layers of the same file
+// version, so they are not queried again when files are reloaded.
+type zoomBounds struct {
+	modTime time.Time
+	size    int64
 
-	if err != nil {
-		return
+	mx     sync.Mutex
+	bounds map[int]TileBounds
+	// empty are zooms without tiles
+	empty map[int]bool
+}
+
+var (
+	boundsCacheMx sync.Mutex
+	boundsCache   = make(map[string]*zoomBounds)
+)
+
+// fileBounds returns the bounds of the file, new ones if the file is changed.
+func fileBounds(path string, fi os.FileInfo) *zoomBounds {
+	boundsCacheMx.Lock()
+	defer boundsCacheMx.Unlock()
+
+	if b, ok := boundsCache[path]; ok && b.modTime.Equal(fi.ModTime()) && b.size == fi.Size() {
+		return b
 	}
 
-	row, err := l.db.Query("SELECT min(tile_row), max(tile_row), min(tile_column), max(tile_column) FROM tiles where zoom_level=?", m)
+	b := &zoomBounds{
+		modTime: fi.ModTime(),
+		size:    fi.Size(),
+		bounds:  make(map[int]TileBounds),
+		empty:   make(map[int]bool),
+	}
+
+	boundsCache[path] = b
+
+	return b
+}
+
+// parseBounds parses "minlon,minlat,maxlon,maxlat" mbtiles bounds.
+func parseBounds(s string) ([]float64, bool) {
+	b, ok := parseFloats(s, 4)
+
+	return b, ok && b[0] < b[2] && b[1] < b[3]
+}
+
+// Info returns the layer info from the metadata.
+func (l *Layer) Info() LayerInfo {
+	info := LayerInfo{
+		Attribution: l.meta["attribution"],
+		Description: l.meta["description"],
+	}
+
+	if b, ok := parseBounds(l.meta["bounds"]); ok {
+		info.Bounds = b
+	}
+
+	if c, ok := parseFloats(l.meta["center"], 3); ok {
+		info.Center = c
+	}
+
+	if v, ok := l.meta["json"]; ok {
+		var j struct {
+			VectorLayers json.RawMessage `json:"vector_layers"`
+		}
+
+		if err := json.Unmarshal([]byte(v), &j); err == nil {
+			info.VectorLayers = j.VectorLayers
+		}
+	}
+
+	return info
+}
+
+// Bounds returns xyz bounds of the layer tiles at the zoom, they are taken from the tiles, not from
+// the bounds metadata.
+func (l *Layer) Bounds(z int) (TileBounds, bool, error) {
+	if z < l.minZoom || z > l.maxZoom {
+		return TileBounds{}, false, nil
+	}
+
+	l.bounds.mx.Lock()
+	defer l.bounds.mx.Unlock()
+
+	if b, ok := l.bounds.bounds[z]; ok {
+		return b, true, nil
+	}
+
+	if l.bounds.empty[z] {
+		return TileBounds{}, false, nil
+	}
+
+	b, ok, err := l.queryBounds(z)
 
 	if err != nil {
-		return
+		// the layer may have tiles anywhere, bounds are queried again next time
+		slog.Error("bounds query error", "layer", l.key, "zoom", z, "error", err)
+
+		return worldBounds(z), true, err
 	}
 
-	var ymin, ymax, xmin, xmax int
+	if !ok {
+		l.bounds.empty[z] = true
 
-	if l.tms {
-		ymin = 1<<m - ymin - 1
-		ymax = 1<<m - ymax - 1
+		return TileBounds{}, false, nil
 	}
 
-	defer row.Close() //nolint:errcheck
-	if row.Next() {
-		if err = row.Scan(&ymin, &ymax, &xmin, &xmax); err != nil {
-			return
+	l.bounds.bounds[z] = b
+	slog.Debug(fmt.Sprintf("%s: zoom %d, %d,%d - %d,%d", l.name, z, b.XMin, b.YMin, b.XMax, b.YMax))
+
+	return b, true, nil
+}
+
+func (l *Layer) queryBounds(z int) (TileBounds, bool, error) {
+	q := "SELECT min(tile_column), min(tile_row), max(tile_column), max(tile_row) FROM tiles WHERE zoom_level=?1"
+
+	if l.overviews {
+		q += " UNION ALL SELECT min(tile_column), min(tile_row), max(tile_column), max(tile_row) FROM overviews WHERE zoom_level=?1"
+	}
+
+	rows, err := l.db.Query(q, z)
+
+	if err != nil {
+		return TileBounds{}, false, err
+	}
+
+	defer rows.Close() //nolint:errcheck
+
+	var res TileBounds
+	var found bool
+
+	for rows.Next() {
+		var xmin, ymin, xmax, ymax sql.NullInt64
+
+		if err := rows.Scan(&xmin, &ymin, &xmax, &ymax); err != nil {
+			return TileBounds{}, false, err
+		}
+
+		// no tiles in the table
+		if !xmin.Valid {
+			continue
+		}
+
+		b := TileBounds{XMin: int(xmin.Int64), YMin: int(ymin.Int64), XMax: int(xmax.Int64), YMax: int(ymax.Int64)}
+
+		if l.tms {
+			b.YMin, b.YMax = 1<<z-b.YMax-1, 1<<z-b.YMin-1
+		}
+
+		if found {
+			res = res.union(b)
+		} else {
+			res, found = b, true
 		}
 	}
 
-	slog.Info(fmt.Sprintf("%s: zoom %d, %d,%d - %d,%d", l.name, m, xmin, ymin, xmax, ymax))
+	return res, found, rows.Err()
 }
 
-func (l *Layer) GetTile(_ context.Context, zoom, x, y int) (string, []byte, error) {
+func (l *Layer) GetTile(_ context.Context, zoom, x, y int) (*TileData, error) {
+	if zoom < l.minZoom || zoom > l.maxZoom {
+		return nil, ErrOutOfRange
+	}
+
 	if l.tms {
 		y = 1<<zoom - y - 1
 	}
 
-	row, err := l.db.Query("SELECT tile_data FROM tiles WHERE zoom_level=? and tile_column=? and tile_row=?", zoom, x, y)
+	q := "SELECT tile_data FROM tiles WHERE zoom_level=?1 and tile_column=?2 and tile_row=?3"
+
+	if l.overviews {
+		q += " UNION ALL SELECT tile_data FROM overviews WHERE zoom_level=?1 and tile_column=?2 and tile_row=?3 LIMIT 1"
+	}
+
+	row, err := l.db.Query(q, zoom, x, y)
 	if err != nil {
-		return "", nil, err
+		return nil, internalError(err)
 	}
 
 	defer row.Close() //nolint:errcheck
@@ -226,11 +374,104 @@ func (l *Layer) GetTile(_ context.Context, zoom, x, y int) (string, []byte, erro
 	if row.Next() {
 		var data []byte
 		if err = row.Scan(&data); err != nil {
-			return "", nil, err
+			return nil, internalError(err)
+		}
+
+		return NewTileData(l.GetContentType(), data, l.modTime), nil
+	}
+
+	if err := row.Err(); err != nil {
+		return nil, internalError(err)
+	}
+
+	return nil, ErrNotFound
+}
+
+const overviewsSchema = "CREATE TABLE IF NOT EXISTS overviews (zoom_level INTEGER NOT NULL, tile_column INTEGER NOT NULL, tile_row INTEGER NOT NULL, tile_data BLOB NOT NULL, UNIQUE (zoom_level, tile_column, tile_row))"
+
+// checkOverviews looks for the overviews table and extends the min zoom to its tiles.
+func (l *Layer) checkOverviews() error {
+	var n int
+
+	if err := l.db.QueryRow("SELECT count(*) FROM sqlite_master WHERE type='table' AND name='overviews'").Scan(&n); err != nil {
+		return err
+	}
+
+	if n == 0 {
+		return nil
+	}
+
+	l.overviews = true
+
+	var z sql.NullInt64
+
+	if err := l.db.QueryRow("SELECT min(zoom_level) FROM overviews").Scan(&z); err != nil {
+		return err
+	}
+
+	if z.Valid {
+		l.minZoom = min(l.minZoom, int(z.Int64))
+	}
+
+	return nil
+}
+
+// hasTiles checks if there are tiles at the zoom in xyz range.
+func (l *Layer) hasTiles(ctx context.Context, z, xmin, ymin, xmax, ymax int) (bool, error) {
+	if b, ok, _ := l.Bounds(z); !ok || !b.intersects(TileBounds{XMin: xmin, YMin: ymin, XMax: xmax, YMax: ymax}) {
+		return false, nil
+	}
+
+	if l.tms {
+		ymin, ymax = 1<<z-ymax-1, 1<<z-ymin-1
+	}
+
+	q := "SELECT 1 FROM tiles WHERE zoom_level=?1 AND tile_column BETWEEN ?2 AND ?3 AND tile_row BETWEEN ?4 AND ?5"
+
+	if l.overviews {
+		q += " UNION ALL SELECT 1 FROM overviews WHERE zoom_level=?1 AND tile_column BETWEEN ?2 AND ?3 AND tile_row BETWEEN ?4 AND ?5"
+	}
+
+	row, err := l.db.QueryContext(ctx, q+" LIMIT 1", z, xmin, xmax, ymin, ymax)
+
+	if err != nil {
+		return false, err
+	}
+
+	defer row.Close() //nolint:errcheck
+
+	return row.Next(), row.Err()
+}
+
+// PutOverview saves the tile made from higher zoom tiles to the overviews table. The min zoom is extended to it
+// only when the file is opened again, so the zoom level being built is still made by downsampling and the tile
+// is not served before. BuildOverviews opens the file again for each level.
+func (l *Layer) PutOverview(ctx context.Context, z, x, y int, data []byte) error {
+	if l.tms {
+		y = 1<<z - y - 1
+	}
+
+	if !l.overviews {
+		if _, err := l.db.ExecContext(ctx, overviewsSchema); err != nil {
+			return err
 		}
 
-		return l.GetContentType(), data, nil
+		l.overviews = true
 	}
 
-	return "", nil, nil
+	if _, err := l.db.ExecContext(ctx, "INSERT OR REPLACE INTO overviews (zoom_level, tile_column, tile_row, tile_data) VALUES (?,?,?,?)", z, x, y, data); err != nil {
+		return err
+	}
+
+	l.bounds.mx.Lock()
+	delete(l.bounds.bounds, z)
+	delete(l.bounds.empty, z)
+	l.bounds.mx.Unlock()
+
+	return nil
+}
+
+// Close closes the mbtiles file.
+func (l *Layer) Close() error {
+	return l.db.Close()
 }
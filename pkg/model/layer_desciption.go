@@ -1,13 +1,23 @@
 package model
 
 import (
+	"fmt"
 	"log/slog"
 	"path/filepath"
 	"strings"
 	"time"
 )
 
+// Layer types in layers.yml.
+const (
+	LayerProxy     = "proxy"
+	LayerComposite = "composite"
+	LayerMulti     = "multi"
+)
+
 type LayerDescription struct {
+	// Type is proxy (default), composite or multi.
+	Type            string        `yaml:"type"`
 	Name            string        `yaml:"name"`
 	Key             string        `yaml:"key"`
 	MinZoom         int           `yaml:"minZoom"`
@@ -18,26 +28,204 @@ type LayerDescription struct {
 	ServerParts     []string      `yaml:"serverParts"`
 	Timeout         time.Duration `yaml:"timeout"`
 	KeepProbability float32       `yaml:"keepProbability"`
+	// StaleWhileRevalidate makes expired tiles served at once and refreshed in background.
+	StaleWhileRevalidate bool `yaml:"staleWhileRevalidate"`
+	// NotFoundTimeout is how long upstream 404 and empty tiles are remembered, 0 disables it.
+	NotFoundTimeout time.Duration `yaml:"notFoundTimeout"`
+	// Rps and MaxConns limit upstream requests rate and concurrency, layers of the same upstream host
+	// share the strictest limits.
+	Rps      float64 `yaml:"rps"`
+	MaxConns int     `yaml:"maxConns"`
+	// Retries is the number of retries with exponential backoff starting from RetryDelay.
+	Retries    int           `yaml:"retries"`
+	RetryDelay time.Duration `yaml:"retryDelay"`
+	// BreakerThreshold is the number of consecutive upstream failures to switch the layer offline for
+	// BreakerCooldown, 0 disables the circuit breaker.
+	BreakerThreshold int           `yaml:"breakerThreshold"`
+	BreakerCooldown  time.Duration `yaml:"breakerCooldown"`
+	// Headers are added to upstream requests, values may refer environment variables as ${NAME}.
+	Headers map[string]string `yaml:"headers"`
+	// QueryEnv maps query parameter names to environment variables holding their values, e.g. api keys.
+	QueryEnv map[string]string `yaml:"queryEnv"`
+	// Proxy is http, https or socks5 proxy url for upstream requests.
+	Proxy              string `yaml:"proxy"`
+	CaFile             string `yaml:"caFile"`
+	InsecureSkipVerify bool   `yaml:"insecureSkipVerify"`
+	// MinSize and MaxSize are allowed upstream tile sizes in bytes, 0 means no limit.
+	MinSize int `yaml:"minSize"`
+	MaxSize int `yaml:"maxSize"`
+	// NoDataHashes are sha256 hashes of upstream "no data" tiles, they are not found tiles.
+	NoDataHashes []string `yaml:"noDataHashes"`
+	// MaxCacheSize is the layer disk cache quota, e.g. "10GB".
+	MaxCacheSize ByteSize `yaml:"maxCacheSize"`
+	// MemCacheSize is the size of in-memory cache of hot tiles, e.g. "64MB".
+	MemCacheSize ByteSize `yaml:"memCacheSize"`
+	// Store is the cache store: sasplanet (default), flat, mbtiles or s3.
+	Store string `yaml:"store"`
+	// StorePath overrides the cache directory, or the file for mbtiles store.
+	StorePath string `yaml:"storePath"`
+	// S3 is the object storage config for s3 store.
+	S3 *S3Config `yaml:"s3"`
+	// Overzoom is the number of zoom levels above MaxZoom made by upscaling parent tiles.
+	Overzoom int `yaml:"overzoom"`
+	// Attribution, Description, Bounds (minlon, minlat, maxlon, maxlat) and Center (lon, lat, zoom) are
+	// shown to clients in TileJSON.
+	Attribution string    `yaml:"attribution"`
+	Description string    `yaml:"description"`
+	Bounds      []float64 `yaml:"bounds"`
+	Center      []float64 `yaml:"center"`
+	// Layers are the source layers of the composite, bottom to top, or of the multilayer in lookup order.
+	Layers []*LayerRef `yaml:"layers"`
+}
+
+// Info returns the layer info set in the description.
+func (l *LayerDescription) Info() LayerInfo {
+	return LayerInfo{
+		Attribution: l.Attribution,
+		Description: l.Description,
+		Bounds:      l.Bounds,
+		Center:      l.Center,
+	}
+}
+
+// LayerRef refers to a source layer by key.
+type LayerRef struct {
+	// Key is the layer key, for multilayers it may be a glob like "*.mbtiles".
+	Key string `yaml:"key"`
+	// MinZoom and MaxZoom limit the layer zoom range, 0 means no limit.
+	MinZoom int `yaml:"minZoom"`
+	MaxZoom int `yaml:"maxZoom"`
+	// Opacity is from 0 to 1, 0 means 1.
+	Opacity float64 `yaml:"opacity"`
+	// Blend is the blend mode: normal (default), multiply, screen, overlay, darken or lighten.
+	Blend string `yaml:"blend"`
+	// Optional composite layer is left out when it fails, e.g. when the proxy is offline.
+	Optional bool `yaml:"optional"`
 }
 
-func NewProxy(l *LayerDescription, logger *slog.Logger, path string) *Proxy {
+// zoomRange returns the zoom range of the source limited by the ref.
+func (r *LayerRef) zoomRange(s Source) (int, int) {
+	minZoom, maxZoom := max(s.GetMinZoom(), r.MinZoom), s.GetMaxZoom()
+
+	if r.MaxZoom > 0 {
+		maxZoom = min(maxZoom, r.MaxZoom)
+	}
+
+	return minZoom, maxZoom
+}
+
+// Limit returns the source limited to the ref zoom range.
+func (r *LayerRef) Limit(s Source) Source {
+	if r.MinZoom == 0 && r.MaxZoom == 0 {
+		return s
+	}
+
+	minZoom, maxZoom := r.zoomRange(s)
+
+	return NewZoomRange(s, minZoom, maxZoom)
+}
+
+func NewProxy(l *LayerDescription, logger *slog.Logger, path string) (*Proxy, error) {
 	p := &Proxy{
-		logger:          logger,
-		minZoom:         l.MinZoom,
-		maxZoom:         l.MaxZoom,
-		keepProbability: l.KeepProbability,
-		key:             l.Key,
-		name:            l.Name,
-		tms:             l.Tms,
-		path:            filepath.Join(path, "tiles", l.Key),
-		url:             l.Url,
-		ext:             strings.ToLower(l.TileType),
-		serverParts:     l.ServerParts,
-		timeout:         l.Timeout,
-		httpTimeout:     time.Second * 10,
-	}
-
-	p.Init()
-
-	return p
+		logger:               logger,
+		minZoom:              l.MinZoom,
+		maxZoom:              l.MaxZoom,
+		keepProbability:      l.KeepProbability,
+		staleWhileRevalidate: l.StaleWhileRevalidate,
+		notFoundTimeout:      l.NotFoundTimeout,
+		rps:                  l.Rps,
+		maxConns:             l.MaxConns,
+		retries:              l.Retries,
+		retryDelay:           l.RetryDelay,
+		key:                  l.Key,
+		name:                 l.Name,
+		tms:                  l.Tms,
+		url:                  l.Url,
+		ext:                  strings.ToLower(l.TileType),
+		serverParts:          l.ServerParts,
+		timeout:              l.Timeout,
+		httpTimeout:          time.Second * 10,
+		headerTemplates:      l.Headers,
+		queryEnv:             l.QueryEnv,
+		proxyUrl:             l.Proxy,
+		caFile:               l.CaFile,
+		insecureSkipVerify:   l.InsecureSkipVerify,
+		minSize:              l.MinSize,
+		maxSize:              l.MaxSize,
+		maxCacheSize:         int64(l.MaxCacheSize),
+		info:                 l.Info(),
+	}
+
+	for _, h := range l.NoDataHashes {
+		p.noDataHashes = append(p.noDataHashes, strings.ToLower(h))
+	}
+
+	cooldown := l.BreakerCooldown
+
+	if cooldown == 0 {
+		cooldown = time.Minute
+	}
+
+	p.breaker = newBreaker(l.BreakerThreshold, cooldown)
+
+	store, err := newStore(l, path)
+
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", l.Key, err)
+	}
+
+	p.store = store
+
+	if err := p.Init(); err != nil {
+		_ = store.Close()
+
+		return nil, err
+	}
+
+	return p, nil
+}
+
+// IsProxy checks if the layer is an upstream proxy, not a composite or a multilayer.
+func (l *LayerDescription) IsProxy() bool {
+	t := strings.ToLower(l.Type)
+
+	return t == "" || t == LayerProxy
+}
+
+// HasRetina checks if the upstream url has {r} or {scale} placeholder for high-DPI tiles.
+func (l *LayerDescription) HasRetina() bool {
+	return strings.Contains(l.Url, "{r}") || strings.Contains(l.Url, "{scale}")
+}
+
+// Retina returns the description of the layer 2x variant with its own key and cache.
+func (l *LayerDescription) Retina() *LayerDescription {
+	r := *l
+	r.Key = l.Key + RetinaSuffix
+	r.Name = l.Name + " " + RetinaSuffix
+	r.Url = strings.NewReplacer("{r}", RetinaSuffix, "{scale}", "2").Replace(l.Url)
+
+	if r.StorePath != "" {
+		r.StorePath = retinaPath(l.StorePath, strings.EqualFold(l.Store, StoreMBTiles))
+	}
+
+	if r.S3 != nil && r.S3.Prefix != "" {
+		s3 := *r.S3
+		s3.Prefix = strings.TrimSuffix(s3.Prefix, "/") + RetinaSuffix
+		r.S3 = &s3
+	}
+
+	return &r
+}
+
+// retinaPath adds the suffix to the directory name, or to the file name before the extension.
+func retinaPath(name string, file bool) string {
+	name = filepath.Clean(name)
+
+	if !file {
+		return name + RetinaSuffix
+	}
+
+	ext := filepath.Ext(name)
+
+	return strings.TrimSuffix(name, ext) + RetinaSuffix + ext
 }
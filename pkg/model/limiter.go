@@ -0,0 +1,211 @@
+package model
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const maxRetryWait = time.Second * 30
+
+// errBackoff is ErrOffline, so the tile is answered with 503 until the time upstream asked to wait.
+var errBackoff = fmt.Errorf("%w: upstream asked to retry later", ErrOffline)
+
+var (
+	limitersMx sync.Mutex
+	limiters   = make(map[string]*limiter)
+)
+
+type limits struct {
+	rps      float64
+	maxConns int
+}
+
+// limiter caps request rate and number of concurrent requests to an upstream host.
+type limiter struct {
+	mx sync.Mutex
+	// layers are limits of all layers using the host, the strictest ones are applied
+	layers       map[string]limits
+	sem          chan struct{}
+	interval     time.Duration
+	next         time.Time
+	blockedUntil time.Time
+}
+
+// getLimiter returns the limiter of the upstream host, so all layers of the host and their 2x variants
+// share the limits. Limiters are kept in the process, other processes using the host are not counted.
+// Limits of the layer are replaced if it is made again.
+func getLimiter(host, layer string, rps float64, maxConns int) *limiter {
+	limitersMx.Lock()
+	l, ok := limiters[host]
+
+	if !ok {
+		l = &limiter{layers: make(map[string]limits)}
+		limiters[host] = l
+	}
+	limitersMx.Unlock()
+
+	l.set(strings.TrimSuffix(layer, RetinaSuffix), limits{rps: rps, maxConns: maxConns})
+
+	return l
+}
+
+func (l *limiter) set(layer string, lim limits) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	l.layers[layer] = lim
+
+	var res limits
+
+	for _, v := range l.layers {
+		if v.rps > 0 && (res.rps == 0 || v.rps < res.rps) {
+			res.rps = v.rps
+		}
+
+		if v.maxConns > 0 && (res.maxConns == 0 || v.maxConns < res.maxConns) {
+			res.maxConns = v.maxConns
+		}
+	}
+
+	l.interval = 0
+
+	if res.rps > 0 {
+		l.interval = time.Duration(float64(time.Second) / res.rps)
+	}
+
+	// requests running with the old semaphore release it
+	if res.maxConns != cap(l.sem) {
+		l.sem = nil
+
+		if res.maxConns > 0 {
+			l.sem = make(chan struct{}, res.maxConns)
+		}
+	}
+}
+
+// Acquire waits for a free connection slot and for the next allowed request time.
+// The returned release func must be called after a successful Acquire.
+func (l *limiter) Acquire(ctx context.Context) (func(), error) {
+	l.mx.Lock()
+	blocked := time.Now().Before(l.blockedUntil)
+	sem := l.sem
+	l.mx.Unlock()
+
+	if blocked {
+		return nil, errBackoff
+	}
+
+	release := func() {}
+
+	if sem != nil {
+		select {
+		case sem <- struct{}{}:
+			release = func() { <-sem }
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+
+	l.mx.Lock()
+
+	if l.interval == 0 {
+		l.mx.Unlock()
+		return release, nil
+	}
+
+	now := time.Now()
+	t := l.next
+
+	if t.Before(now) {
+		t = now
+	}
+
+	l.next = t.Add(l.interval)
+	l.mx.Unlock()
+
+	if err := sleep(ctx, t.Sub(now)); err != nil {
+		release()
+		return nil, err
+	}
+
+	return release, nil
+}
+
+// BlockUntil makes all requests fail until t, used to honor upstream Retry-After.
+func (l *limiter) BlockUntil(t time.Time) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+
+	if t.After(l.blockedUntil) {
+		l.blockedUntil = t
+	}
+}
+
+// upstreamHost returns the host of the url template, e.g. {s}.tile.example.com:8080.
+func upstreamHost(u string) string {
+	if _, rest, ok := strings.Cut(u, "://"); ok {
+		u = rest
+	}
+
+	host, _, _ := strings.Cut(u, "/")
+
+	return strings.ToLower(host)
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+
+	t := time.NewTimer(d)
+	defer t.Stop()
+
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// backoff returns exponential delay with jitter for the retry attempt.
+func backoff(base time.Duration, attempt int) time.Duration {
+	d := min(base<<attempt, maxRetryWait)
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// retryAfter parses Retry-After header value given as seconds or http date.
+func retryAfter(h http.Header) (time.Duration, bool) {
+	v := h.Get("Retry-After")
+
+	if v == "" {
+		return 0, false
+	}
+
+	if s, err := strconv.Atoi(v); err == nil {
+		return time.Duration(s) * time.Second, true
+	}
+
+	if t, err := http.ParseTime(v); err == nil {
+		return time.Until(t), true
+	}
+
+	return 0, false
+}
+
+func isRetryable(status int) bool {
+	switch status {
+	case http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway,
+		http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,320 @@
+package model
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"os"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+var _ TileStore = &MBTilesStore{}
+
+// MBTilesInfo is written to the metadata table of the new mbtiles file.
+type MBTilesInfo struct {
+	Name    string
+	Format  string
+	MinZoom int
+	MaxZoom int
+}
+
+// MBTilesStore keeps tiles in the mbtiles file, so the cache can be served by tileserver as a file layer.
+// Fetch times, upstream metadata and "tile not exists" markers are kept in the extra tile_info table.
+// Tiles without the fetch time, as in the pre-seeded file, are as fresh as the file.
+type MBTilesStore struct {
+	db *sql.DB
+	// seeded is the file mtime before it is opened, unix seconds
+	seeded int64
+}
+
+const mbtilesSchema = `
+CREATE TABLE IF NOT EXISTS tiles (zoom_level INTEGER NOT NULL, tile_column INTEGER NOT NULL, tile_row INTEGER NOT NULL, tile_data BLOB NOT NULL, UNIQUE (zoom_level, tile_column, tile_row));
+CREATE TABLE IF NOT EXISTS metadata (name TEXT, value TEXT);
+CREATE TABLE IF NOT EXISTS tile_info (zoom_level INTEGER NOT NULL, tile_column INTEGER NOT NULL, tile_row INTEGER NOT NULL, fetched INTEGER NOT NULL, etag TEXT NOT NULL DEFAULT '', last_modified TEXT NOT NULL DEFAULT '', missing INTEGER NOT NULL DEFAULT 0, accessed INTEGER NOT NULL DEFAULT 0, UNIQUE (zoom_level, tile_column, tile_row));
+`
+
+// NewMBTilesStore opens or creates the mbtiles file, the metadata is written only to the new file.
+func NewMBTilesStore(name string, info MBTilesInfo) (*MBTilesStore, error) {
+	if err := os.MkdirAll(filepath.Dir(name), 0755); err != nil {
+		return nil, err
+	}
+
+	seeded := time.Now().Unix()
+
+	if st, err := os.Stat(name); err == nil {
+		seeded = st.ModTime().Unix()
+	}
+
+	db, err := sql.Open("sqlite", "file:"+name+"?_pragma=busy_timeout(10000)&_pragma=journal_mode(WAL)&_pragma=auto_vacuum(FULL)")
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := db.Exec(mbtilesSchema); err != nil {
+		_ = db.Close()
+
+		return nil, err
+	}
+
+	var n int
+
+	if err := db.QueryRow("SELECT count(*) FROM metadata").Scan(&n); err != nil {
+		_ = db.Close()
+
+		return nil, err
+	}
+
+	if n == 0 {
+		meta := map[string]string{
+			"name":    info.Name,
+			"format":  info.Format,
+			"minzoom": strconv.Itoa(info.MinZoom),
+			"maxzoom": strconv.Itoa(info.MaxZoom),
+			"scheme":  "tms",
+			"type":    "baselayer",
+		}
+
+		for k, v := range meta {
+			if _, err := db.Exec("INSERT INTO metadata (name, value) VALUES (?,?)", k, v); err != nil {
+				_ = db.Close()
+
+				return nil, err
+			}
+		}
+	}
+
+	return &MBTilesStore{db: db, seeded: seeded}, nil
+}
+
+func (s *MBTilesStore) Get(ctx context.Context, t Tile) ([]byte, *TileInfo, error) {
+	t = flipY(t)
+
+	var data []byte
+
+	info := new(TileInfo)
+
+	err := s.db.QueryRowContext(ctx, `SELECT t.tile_data, coalesce(nullif(i.fetched, 0), ?), coalesce(i.etag, ''), coalesce(i.last_modified, '')
+		FROM tiles t LEFT JOIN tile_info i USING (zoom_level, tile_column, tile_row)
+		WHERE t.zoom_level=? AND t.tile_column=? AND t.tile_row=?`, s.seeded, t.Z, t.X, t.Y).
+		Scan(&data, scanUnix(&info.ModTime), &info.Meta.ETag, &info.Meta.LastModified)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		info, err = s.statMissing(ctx, t)
+
+		return nil, info, err
+	}
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info.Size = int64(len(data))
+
+	return data, info, nil
+}
+
+func (s *MBTilesStore) Stat(ctx context.Context, t Tile) (*TileInfo, error) {
+	t = flipY(t)
+
+	info := new(TileInfo)
+
+	err := s.db.QueryRowContext(ctx, `SELECT length(t.tile_data), coalesce(nullif(i.fetched, 0), ?), coalesce(i.etag, ''), coalesce(i.last_modified, '')
+		FROM tiles t LEFT JOIN tile_info i USING (zoom_level, tile_column, tile_row)
+		WHERE t.zoom_level=? AND t.tile_column=? AND t.tile_row=?`, s.seeded, t.Z, t.X, t.Y).
+		Scan(&info.Size, scanUnix(&info.ModTime), &info.Meta.ETag, &info.Meta.LastModified)
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return s.statMissing(ctx, t)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+// statMissing returns the "tile not exists" marker of the tile with TMS y.
+func (s *MBTilesStore) statMissing(ctx context.Context, t Tile) (*TileInfo, error) {
+	info := &TileInfo{Missing: true}
+
+	err := s.db.QueryRowContext(ctx, "SELECT fetched FROM tile_info WHERE zoom_level=? AND tile_column=? AND tile_row=? AND missing=1",
+		t.Z, t.X, t.Y).Scan(scanUnix(&info.ModTime))
+
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, ErrNotFound
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return info, nil
+}
+
+func (s *MBTilesStore) Put(ctx context.Context, t Tile, data []byte, meta TileMeta) error {
+	t = flipY(t)
+
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "INSERT OR REPLACE INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (?,?,?,?)",
+			t.Z, t.X, t.Y, data); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO tile_info (zoom_level, tile_column, tile_row, fetched, etag, last_modified, missing)
+			VALUES (?,?,?,?,?,?,0)`, t.Z, t.X, t.Y, time.Now().Unix(), meta.ETag, meta.LastModified)
+
+		return err
+	})
+}
+
+func (s *MBTilesStore) PutMissing(ctx context.Context, t Tile) error {
+	t = flipY(t)
+
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?", t.Z, t.X, t.Y); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, `INSERT OR REPLACE INTO tile_info (zoom_level, tile_column, tile_row, fetched, missing)
+			VALUES (?,?,?,?,1)`, t.Z, t.X, t.Y, time.Now().Unix())
+
+		return err
+	})
+}
+
+func (s *MBTilesStore) Touch(ctx context.Context, t Tile) error {
+	t = flipY(t)
+
+	res, err := s.db.ExecContext(ctx, `INSERT INTO tile_info (zoom_level, tile_column, tile_row, fetched)
+		SELECT zoom_level, tile_column, tile_row, ? FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?
+		ON CONFLICT (zoom_level, tile_column, tile_row) DO UPDATE SET fetched=excluded.fetched`,
+		time.Now().Unix(), t.Z, t.X, t.Y)
+
+	if err != nil {
+		return err
+	}
+
+	if n, err := res.RowsAffected(); err == nil && n == 0 {
+		return ErrNotFound
+	}
+
+	return nil
+}
+
+// SetAccessTimes saves access times to tile_info, tiles without info get zero fetch time, the unknown one.
+func (s *MBTilesStore) SetAccessTimes(ctx context.Context, times map[Tile]time.Time) error {
+	if len(times) == 0 {
+		return nil
+	}
+
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		for t, atime := range times {
+			t = flipY(t)
+
+			if _, err := tx.ExecContext(ctx, `INSERT INTO tile_info (zoom_level, tile_column, tile_row, fetched, accessed)
+				SELECT zoom_level, tile_column, tile_row, 0, ? FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?
+				ON CONFLICT (zoom_level, tile_column, tile_row) DO UPDATE SET accessed=excluded.accessed`,
+				atime.Unix(), t.Z, t.X, t.Y); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (s *MBTilesStore) Delete(ctx context.Context, t Tile) error {
+	t = flipY(t)
+
+	return s.tx(ctx, func(tx *sql.Tx) error {
+		if _, err := tx.ExecContext(ctx, "DELETE FROM tiles WHERE zoom_level=? AND tile_column=? AND tile_row=?", t.Z, t.X, t.Y); err != nil {
+			return err
+		}
+
+		_, err := tx.ExecContext(ctx, "DELETE FROM tile_info WHERE zoom_level=? AND tile_column=? AND tile_row=?", t.Z, t.X, t.Y)
+
+		return err
+	})
+}
+
+func (s *MBTilesStore) Iterate(ctx context.Context, fn func(t Tile, info *TileInfo) bool) error {
+	rows, err := s.db.QueryContext(ctx, `SELECT t.zoom_level, t.tile_column, t.tile_row, length(t.tile_data), coalesce(nullif(i.fetched, 0), ?), coalesce(i.accessed, 0), 0
+		FROM tiles t LEFT JOIN tile_info i USING (zoom_level, tile_column, tile_row)
+		UNION ALL
+		SELECT zoom_level, tile_column, tile_row, 0, fetched, accessed, 1 FROM tile_info WHERE missing=1`, s.seeded)
+
+	if err != nil {
+		return err
+	}
+
+	defer rows.Close()
+
+	for rows.Next() {
+		var t Tile
+
+		info := new(TileInfo)
+
+		if err := rows.Scan(&t.Z, &t.X, &t.Y, &info.Size, scanUnix(&info.ModTime), scanUnix(&info.AccessTime), &info.Missing); err != nil {
+			return err
+		}
+
+		if !fn(flipY(t), info) {
+			return nil
+		}
+	}
+
+	if err := rows.Err(); err != nil && ctx.Err() == nil {
+		return err
+	}
+
+	return nil
+}
+
+func (s *MBTilesStore) Close() error {
+	return s.db.Close()
+}
+
+func (s *MBTilesStore) tx(ctx context.Context, f func(tx *sql.Tx) error) error {
+	tx, err := s.db.BeginTx(ctx, nil)
+
+	if err != nil {
+		return err
+	}
+
+	if err := f(tx); err != nil {
+		_ = tx.Rollback()
+
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// unixTime scans unix seconds into time.Time, 0 is the zero time.
+type unixTime struct {
+	t *time.Time
+}
+
+func scanUnix(t *time.Time) *unixTime {
+	return &unixTime{t: t}
+}
+
+func (u *unixTime) Scan(src any) error {
+	var n sql.NullInt64
+
+	if err := n.Scan(src); err != nil {
+		return err
+	}
+
+	if n.Int64 == 0 {
+		*u.t = time.Time{}
+	} else {
+		*u.t = time.Unix(n.Int64, 0)
+	}
+
+	return nil
+}
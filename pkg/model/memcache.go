@@ -0,0 +1,192 @@
+package model
+
+import (
+	"container/list"
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var _ Source = &MemCache{}
+
+// MemCache is an in-memory LRU tile cache in front of any source, limited by the total size of tile data.
+type MemCache struct {
+	Source
+	*lruCache[Tile]
+
+	hits   atomic.Int64
+	misses atomic.Int64
+}
+
+func NewMemCache(src Source, maxSize int64) *MemCache {
+	return &MemCache{
+		Source:   src,
+		lruCache: newLRUCache[Tile](maxSize),
+	}
+}
+
+func (m *MemCache) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	t := Tile{X: x, Y: y, Z: z}
+
+	if td := m.get(t); td != nil {
+		m.hits.Add(1)
+		touch(m.Source, t)
+
+		return td, nil
+	}
+
+	m.misses.Add(1)
+
+	td, err := m.Source.GetTile(ctx, z, x, y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	m.put(t, td)
+
+	return td, nil
+}
+
+// Touch passes the tile use to the source.
+func (m *MemCache) Touch(t Tile) {
+	touch(m.Source, t)
+}
+
+// toucher is a source that tracks tile use, e.g. the proxy evicting least recently used tiles from disk.
+// Tiles served from memory are not requested from the source, so their use is passed with Touch.
+type toucher interface {
+	Touch(t Tile)
+}
+
+func touch(s Source, t Tile) {
+	if tc, ok := s.(toucher); ok {
+		tc.Touch(t)
+	}
+}
+
+// lruCache is a LRU cache of tiles limited by the total size of tile data.
+type lruCache[K comparable] struct {
+	maxSize int64
+
+	mx    sync.Mutex
+	ll    *list.List
+	items map[K]*list.Element
+	size  int64
+}
+
+type lruItem[K comparable] struct {
+	key  K
+	data *TileData
+}
+
+func newLRUCache[K comparable](maxSize int64) *lruCache[K] {
+	return &lruCache[K]{
+		maxSize: maxSize,
+		ll:      list.New(),
+		items:   make(map[K]*list.Element),
+	}
+}
+
+func (c *lruCache[K]) get(k K) *TileData {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	e, ok := c.items[k]
+
+	if !ok {
+		return nil
+	}
+
+	item := e.Value.(*lruItem[K])
+
+	// expired tiles are left to the source to decide
+	if !item.data.Expires.IsZero() && item.data.Expires.Before(time.Now()) {
+		c.removeElement(e)
+		return nil
+	}
+
+	c.ll.MoveToFront(e)
+
+	return item.data
+}
+
+func (c *lruCache[K]) put(k K, td *TileData) {
+	size := int64(len(td.Data))
+
+	if size > c.maxSize {
+		return
+	}
+
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	if e, ok := c.items[k]; ok {
+		c.removeElement(e)
+	}
+
+	c.items[k] = c.ll.PushFront(&lruItem[K]{key: k, data: td})
+	c.size += size
+
+	for c.size > c.maxSize {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *lruCache[K]) removeElement(e *list.Element) {
+	item := c.ll.Remove(e).(*lruItem[K])
+	delete(c.items, item.key)
+	c.size -= int64(len(item.data.Data))
+}
+
+// Invalidate drops all cached tiles.
+func (c *lruCache[K]) Invalidate() {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+
+	c.ll.Init()
+	clear(c.items)
+	c.size = 0
+}
+
+// Stats returns cache hits and misses counters and the size of cached data.
+func (m *MemCache) Stats() (int64, int64, int64) {
+	m.mx.Lock()
+	size := m.size
+	m.mx.Unlock()
+
+	return m.hits.Load(), m.misses.Load(), size
+}
+
+func (m *MemCache) Bounds(z int) (TileBounds, bool, error) {
+	return sourceBounds(m.Source, z)
+}
+
+func (m *MemCache) Unwrap() Source {
+	return m.Source
+}
+
+func (m *MemCache) Close() error {
+	m.Invalidate()
+
+	if c, ok := m.Source.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// Unwrap returns the source under all wrappers like MemCache.
+func Unwrap(s Source) Source {
+	for {
+		w, ok := s.(interface{ Unwrap() Source })
+
+		if !ok {
+			return s
+		}
+
+		s = w.Unwrap()
+	}
+}
@@ -0,0 +1,98 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// testSource returns tiles with data "z/x/y" of the given size and counts calls.
+type testSource struct {
+	calls   atomic.Int32
+	size    int
+	expires time.Time
+}
+
+func (s *testSource) GetTile(_ context.Context, z, x, y int) (*TileData, error) {
+	s.calls.Add(1)
+
+	if x < 0 {
+		return nil, ErrNotFound
+	}
+
+	b := make([]byte, s.size)
+	copy(b, fmt.Sprintf("%d/%d/%d", z, x, y))
+
+	td := NewTileData("image/png", b, time.Now())
+	td.Expires = s.expires
+
+	return td, nil
+}
+
+func (s *testSource) GetMinZoom() int        { return 0 }
+func (s *testSource) GetMaxZoom() int        { return 18 }
+func (s *testSource) GetKey() string         { return "test" }
+func (s *testSource) GetName() string        { return "test" }
+func (s *testSource) IsTms() bool            { return false }
+func (s *testSource) IsFile() bool           { return true }
+func (s *testSource) GetContentType() string { return "image/png" }
+
+func TestMemCache(t *testing.T) {
+	src := &testSource{size: 100}
+	m := NewMemCache(src, 250)
+
+	ctx := context.Background()
+
+	for _, x := range []int{1, 2, 1, 3, 1, 2} {
+		if _, err := m.GetTile(ctx, 5, x, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 1 and 2 are cached, 3 pushes out 2, then 2 pushes out 3
+	if c := src.calls.Load(); c != 4 {
+		t.Errorf("source calls: got %d, must be 4", c)
+	}
+
+	hits, misses, size := m.Stats()
+
+	if hits != 2 || misses != 4 || size != 200 {
+		t.Errorf("got %d hits, %d misses, size %d", hits, misses, size)
+	}
+
+	if _, err := m.GetTile(ctx, 5, -1, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, must be ErrNotFound", err)
+	}
+
+	m.Invalidate()
+
+	if _, err := m.GetTile(ctx, 5, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if c := src.calls.Load(); c != 6 {
+		t.Errorf("source calls: got %d, must be 6", c)
+	}
+
+	if Unwrap(m) != Source(src) {
+		t.Error("wrong unwrapped source")
+	}
+}
+
+func TestMemCacheExpired(t *testing.T) {
+	src := &testSource{size: 10, expires: time.Now().Add(-time.Second)}
+	m := NewMemCache(src, 1000)
+
+	for range 2 {
+		if _, err := m.GetTile(context.Background(), 5, 1, 1); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if c := src.calls.Load(); c != 2 {
+		t.Errorf("source calls: got %d, must be 2", c)
+	}
+}
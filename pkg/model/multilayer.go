@@ -1,18 +1,50 @@
 package model
 
-import "context"
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+)
 
 var _ Source = &MultiLayer{}
 
+// indexRetryDelay is how long the index of the zoom with failed bounds queries is used before it is built again.
+const indexRetryDelay = time.Second * 10
+
+// MultiLayer returns the tile from the first layer that has it.
 type MultiLayer struct {
 	key     string
 	name    string
 	minZoom int
 	maxZoom int
-	layers  []*Layer
+	layers  []Source
+
+	mx sync.Mutex
+	// index finds the layers that may have the tile at each zoom, it is built on first use
+	index map[int]*zoomIndex
+}
+
+// zoomIndex is the bounds index of one zoom shared by all callers, it is ready when done is closed.
+type zoomIndex struct {
+	done chan struct{}
+	idx  *boundsIndex
+	err  error
+	// expires is the time the index built with bounds errors is built again
+	expires time.Time
+}
+
+// stale checks if the ready index failed and is to be built again.
+func (zi *zoomIndex) stale() bool {
+	select {
+	case <-zi.done:
+		return zi.err != nil && time.Now().After(zi.expires)
+	default:
+		return false
+	}
 }
 
-func NewMultilayer(key, name string, layers []*Layer) *MultiLayer {
+func NewMultilayer(key, name string, layers []Source) *MultiLayer {
 	m := &MultiLayer{
 		key:    key,
 		name:   name,
@@ -36,6 +68,68 @@ func (m *MultiLayer) init() {
 		m.minZoom = min(m.minZoom, l.GetMinZoom())
 		m.maxZoom = max(m.maxZoom, l.GetMaxZoom())
 	}
+
+	m.index = make(map[int]*zoomIndex)
+}
+
+// zoomIndex returns the bounds index of the zoom. It is built once by the first caller without the lock,
+// others wait for it. Layers with failed bounds queries are in the index with world bounds, the index is
+// used with the first bounds error for indexRetryDelay and then built again.
+func (m *MultiLayer) zoomIndex(z int) (*boundsIndex, bool, error) {
+	if z < m.minZoom || z > m.maxZoom {
+		return nil, false, nil
+	}
+
+	m.mx.Lock()
+	zi, ok := m.index[z]
+
+	if !ok || zi.stale() {
+		zi = &zoomIndex{done: make(chan struct{})}
+		m.index[z] = zi
+		ok = false
+	}
+	m.mx.Unlock()
+
+	if ok {
+		<-zi.done
+
+		return zi.idx, true, zi.err
+	}
+
+	zi.idx, zi.err = m.buildIndex(z)
+
+	if zi.err != nil {
+		zi.expires = time.Now().Add(indexRetryDelay)
+	}
+
+	close(zi.done)
+
+	return zi.idx, true, zi.err
+}
+
+// buildIndex queries bounds of the layers at the zoom, the first bounds error is returned.
+func (m *MultiLayer) buildIndex(z int) (*boundsIndex, error) {
+	idx := newBoundsIndex(z)
+
+	var firstErr error
+
+	for i, l := range m.layers {
+		if z < l.GetMinZoom() || z > l.GetMaxZoom() {
+			continue
+		}
+
+		b, ok, err := sourceBounds(l, z)
+
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+
+		if ok {
+			idx.add(i, b)
+		}
+	}
+
+	return idx, firstErr
 }
 
 func (m *MultiLayer) GetKey() string {
@@ -66,14 +160,145 @@ func (m *MultiLayer) GetContentType() string {
 	return ""
 }
 
-func (m *MultiLayer) GetTile(ctx context.Context, z int, x int, y int) (string, []byte, error) {
-	for _, l := range m.layers {
-		ct, b, err := l.GetTile(ctx, z, x, y)
+// GetTile returns the tile of the first layer having it. Failed layers are skipped, so a proxy may be
+// a fallback for files; the first error is returned if no layer has the tile.
+func (m *MultiLayer) GetTile(ctx context.Context, z int, x int, y int) (*TileData, error) {
+	if z < m.minZoom || z > m.maxZoom {
+		return nil, ErrOutOfRange
+	}
+
+	idx, _, _ := m.zoomIndex(z)
+
+	var firstErr error
+
+	for _, i := range idx.find(x, y) {
+		t, err := m.layers[i].GetTile(ctx, z, x, y)
+
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfRange) || errors.Is(err, ErrOutOfBounds) {
+			continue
+		}
+
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+
+			continue
+		}
+
+		if len(t.Data) > 0 {
+			return t, nil
+		}
+	}
+
+	if firstErr != nil {
+		return nil, firstErr
+	}
+
+	return nil, ErrNotFound
+}
+
+// hasTiles checks if any of the layers has tiles at the zoom in xyz range.
+// Layers that can't check it are supposed to have tiles.
+func (m *MultiLayer) hasTiles(ctx context.Context, z, xmin, ymin, xmax, ymax int) (bool, error) {
+	idx, ok, _ := m.zoomIndex(z)
+
+	if !ok {
+		return false, nil
+	}
+
+	r := TileBounds{XMin: xmin, YMin: ymin, XMax: xmax, YMax: ymax}
+
+	for i, l := range m.layers {
+		if b, ok := idx.bounds[i]; !ok || !b.intersects(r) {
+			continue
+		}
+
+		c, ok := Unwrap(l).(extentChecker)
+
+		if !ok {
+			return true, nil
+		}
+
+		ok, err := c.hasTiles(ctx, z, xmin, ymin, xmax, ymax)
+
+		if err != nil || ok {
+			return ok, err
+		}
+	}
+
+	return false, nil
+}
+
+// Bounds returns bounds of tiles of all layers at the zoom.
+func (m *MultiLayer) Bounds(z int) (TileBounds, bool, error) {
+	idx, ok, err := m.zoomIndex(z)
+
+	if !ok {
+		return TileBounds{}, false, nil
+	}
+
+	if err != nil {
+		return worldBounds(z), true, err
+	}
+
+	var res TileBounds
+	var found bool
 
-		if err != nil || len(b) > 0 {
-			return ct, b, err
+	for _, b := range idx.bounds {
+		if found {
+			res = res.union(b)
+		} else {
+			res, found = b, true
 		}
 	}
 
-	return "", nil, nil
+	return res, found, nil
+}
+
+// Info returns the info with attributions of all layers.
+func (m *MultiLayer) Info() LayerInfo {
+	return LayerInfo{Attribution: joinAttributions(m.layers)}
+}
+
+var _ Source = &ZoomRange{}
+
+// ZoomRange limits the zoom range of the source.
+type ZoomRange struct {
+	Source
+
+	minZoom int
+	maxZoom int
+}
+
+func NewZoomRange(src Source, minZoom, maxZoom int) *ZoomRange {
+	return &ZoomRange{Source: src, minZoom: minZoom, maxZoom: maxZoom}
+}
+
+func (r *ZoomRange) GetMinZoom() int {
+	return r.minZoom
+}
+
+func (r *ZoomRange) GetMaxZoom() int {
+	return r.maxZoom
+}
+
+func (r *ZoomRange) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	if z < r.minZoom || z > r.maxZoom {
+		return nil, ErrOutOfRange
+	}
+
+	return r.Source.GetTile(ctx, z, x, y)
+}
+
+func (r *ZoomRange) Bounds(z int) (TileBounds, bool, error) {
+	if z < r.minZoom || z > r.maxZoom {
+		return TileBounds{}, false, nil
+	}
+
+	return sourceBounds(r.Source, z)
+}
+
+func (r *ZoomRange) Unwrap() Source {
+	return r.Source
 }
@@ -0,0 +1,96 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"testing"
+)
+
+// errorSource fails all requests with the error.
+type errorSource struct {
+	testSource
+
+	err error
+}
+
+func (s *errorSource) GetTile(_ context.Context, _, _, _ int) (*TileData, error) {
+	return nil, s.err
+}
+
+func TestMultiLayer(t *testing.T) {
+	red := newColorSource(t, "red", color.RGBA{R: 255, A: 255})
+	blue := newColorSource(t, "blue", color.RGBA{B: 255, A: 255})
+	offline := &errorSource{err: ErrOffline}
+
+	ref := &LayerRef{MinZoom: 5, MaxZoom: 10}
+	m := NewMultilayer("multi", "multi", []Source{offline, ref.Limit(red), blue})
+
+	if m.GetMinZoom() != 0 || m.GetMaxZoom() != 18 {
+		t.Errorf("wrong zoom range %d-%d", m.GetMinZoom(), m.GetMaxZoom())
+	}
+
+	for _, c := range []struct {
+		z int
+		c color.RGBA
+	}{
+		{z: 4, c: color.RGBA{B: 255, A: 255}},
+		{z: 5, c: color.RGBA{R: 255, A: 255}},
+		{z: 10, c: color.RGBA{R: 255, A: 255}},
+		{z: 11, c: color.RGBA{B: 255, A: 255}},
+	} {
+		td, err := m.GetTile(context.Background(), c.z, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := tileColor(t, td, 10, 10); got != c.c {
+			t.Errorf("zoom %d: got color %v, must be %v", c.z, got, c.c)
+		}
+	}
+
+	if c := red.calls.Load(); c != 2 {
+		t.Errorf("red calls: got %d, must be 2", c)
+	}
+
+	m = NewMultilayer("multi", "multi", []Source{&errorSource{err: ErrNotFound}, offline})
+
+	if _, err := m.GetTile(context.Background(), 1, 0, 0); !errors.Is(err, ErrOffline) {
+		t.Errorf("got %v, must be ErrOffline", err)
+	}
+}
+
+func TestMultiLayerOverzoom(t *testing.T) {
+	red := newColorSource(t, "red", color.RGBA{R: 255, A: 255})
+	blue := newColorSource(t, "blue", color.RGBA{B: 255, A: 255})
+
+	// the multilayer is made of raw layers and overzoomed as a whole
+	m := NewOverzoom(NewMultilayer("multi", "multi", []Source{NewZoomRange(red, 0, 10), NewZoomRange(blue, 0, 12)}), 2)
+
+	if m.GetMaxZoom() != 14 {
+		t.Errorf("got max zoom %d, must be 14", m.GetMaxZoom())
+	}
+
+	for _, c := range []struct {
+		z int
+		c color.RGBA
+	}{
+		{z: 10, c: color.RGBA{R: 255, A: 255}},
+		{z: 11, c: color.RGBA{B: 255, A: 255}},
+		{z: 12, c: color.RGBA{B: 255, A: 255}},
+		{z: 14, c: color.RGBA{B: 255, A: 255}},
+	} {
+		td, err := m.GetTile(context.Background(), c.z, 0, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := tileColor(t, td, 10, 10); got != c.c {
+			t.Errorf("zoom %d: got color %v, must be %v", c.z, got, c.c)
+		}
+	}
+
+	if _, err := m.GetTile(context.Background(), 15, 0, 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("got %v, must be ErrOutOfRange", err)
+	}
+}
@@ -0,0 +1,361 @@
+package model
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/vector"
+
+	"github.com/kdudkov/tileproxy/pkg/mapper"
+)
+
+// Overlay kinds.
+const (
+	OverlayMarker  = "marker"
+	OverlayLine    = "line"
+	OverlayPolygon = "polygon"
+)
+
+// Overlay is a marker, polyline or polygon drawn on top of a static map.
+type Overlay struct {
+	Kind string
+	// Points are lon, lat of the marker, line vertices or the polygon outer ring.
+	Points [][2]float64
+	// Holes are the polygon inner rings.
+	Holes [][][2]float64
+	// Color is the marker color, or the line and polygon outline color.
+	Color color.NRGBA
+	Fill  color.NRGBA
+	// Width is the line width in pixels, 0 for a polygon without outline.
+	Width float64
+	// Size is the marker radius in pixels.
+	Size float64
+}
+
+// NewOverlay returns the overlay of the kind with default style.
+func NewOverlay(kind string) Overlay {
+	o := Overlay{Kind: kind, Width: 3, Size: 8}
+
+	if kind == OverlayMarker {
+		o.Color = color.NRGBA{R: 0xe0, G: 0x30, B: 0x30, A: 0xff}
+	} else {
+		o.Color = color.NRGBA{R: 0x33, G: 0x88, B: 0xff, A: 0xff}
+		o.Fill = color.NRGBA{R: 0x33, G: 0x88, B: 0xff, A: 0x40}
+	}
+
+	return o
+}
+
+var namedColors = map[string]color.NRGBA{
+	"black":  {A: 0xff},
+	"white":  {R: 0xff, G: 0xff, B: 0xff, A: 0xff},
+	"gray":   {R: 0x80, G: 0x80, B: 0x80, A: 0xff},
+	"red":    {R: 0xe0, G: 0x30, B: 0x30, A: 0xff},
+	"green":  {R: 0x30, G: 0xa0, B: 0x30, A: 0xff},
+	"blue":   {R: 0x33, G: 0x88, B: 0xff, A: 0xff},
+	"yellow": {R: 0xff, G: 0xd7, B: 0x00, A: 0xff},
+	"orange": {R: 0xff, G: 0x8c, B: 0x00, A: 0xff},
+	"purple": {R: 0x80, G: 0x30, B: 0xa0, A: 0xff},
+	"brown":  {R: 0x8b, G: 0x45, B: 0x13, A: 0xff},
+}
+
+// ParseColor parses a color name, #rgb, #rrggbb, #rrggbbaa or the same hex with 0x prefix.
+func ParseColor(s string) (color.NRGBA, bool) {
+	if c, ok := namedColors[strings.ToLower(s)]; ok {
+		return c, true
+	}
+
+	h := strings.TrimPrefix(strings.TrimPrefix(strings.TrimPrefix(s, "#"), "0x"), "0X")
+
+	if len(h) == 3 {
+		h = string([]byte{h[0], h[0], h[1], h[1], h[2], h[2]})
+	}
+
+	if len(h) == 6 {
+		h += "ff"
+	}
+
+	v, err := strconv.ParseUint(h, 16, 32)
+
+	if err != nil || len(h) != 8 {
+		return color.NRGBA{}, false
+	}
+
+	return color.NRGBA{R: uint8(v >> 24), G: uint8(v >> 16), B: uint8(v >> 8), A: uint8(v)}, true
+}
+
+// DrawOverlays draws the overlays on the map rendered for the request in EPSG:3857.
+func DrawOverlays(dst *image.RGBA, req MapRequest, overlays []Overlay) {
+	proj := func(p [2]float64) fpoint {
+		mx, my := mapper.LatLon2Mercator(max(-maxLat, min(p[1], maxLat)), p[0])
+
+		return fpoint{
+			x: (mx - req.BBox[0]) / (req.BBox[2] - req.BBox[0]) * float64(req.Width),
+			y: (req.BBox[3] - my) / (req.BBox[3] - req.BBox[1]) * float64(req.Height),
+		}
+	}
+
+	project := func(pts [][2]float64) []fpoint {
+		res := make([]fpoint, len(pts))
+
+		for i, p := range pts {
+			res[i] = proj(p)
+		}
+
+		return res
+	}
+
+	for _, o := range overlays {
+		// shapes far outside of the image are cut to keep rasterizing fast
+		m := o.Width + o.Size + 2
+		clip := frect{x0: -m, y0: -m, x1: float64(req.Width) + m, y1: float64(req.Height) + m}
+
+		switch o.Kind {
+		case OverlayMarker:
+			for _, p := range project(o.Points) {
+				if !clip.contains(p) {
+					continue
+				}
+
+				var outline, fill shape
+				outline.circle(p, o.Size+1.5)
+				outline.draw(dst, color.NRGBA{R: 0xff, G: 0xff, B: 0xff, A: o.Color.A})
+				fill.circle(p, o.Size)
+				fill.draw(dst, o.Color)
+			}
+		case OverlayLine:
+			var s shape
+			s.polyline(project(o.Points), o.Width, false, clip)
+			s.draw(dst, o.Color)
+		case OverlayPolygon:
+			outer := project(o.Points)
+
+			var fill, line shape
+			fill.ring(clip.clipPolygon(outer), false)
+			line.polyline(outer, o.Width, true, clip)
+
+			for _, h := range o.Holes {
+				hole := project(h)
+				fill.ring(clip.clipPolygon(hole), true)
+				line.polyline(hole, o.Width, true, clip)
+			}
+
+			fill.draw(dst, o.Fill)
+
+			if o.Width > 0 {
+				line.draw(dst, o.Color)
+			}
+		}
+	}
+}
+
+type fpoint struct {
+	x, y float64
+}
+
+type frect struct {
+	x0, y0, x1, y1 float64
+}
+
+func (r frect) contains(p fpoint) bool {
+	return p.x >= r.x0 && p.x <= r.x1 && p.y >= r.y0 && p.y <= r.y1
+}
+
+// clipSegment cuts the segment to the rect, Liang-Barsky algorithm.
+func (r frect) clipSegment(a, b fpoint) (fpoint, fpoint, bool) {
+	t0, t1 := 0.0, 1.0
+	dx, dy := b.x-a.x, b.y-a.y
+
+	for _, e := range [4][2]float64{{-dx, a.x - r.x0}, {dx, r.x1 - a.x}, {-dy, a.y - r.y0}, {dy, r.y1 - a.y}} {
+		p, q := e[0], e[1]
+
+		if p == 0 {
+			if q < 0 {
+				return a, b, false
+			}
+
+			continue
+		}
+
+		t := q / p
+
+		if p < 0 {
+			t0 = max(t0, t)
+		} else {
+			t1 = min(t1, t)
+		}
+
+		if t0 > t1 {
+			return a, b, false
+		}
+	}
+
+	return fpoint{a.x + t0*dx, a.y + t0*dy}, fpoint{a.x + t1*dx, a.y + t1*dy}, true
+}
+
+// clipPolygon cuts the ring to the rect, Sutherland-Hodgman algorithm.
+func (r frect) clipPolygon(pts []fpoint) []fpoint {
+	edges := []struct {
+		inside func(p fpoint) bool
+		cross  func(a, b fpoint) fpoint
+	}{
+		{func(p fpoint) bool { return p.x >= r.x0 }, func(a, b fpoint) fpoint { return crossX(a, b, r.x0) }},
+		{func(p fpoint) bool { return p.x <= r.x1 }, func(a, b fpoint) fpoint { return crossX(a, b, r.x1) }},
+		{func(p fpoint) bool { return p.y >= r.y0 }, func(a, b fpoint) fpoint { return crossY(a, b, r.y0) }},
+		{func(p fpoint) bool { return p.y <= r.y1 }, func(a, b fpoint) fpoint { return crossY(a, b, r.y1) }},
+	}
+
+	for _, e := range edges {
+		if len(pts) == 0 {
+			break
+		}
+
+		var res []fpoint
+
+		prev := pts[len(pts)-1]
+
+		for _, p := range pts {
+			switch {
+			case e.inside(p) && !e.inside(prev):
+				res = append(res, e.cross(prev, p), p)
+			case e.inside(p):
+				res = append(res, p)
+			case e.inside(prev):
+				res = append(res, e.cross(prev, p))
+			}
+
+			prev = p
+		}
+
+		pts = res
+	}
+
+	return pts
+}
+
+func crossX(a, b fpoint, x float64) fpoint {
+	return fpoint{x, a.y + (b.y-a.y)*(x-a.x)/(b.x-a.x)}
+}
+
+func crossY(a, b fpoint, y float64) fpoint {
+	return fpoint{a.x + (b.x-a.x)*(y-a.y)/(b.y-a.y), y}
+}
+
+// shape is a set of rings filled at once. Rings are drawn with the same orientation, so overlapping parts of a
+// line aren't drawn twice, and holes with the opposite one.
+type shape struct {
+	rings [][]fpoint
+}
+
+func (s *shape) ring(pts []fpoint, hole bool) {
+	if len(pts) < 3 {
+		return
+	}
+
+	if (signedArea(pts) < 0) != hole {
+		pts = slices.Clone(pts)
+		slices.Reverse(pts)
+	}
+
+	s.rings = append(s.rings, pts)
+}
+
+func (s *shape) circle(c fpoint, r float64) {
+	n := max(8, min(64, int(r*2)))
+	pts := make([]fpoint, n)
+
+	for i := range pts {
+		a := 2 * math.Pi * float64(i) / float64(n)
+		pts[i] = fpoint{c.x + r*math.Cos(a), c.y + r*math.Sin(a)}
+	}
+
+	s.ring(pts, false)
+}
+
+// polyline adds the line of the width with round joins and caps, cut to the rect.
+func (s *shape) polyline(pts []fpoint, width float64, closed bool, clip frect) {
+	if width <= 0 || len(pts) == 0 {
+		return
+	}
+
+	hw := width / 2
+
+	if closed {
+		pts = append(slices.Clone(pts), pts[0])
+	}
+
+	for i, p := range pts {
+		if clip.contains(p) {
+			s.circle(p, hw)
+		}
+
+		if i == 0 {
+			continue
+		}
+
+		a, b, ok := clip.clipSegment(pts[i-1], p)
+
+		if !ok {
+			continue
+		}
+
+		l := math.Hypot(b.x-a.x, b.y-a.y)
+
+		if l == 0 {
+			continue
+		}
+
+		nx, ny := -(b.y-a.y)/l*hw, (b.x-a.x)/l*hw
+		s.ring([]fpoint{{a.x + nx, a.y + ny}, {b.x + nx, b.y + ny}, {b.x - nx, b.y - ny}, {a.x - nx, a.y - ny}}, false)
+	}
+}
+
+// draw fills the shape with the color, only the part of the image under the shape is rasterized.
+func (s *shape) draw(dst *image.RGBA, c color.NRGBA) {
+	if len(s.rings) == 0 || c.A == 0 {
+		return
+	}
+
+	minX, minY, maxX, maxY := math.Inf(1), math.Inf(1), math.Inf(-1), math.Inf(-1)
+
+	for _, r := range s.rings {
+		for _, p := range r {
+			minX, minY, maxX, maxY = min(minX, p.x), min(minY, p.y), max(maxX, p.x), max(maxY, p.y)
+		}
+	}
+
+	r := image.Rect(int(math.Floor(minX)), int(math.Floor(minY)), int(math.Ceil(maxX)), int(math.Ceil(maxY))).Intersect(dst.Bounds())
+
+	if r.Empty() {
+		return
+	}
+
+	z := vector.NewRasterizer(r.Dx(), r.Dy())
+
+	for _, ring := range s.rings {
+		z.MoveTo(float32(ring[0].x)-float32(r.Min.X), float32(ring[0].y)-float32(r.Min.Y))
+
+		for _, p := range ring[1:] {
+			z.LineTo(float32(p.x)-float32(r.Min.X), float32(p.y)-float32(r.Min.Y))
+		}
+
+		z.ClosePath()
+	}
+
+	z.Draw(dst, r, image.NewUniform(c), image.Point{})
+}
+
+func signedArea(pts []fpoint) float64 {
+	var a float64
+
+	for i, p := range pts {
+		q := pts[(i+1)%len(pts)]
+		a += p.x*q.y - q.x*p.y
+	}
+
+	return a / 2
+}
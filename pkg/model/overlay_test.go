@@ -0,0 +1,110 @@
+package model
+
+import (
+	"image"
+	"image/color"
+	"testing"
+)
+
+func TestParseColor(t *testing.T) {
+	for s, want := range map[string]color.NRGBA{
+		"red":        namedColors["red"],
+		"#f00":       {R: 0xff, A: 0xff},
+		"#00ff00":    {G: 0xff, A: 0xff},
+		"0x0000ff80": {B: 0xff, A: 0x80},
+	} {
+		if c, ok := ParseColor(s); !ok || c != want {
+			t.Errorf("%s: got %v, want %v", s, c, want)
+		}
+	}
+
+	for _, s := range []string{"", "#12", "nocolor", "0x1234567"} {
+		if _, ok := ParseColor(s); ok {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestParseGeoJSON(t *testing.T) {
+	overlays, err := ParseGeoJSON([]byte(`{"type": "FeatureCollection", "features": [
+		{"type": "Feature", "properties": {"marker-color": "#00ff00"}, "geometry": {"type": "Point", "coordinates": [37.6, 55.7]}},
+		{"type": "Feature", "properties": {"stroke": "#ff0000", "stroke-width": 5},
+			"geometry": {"type": "MultiLineString", "coordinates": [[[0, 0], [1, 1]], [[2, 2], [3, 3, 100]]]}},
+		{"type": "Feature", "properties": {"fill": "#0000ff", "fill-opacity": 0.5},
+			"geometry": {"type": "Polygon", "coordinates": [[[0, 0], [10, 0], [10, 10], [0, 0]], [[1, 1], [2, 1], [2, 2], [1, 1]]]}}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(overlays) != 4 {
+		t.Fatalf("got %d overlays, want 4", len(overlays))
+	}
+
+	if o := overlays[0]; o.Kind != OverlayMarker || o.Color != (color.NRGBA{G: 0xff, A: 0xff}) || o.Points[0] != [2]float64{37.6, 55.7} {
+		t.Errorf("wrong marker %+v", o)
+	}
+
+	if o := overlays[2]; o.Kind != OverlayLine || o.Width != 5 || o.Color.R != 0xff || o.Points[1] != [2]float64{3, 3} {
+		t.Errorf("wrong line %+v", o)
+	}
+
+	if o := overlays[3]; o.Kind != OverlayPolygon || len(o.Holes) != 1 || o.Fill != (color.NRGBA{B: 0xff, A: 128}) {
+		t.Errorf("wrong polygon %+v", o)
+	}
+
+	for _, s := range []string{
+		`{"type": "Point", "coordinates": [0]}`,
+		`{"type": "Point", "coordinates": [0, 100]}`,
+		`{"type": "Circle", "coordinates": [0, 0]}`,
+		`not json`,
+	} {
+		if _, err := ParseGeoJSON([]byte(s)); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestDrawOverlays(t *testing.T) {
+	// 256x256 map of the whole world at zoom 0
+	req := CenterMap(0, 0, 0, 256, 256)
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+
+	red := color.NRGBA{R: 0xff, A: 0xff}
+
+	polygon := NewOverlay(OverlayPolygon)
+	polygon.Points = [][2]float64{{-90, -60}, {90, -60}, {90, 60}, {-90, 60}}
+	polygon.Holes = [][][2]float64{{{-10, -10}, {10, -10}, {10, 10}, {-10, 10}}}
+	polygon.Fill = red
+	polygon.Width = 0
+
+	marker := NewOverlay(OverlayMarker)
+	marker.Points = [][2]float64{{135, 0}}
+
+	// the line far outside of the image at zoom 0 is cut
+	line := NewOverlay(OverlayLine)
+	line.Points = [][2]float64{{-180, -80}, {-180, 80}, {1e6, 80}}
+	line.Color = color.NRGBA{G: 0xff, A: 0xff}
+
+	DrawOverlays(img, req, []Overlay{polygon, marker, line})
+
+	if c := img.RGBAAt(80, 128); c.R != 0xff {
+		t.Errorf("polygon is not filled: %v", c)
+	}
+
+	if c := img.RGBAAt(128, 128); c.A != 0 {
+		t.Errorf("hole is filled: %v", c)
+	}
+
+	if c := img.RGBAAt(224, 128); c != (color.RGBA{R: 0xe0, G: 0x30, B: 0x30, A: 0xff}) {
+		t.Errorf("wrong marker color %v", c)
+	}
+
+	if c := img.RGBAAt(0, 128); c.G != 0xff {
+		t.Errorf("line is not drawn: %v", c)
+	}
+
+	if c := img.RGBAAt(128, 60); c.A != 0 {
+		t.Errorf("wrong background %v", c)
+	}
+}
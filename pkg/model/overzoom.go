@@ -0,0 +1,147 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+
+	"golang.org/x/image/draw"
+)
+
+// maxOverzoomDepth is the max zoom difference between the requested tile and the ancestor it is made of.
+const maxOverzoomDepth = 6
+
+var _ Source = &Overzoom{}
+
+// Overzoom makes tiles above the source max zoom by cropping and upscaling the nearest available ancestor tile.
+type Overzoom struct {
+	Source
+
+	levels int
+}
+
+// NewOverzoom extends the source max zoom by levels.
+func NewOverzoom(src Source, levels int) *Overzoom {
+	return &Overzoom{Source: src, levels: levels}
+}
+
+func (o *Overzoom) GetMaxZoom() int {
+	return o.Source.GetMaxZoom() + o.levels
+}
+
+func (o *Overzoom) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	maxZoom := o.Source.GetMaxZoom()
+
+	if z <= maxZoom {
+		return o.Source.GetTile(ctx, z, x, y)
+	}
+
+	if z > o.GetMaxZoom() {
+		return nil, ErrOutOfRange
+	}
+
+	for pz := maxZoom; pz >= max(o.Source.GetMinZoom(), z-maxOverzoomDepth); pz-- {
+		dz := z - pz
+
+		td, err := o.Source.GetTile(ctx, pz, x>>dz, y>>dz)
+
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		return upscale(td, dz, x&(1<<dz-1), y&(1<<dz-1), 1)
+	}
+
+	return nil, ErrNotFound
+}
+
+// upscale crops the (qx, qy) part of the tile divided into 2^dz x 2^dz parts and scales it to scale times
+// the tile size.
+func upscale(td *TileData, dz, qx, qy, scale int) (*TileData, error) {
+	img, format, err := decodeTile(td.Data)
+
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	b := img.Bounds()
+	w, h := b.Dx()>>dz, b.Dy()>>dz
+
+	if w == 0 || h == 0 {
+		return nil, ErrNotFound
+	}
+
+	r := image.Rect(b.Min.X+qx*w, b.Min.Y+qy*h, b.Min.X+(qx+1)*w, b.Min.Y+(qy+1)*h)
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx()*scale, b.Dy()*scale))
+
+	draw.CatmullRom.Scale(dst, dst.Bounds(), img, r, draw.Src, nil)
+
+	data, ct, err := encodeTile(dst, format)
+
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	res := NewTileData(ct, data, td.ModTime)
+	res.Expires = td.Expires
+
+	return res, nil
+}
+
+// Bounds returns bounds of the tiles the source has, or the ancestors of them above the source max zoom.
+func (o *Overzoom) Bounds(z int) (TileBounds, bool, error) {
+	maxZoom := o.Source.GetMaxZoom()
+
+	if z <= maxZoom {
+		return sourceBounds(o.Source, z)
+	}
+
+	var res TileBounds
+	var found bool
+
+	for pz := maxZoom; pz >= max(o.Source.GetMinZoom(), z-maxOverzoomDepth); pz-- {
+		b, ok, err := sourceBounds(o.Source, pz)
+
+		if err != nil {
+			return worldBounds(z), true, err
+		}
+
+		if !ok {
+			continue
+		}
+
+		if b = b.zoomIn(z - pz); found {
+			res = res.union(b)
+		} else {
+			res, found = b, true
+		}
+	}
+
+	return res, found, nil
+}
+
+// Touch passes the use of the tile, or of its ancestor at the source max zoom, to the source.
+func (o *Overzoom) Touch(t Tile) {
+	if dz := t.Z - o.Source.GetMaxZoom(); dz > 0 {
+		t = Tile{X: t.X >> dz, Y: t.Y >> dz, Z: t.Z - dz}
+	}
+
+	touch(o.Source, t)
+}
+
+func (o *Overzoom) Unwrap() Source {
+	return o.Source
+}
+
+func (o *Overzoom) Close() error {
+	if c, ok := o.Source.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
@@ -0,0 +1,107 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"testing"
+	"time"
+)
+
+var quadrantColors = []color.RGBA{
+	{R: 255, A: 255}, {G: 255, A: 255},
+	{B: 255, A: 255}, {R: 255, G: 255, A: 255},
+}
+
+// imageSource returns 256px png tiles of four colored quadrants up to zoom 1, tiles with x = 1 are missing.
+type imageSource struct {
+	testSource
+}
+
+func (s *imageSource) GetTile(_ context.Context, z, x, y int) (*TileData, error) {
+	if z > s.GetMaxZoom() {
+		return nil, ErrOutOfRange
+	}
+
+	if x == 1 {
+		return nil, ErrNotFound
+	}
+
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+
+	for py := range 256 {
+		for px := range 256 {
+			img.Set(px, py, quadrantColors[py/128*2+px/128])
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, img); err != nil {
+		return nil, err
+	}
+
+	return NewTileData("image/png", buf.Bytes(), time.Now()), nil
+}
+
+func (s *imageSource) GetMaxZoom() int { return 1 }
+
+func tileColor(t *testing.T, td *TileData, x, y int) color.RGBA {
+	img, _, err := decodeTile(td.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds().Dx() != 256 || img.Bounds().Dy() != 256 {
+		t.Fatalf("wrong tile size %v", img.Bounds())
+	}
+
+	return color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+}
+
+func TestOverzoom(t *testing.T) {
+	o := NewOverzoom(&imageSource{}, 3)
+
+	if z := o.GetMaxZoom(); z != 4 {
+		t.Errorf("max zoom: got %d, must be 4", z)
+	}
+
+	// z2 tiles are quadrants of z1 tile 0,0
+	for i, c := range quadrantColors {
+		td, err := o.GetTile(context.Background(), 2, i%2, i/2)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got := tileColor(t, td, 128, 128); got != c {
+			t.Errorf("quadrant %d: got color %v, must be %v", i, got, c)
+		}
+	}
+
+	// z3 tile 3,1 is in the top right quadrant of z1 tile 0,0
+	td, err := o.GetTile(context.Background(), 3, 3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tileColor(t, td, 10, 10); got != quadrantColors[1] {
+		t.Errorf("got color %v, must be %v", got, quadrantColors[1])
+	}
+
+	// z1 tile 1,0 is missing, z0 tile 0,0 is used
+	td, err = o.GetTile(context.Background(), 2, 2, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tileColor(t, td, 10, 10); got != quadrantColors[1] {
+		t.Errorf("got color %v, must be %v", got, quadrantColors[1])
+	}
+
+	if _, err := o.GetTile(context.Background(), 5, 0, 0); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("got %v, must be ErrOutOfRange", err)
+	}
+}
@@ -3,18 +3,23 @@ package model
 import (
 	"context"
 	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	neturl "net/url"
 	"os"
-	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
+const defaultUserAgent = "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:125.0) Gecko/20100101 Firefox/125.0"
+
 var _ Source = &Proxy{}
 
 type Proxy struct {
@@ -24,7 +29,7 @@ type Proxy struct {
 	minZoom     int
 	maxZoom     int
 	tms         bool
-	path        string
+	store       TileStore
 	url         string
 	ext         string
 	serverParts []string
@@ -32,24 +37,154 @@ type Proxy struct {
 	httpTimeout time.Duration
 	cl          *http.Client
 
+	rps        float64
+	maxConns   int
+	retries    int
+	retryDelay time.Duration
+	limiter    *limiter
+	breaker    *breaker
+
+	headerTemplates    map[string]string
+	queryEnv           map[string]string
+	proxyUrl           string
+	caFile             string
+	insecureSkipVerify bool
+	minSize            int
+	maxSize            int
+	noDataHashes       []string
+	headers            http.Header
+	query              map[string]string
+
 	urlGetter func(z, x, y int) string
 
-	Offline         bool
-	keepProbability float32
+	keepProbability      float32
+	staleWhileRevalidate bool
+	notFoundTimeout      time.Duration
 
 	t1 *Tile
 	t2 *Tile
+
+	info LayerInfo
+
+	mx       sync.Mutex
+	inflight map[Tile]*download
+	// downloads are canceled and waited for on Close
+	downloads sync.WaitGroup
+	ctx       context.Context
+	cancel    context.CancelFunc
+
+	refresher *refresher
+
+	maxCacheSize int64
+	usage        *diskUsage
 }
 
-func (p *Proxy) Init() {
+// download is an upstream request shared by all callers asking for the same tile.
+type download struct {
+	done chan struct{}
+	data []byte
+	err  error
+}
+
+func (p *Proxy) Init() error {
+	p.inflight = make(map[Tile]*download)
+	p.ctx, p.cancel = context.WithCancel(context.Background())
+
+	if p.staleWhileRevalidate {
+		p.refresher = newRefresher(p, refreshWorkers, refreshQueueSize)
+	}
+
+	if p.retryDelay == 0 {
+		p.retryDelay = time.Millisecond * 500
+	}
+
+	host := upstreamHost(p.url)
+
+	if host == "" {
+		host = p.key
+	}
+
+	p.limiter = getLimiter(host, p.key, p.rps, p.maxConns)
+
+	if p.breaker == nil {
+		p.breaker = newBreaker(0, 0)
+	}
+
+	p.headers = make(http.Header)
+	p.headers.Set("User-Agent", defaultUserAgent)
+
+	for k, v := range p.headerTemplates {
+		p.headers.Set(k, os.ExpandEnv(v))
+	}
+
+	p.query = make(map[string]string, len(p.queryEnv))
+
+	for k, env := range p.queryEnv {
+		v, ok := os.LookupEnv(env)
+
+		if !ok {
+			return fmt.Errorf("%s: environment variable %s is not set", p.key, env)
+		}
+
+		p.query[k] = v
+	}
+
+	tlsConfig := &tls.Config{InsecureSkipVerify: p.insecureSkipVerify} //nolint:gosec
+
+	if p.caFile != "" {
+		pool, err := loadCertPool(p.caFile)
+
+		if err != nil {
+			return fmt.Errorf("%s: %w", p.key, err)
+		}
+
+		tlsConfig.RootCAs = pool
+	}
+
+	tr := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		ResponseHeaderTimeout: p.httpTimeout,
+		TLSClientConfig:       tlsConfig,
+		MaxConnsPerHost:       p.maxConns,
+	}
+
+	if p.proxyUrl != "" {
+		u, err := neturl.Parse(os.ExpandEnv(p.proxyUrl))
+
+		if err != nil {
+			return fmt.Errorf("%s: invalid proxy url: %w", p.key, err)
+		}
+
+		tr.Proxy = http.ProxyURL(u)
+	}
+
 	p.cl = &http.Client{
-		Timeout: time.Second * 10,
-		Transport: &http.Transport{
-			ResponseHeaderTimeout: p.httpTimeout,
-			TLSClientConfig:       &tls.Config{InsecureSkipVerify: true},
-			//MaxConnsPerHost:       4,
-		},
+		Timeout:   time.Second * 10,
+		Transport: tr,
+	}
+
+	return nil
+}
+
+// loadCertPool returns system cert pool with certificates from the pem file added.
+func loadCertPool(name string) (*x509.CertPool, error) {
+	b, err := os.ReadFile(name)
+
+	if err != nil {
+		return nil, err
+	}
+
+	pool, err := x509.SystemCertPool()
+
+	if err != nil {
+		pool = x509.NewCertPool()
+	}
+
+	if !pool.AppendCertsFromPEM(b) {
+		return nil, fmt.Errorf("no certificates found in %s", name)
 	}
+
+	return pool, nil
 }
 
 func (p *Proxy) GetName() string {
@@ -74,11 +209,17 @@ func (p *Proxy) GetContentType() string {
 		return "image/jpeg"
 	case "png":
 		return "image/png"
+	case "webp":
+		return "image/webp"
 	default:
 		return "image/png"
 	}
 }
 
+func (p *Proxy) Info() LayerInfo {
+	return p.info
+}
+
 func (p *Proxy) IsTms() bool {
 	return p.tms
 }
@@ -87,101 +228,411 @@ func (p *Proxy) IsFile() bool {
 	return false
 }
 
-func (p *Proxy) GetTile(ctx context.Context, z, x, y int) (string, []byte, error) {
+func (p *Proxy) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
 	if z < p.minZoom || z > p.maxZoom {
-		return "", nil, fmt.Errorf("invalid zoom")
+		return nil, ErrOutOfRange
 	}
 
 	if p.t1 != nil && p.t2 != nil && !(&Tile{X: x, Y: y, Z: z}).InRect(p.t1, p.t2) {
-		return "", nil, fmt.Errorf("border")
-	}
-
-	if p.tms {
-		y = 1<<z - y - 1
+		return nil, ErrOutOfBounds
 	}
 
 	logger := p.logger.With("zoom", strconv.Itoa(z))
 
-	fpath := path.Join(p.path, fmt.Sprintf("z%d/%d/x%d/%d", z, x/1024, x, y/1024))
-	fname := fmt.Sprintf("y%d.%s", y, p.ext)
+	t := Tile{X: x, Y: y, Z: z}
 
-	st, err := os.Stat(path.Join(fpath, fname))
+	data, info, err := p.store.Get(ctx, t)
 
-	if err != nil {
+	if err == nil && info.Missing {
+		if p.isNotFound(info) {
+			logger.Debug("not found")
+
+			return nil, ErrNotFound
+		}
+
+		err = ErrNotFound
+	}
+
+	if errors.Is(err, ErrNotFound) {
 		logger.Debug("miss")
-		b, err := p.download(ctx, p.GetUrl(z, x, y), fpath, fname)
+		b, err := p.fetch(ctx, t, false)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return p.newTileData(b, time.Now()), nil
+	}
 
-		return p.GetContentType(), b, err
+	if err != nil {
+		return nil, internalError(err)
 	}
 
-	if p.timeout == 0 || st.ModTime().Add(p.timeout).After(time.Now()) {
+	if p.timeout == 0 || info.ModTime.Add(p.timeout).After(time.Now()) {
 		logger.Debug("hit")
-		b, err := os.ReadFile(path.Join(fpath, fname))
 
-		return p.GetContentType(), b, err
+		return p.cachedTile(t, data, info), nil
 	}
 
 	if rand.Float32() < p.keepProbability {
 		logger.Debug("keep")
-		b, err := os.ReadFile(path.Join(fpath, fname))
 
-		return p.GetContentType(), b, err
+		return p.cachedTile(t, data, info), nil
+	}
+
+	if p.refresher != nil {
+		logger.Debug("stale")
+		p.refresher.Add(t)
+
+		return p.cachedTile(t, data, info), nil
 	}
 
 	logger.Debug("timeout")
-	data, err := p.download(ctx, p.GetUrl(z, x, y), fpath, fname)
+	b, err := p.fetch(ctx, t, true)
 
-	// backup - return file if any
+	// backup - return the cached tile
 	if err != nil {
-		b, err := os.ReadFile(path.Join(fpath, fname))
+		return p.cachedTile(t, data, info), nil
+	}
 
-		return p.GetContentType(), b, err
+	return p.newTileData(b, time.Now()), nil
+}
+
+// PendingRefreshes returns the number of stale tiles waiting for the background refresh.
+func (p *Proxy) PendingRefreshes() int64 {
+	if p.refresher == nil {
+		return 0
 	}
 
-	return p.GetContentType(), data, nil
+	return p.refresher.Pending()
 }
 
-func (p *Proxy) download(ctx context.Context, url string, fpath, fname string) ([]byte, error) {
-	if p.Offline {
-		return nil, fmt.Errorf("offline")
+// Close waits a while for the queued background refreshes to finish, cancels running downloads
+// and closes the cache store.
+func (p *Proxy) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), refreshCloseTimeout)
+	defer cancel()
+
+	return p.Shutdown(ctx)
+}
+
+// Shutdown closes the proxy, queued background refreshes are done until ctx is done and dropped then.
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	if p.refresher != nil {
+		p.refresher.shutdown(ctx)
 	}
 
-	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	p.cancel()
+	p.downloads.Wait()
 
-	if err != nil {
-		return nil, err
+	return p.store.Close()
+}
+
+func (p *Proxy) newTileData(data []byte, modTime time.Time) *TileData {
+	t := NewTileData(p.GetContentType(), data, modTime)
+
+	if p.timeout > 0 {
+		t.Expires = modTime.Add(p.timeout)
 	}
 
-	req.Header.Set("User-Agent", "Mozilla/5.0 (Macintosh; Intel Mac OS X 10.15; rv:125.0) Gecko/20100101 Firefox/125.0")
+	return t
+}
 
-	resp, err := p.cl.Do(req)
+func (p *Proxy) cachedTile(t Tile, data []byte, info *TileInfo) *TileData {
+	p.usage.Touch(t)
+
+	return p.newTileData(data, info.ModTime)
+}
+
+// fetch downloads the tile, joining an already running download of the same tile if there is one.
+// The download itself is not canceled when ctx is done, so other waiters still get the tile,
+// it is canceled only when the proxy is closed.
+func (p *Proxy) fetch(ctx context.Context, t Tile, revalidate bool) ([]byte, error) {
+	p.mx.Lock()
+	d, ok := p.inflight[t]
+
+	if !ok {
+		d = &download{done: make(chan struct{})}
+		p.inflight[t] = d
+		p.downloads.Add(1)
+
+		go func() {
+			defer p.downloads.Done()
+
+			dctx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+			stop := context.AfterFunc(p.ctx, cancel)
+
+			d.data, d.err = p.download(dctx, t, revalidate)
+
+			stop()
+			cancel()
+
+			p.mx.Lock()
+			delete(p.inflight, t)
+			p.mx.Unlock()
+
+			close(d.done)
+		}()
+	}
+	p.mx.Unlock()
+
+	select {
+	case <-d.done:
+		return d.data, d.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// download gets the tile from upstream and saves it to the cache.
+// With revalidate set the request is conditional on the stored ETag/Last-Modified,
+// and 304 answer just refreshes the cached file time.
+func (p *Proxy) download(ctx context.Context, t Tile, revalidate bool) ([]byte, error) {
+	if !p.breaker.Allow() {
+		return nil, ErrOffline
+	}
+
+	y := t.Y
+
+	if p.tms {
+		y = 1<<t.Z - y - 1
+	}
+
+	url := p.GetUrl(t.Z, t.X, y)
+	header := p.headers.Clone()
+
+	if revalidate {
+		if info, err := p.store.Stat(ctx, t); err == nil {
+			if info.Meta.ETag != "" {
+				header.Set("If-None-Match", info.Meta.ETag)
+			}
+
+			if info.Meta.LastModified != "" {
+				header.Set("If-Modified-Since", info.Meta.LastModified)
+			}
+		}
+	}
+
+	resp, data, err := p.get(ctx, url, header)
+
+	// the upstream has answered, so rejected tiles are not breaker failures
+	p.report(ctx, resp, err)
 
 	if err != nil {
 		return nil, err
 	}
 
+	if resp.StatusCode < 300 && (len(data) > 0 || p.notFoundTimeout == 0) {
+		if err := p.validate(data); errors.Is(err, ErrNotFound) {
+			p.markNotFound(ctx, t)
+
+			return nil, err
+		} else if err != nil {
+			return nil, &UpstreamError{Url: url, Status: resp.StatusCode, Err: err}
+		}
+	}
+
+	if revalidate && resp.StatusCode == http.StatusNotModified {
+		if err := p.store.Touch(ctx, t); err != nil {
+			return nil, internalError(err)
+		}
+
+		b, _, err := p.store.Get(ctx, t)
+
+		if err != nil {
+			return nil, internalError(err)
+		}
+
+		p.usage.Touch(t)
+
+		return b, nil
+	}
+
+	if resp.StatusCode == http.StatusNotFound {
+		p.markNotFound(ctx, t)
+	}
+
 	if resp.StatusCode >= 300 {
-		return nil, fmt.Errorf("%s error %s\n", url, resp.Status)
+		return nil, &UpstreamError{Url: url, Status: resp.StatusCode}
+	}
+
+	if len(data) == 0 && p.notFoundTimeout > 0 {
+		p.markNotFound(ctx, t)
+
+		return nil, ErrNotFound
+	}
+
+	m := TileMeta{ETag: resp.Header.Get("ETag"), LastModified: resp.Header.Get("Last-Modified")}
+
+	if err := p.store.Put(ctx, t, data, m); err != nil {
+		return nil, internalError(err)
+	}
+
+	p.usage.Add(t, int64(len(data)), time.Now())
+
+	return data, nil
+}
+
+// report passes the upstream request result to the circuit breaker.
+func (p *Proxy) report(ctx context.Context, resp *http.Response, err error) {
+	switch {
+	case err != nil && (errors.Is(err, errBackoff) || errors.Is(err, ErrInternal) || ctx.Err() != nil):
+		p.breaker.Release()
+	case err != nil:
+		p.breaker.Failure()
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		p.breaker.Failure()
+	default:
+		p.breaker.Success()
+	}
+}
+
+// SetMode forces the layer online or offline, ModeAuto returns control to the circuit breaker.
+func (p *Proxy) SetMode(m Mode) {
+	p.breaker.SetMode(m)
+}
+
+// State returns the layer mode and the circuit breaker state.
+func (p *Proxy) State() (Mode, string) {
+	return p.breaker.State()
+}
+
+// get does the upstream request within the layer limits, retrying network errors and retryable statuses
+// with exponential backoff. The response body is read and closed.
+func (p *Proxy) get(ctx context.Context, url string, header http.Header) (*http.Response, []byte, error) {
+	for attempt := 0; ; attempt++ {
+		resp, data, err := p.do(ctx, url, header)
+
+		var wait time.Duration
+
+		if err != nil {
+			var upErr *UpstreamError
+
+			if !errors.As(err, &upErr) || errors.Is(err, errBackoff) || ctx.Err() != nil || attempt >= p.retries {
+				return nil, nil, err
+			}
+
+			wait = backoff(p.retryDelay, attempt)
+		} else {
+			if !isRetryable(resp.StatusCode) {
+				return resp, data, nil
+			}
+
+			wait = backoff(p.retryDelay, attempt)
+
+			if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode == http.StatusServiceUnavailable {
+				if ra, ok := retryAfter(resp.Header); ok {
+					p.limiter.BlockUntil(time.Now().Add(ra))
+
+					if ra > maxRetryWait {
+						return resp, data, nil
+					}
+
+					wait = max(wait, ra)
+				}
+			}
+
+			if attempt >= p.retries {
+				return resp, data, nil
+			}
+		}
+
+		p.logger.Debug(fmt.Sprintf("retry %s in %s", url, wait))
+
+		if err := sleep(ctx, wait); err != nil {
+			return nil, nil, &UpstreamError{Url: url, Err: err}
+		}
+	}
+}
+
+func (p *Proxy) do(ctx context.Context, url string, header http.Header) (*http.Response, []byte, error) {
+	release, err := p.limiter.Acquire(ctx)
+
+	if err != nil {
+		return nil, nil, &UpstreamError{Url: url, Err: err}
+	}
+
+	defer release()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+
+	if err != nil {
+		return nil, nil, internalError(err)
+	}
+
+	// secret query parameters are added here, so they never get into logs and errors
+	if len(p.query) > 0 {
+		q := req.URL.Query()
+
+		for k, v := range p.query {
+			q.Set(k, v)
+		}
+
+		req.URL.RawQuery = q.Encode()
 	}
 
-	if resp.Body == nil {
-		return nil, fmt.Errorf("nil body")
+	req.Header = header.Clone()
+
+	resp, err := p.cl.Do(req)
+
+	if err != nil {
+		return nil, nil, &UpstreamError{Url: url, Err: err}
 	}
 
 	defer resp.Body.Close()
+
 	data, err := io.ReadAll(resp.Body)
 
 	if err != nil {
-		return nil, err
+		return nil, nil, &UpstreamError{Url: url, Status: resp.StatusCode, Err: err}
 	}
 
-	if err := os.MkdirAll(fpath, 0755); err != nil {
-		return nil, err
+	return resp, data, nil
+}
+
+func (p *Proxy) isNotFound(info *TileInfo) bool {
+	return p.notFoundTimeout > 0 && info.ModTime.Add(p.notFoundTimeout).After(time.Now())
+}
+
+// markNotFound replaces the cached tile with the "tile not exists" marker.
+func (p *Proxy) markNotFound(ctx context.Context, t Tile) {
+	if p.notFoundTimeout == 0 {
+		return
+	}
+
+	if err := p.store.PutMissing(ctx, t); err != nil {
+		p.logger.Warn("can't save not found marker", "error", err)
+		return
 	}
 
-	err2 := os.WriteFile(path.Join(fpath, fname), data, 0644)
+	p.usage.Remove(t)
+}
+
+// PurgeNotFound removes all "tile not exists" markers from the layer cache and returns their number.
+func (p *Proxy) PurgeNotFound() (int, error) {
+	ctx := context.Background()
+
+	var tiles []Tile
+
+	err := p.store.Iterate(ctx, func(t Tile, info *TileInfo) bool {
+		if info.Missing {
+			tiles = append(tiles, t)
+		}
+
+		return true
+	})
+
+	if err != nil {
+		return 0, err
+	}
+
+	for i, t := range tiles {
+		if err := p.store.Delete(ctx, t); err != nil {
+			return i, err
+		}
+	}
 
-	return data, err2
+	return len(tiles), nil
 }
 
 func (p *Proxy) GetUrl(z, x, y int) string {
@@ -189,6 +640,8 @@ func (p *Proxy) GetUrl(z, x, y int) string {
 		url := strings.ReplaceAll(p.url, "{z}", strconv.Itoa(z))
 		url = strings.ReplaceAll(url, "{x}", strconv.Itoa(x))
 		url = strings.ReplaceAll(url, "{y}", strconv.Itoa(y))
+		url = strings.ReplaceAll(url, "{r}", "")
+		url = strings.ReplaceAll(url, "{scale}", "1")
 
 		if len(p.serverParts) > 0 {
 			i := rand.Intn(len(p.serverParts))
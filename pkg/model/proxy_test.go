@@ -0,0 +1,783 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+var pngTile = []byte("\x89PNG\r\n\x1a\ntile")
+
+type upstream struct {
+	*httptest.Server
+	hits        atomic.Int32
+	notModified atomic.Int32
+	delay       time.Duration
+
+	mx     sync.Mutex
+	status int
+	etag   string
+	body   []byte
+}
+
+func (u *upstream) set(f func(u *upstream)) {
+	u.mx.Lock()
+	defer u.mx.Unlock()
+
+	f(u)
+}
+
+func newUpstream(t *testing.T, delay time.Duration) *upstream {
+	u := &upstream{delay: delay, body: pngTile}
+
+	u.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		u.hits.Add(1)
+		time.Sleep(u.delay)
+
+		u.mx.Lock()
+		defer u.mx.Unlock()
+
+		if u.etag != "" {
+			w.Header().Set("ETag", u.etag)
+
+			if r.Header.Get("If-None-Match") == u.etag {
+				u.notModified.Add(1)
+				w.WriteHeader(http.StatusNotModified)
+
+				return
+			}
+		}
+
+		if u.status != 0 {
+			w.WriteHeader(u.status)
+		}
+
+		_, _ = w.Write(u.body)
+	}))
+
+	t.Cleanup(u.Close)
+
+	return u
+}
+
+func mustProxy(t *testing.T, l *LayerDescription) *Proxy {
+	p, err := NewProxy(l, slog.Default(), t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return p
+}
+
+// cacheDir returns the cache directory of the proxy with the default file store.
+func cacheDir(p *Proxy) string {
+	return p.store.(*FileStore).root
+}
+
+func newTestProxy(t *testing.T, u *upstream) *Proxy {
+	return mustProxy(t, &LayerDescription{
+		Key:      t.Name(),
+		Name:     "test",
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      u.URL + "/{z}/{x}/{y}.png",
+	})
+}
+
+func TestProxyCoalesceDownloads(t *testing.T) {
+	u := newUpstream(t, time.Millisecond*100)
+	p := newTestProxy(t, u)
+
+	const n = 10
+
+	res := make([]*TileData, n)
+	errs := make([]error, n)
+
+	wg := new(sync.WaitGroup)
+
+	for i := range n {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+			res[i], errs[i] = p.GetTile(context.Background(), 10, 100, 200)
+		}()
+	}
+
+	wg.Wait()
+
+	if h := u.hits.Load(); h != 1 {
+		t.Errorf("upstream hits: got %d, must be 1", h)
+	}
+
+	for i := range n {
+		if errs[i] != nil {
+			t.Fatalf("request %d: %s", i, errs[i])
+		}
+
+		if !bytes.Equal(res[i].Data, u.body) {
+			t.Errorf("request %d: wrong data %q", i, res[i].Data)
+		}
+	}
+
+	files, err := filepath.Glob(filepath.Join(cacheDir(p), "z10", "0", "x100", "0", "*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 1 || filepath.Base(files[0]) != "y200.png" {
+		t.Errorf("wrong cache files: %v", files)
+	}
+
+	if _, err := p.GetTile(context.Background(), 10, 100, 200); err != nil {
+		t.Fatal(err)
+	}
+
+	if h := u.hits.Load(); h != 1 {
+		t.Errorf("cached tile is downloaded again, hits: %d", h)
+	}
+}
+
+func TestProxyDifferentTiles(t *testing.T) {
+	u := newUpstream(t, time.Millisecond*10)
+	p := newTestProxy(t, u)
+
+	wg := new(sync.WaitGroup)
+
+	for i := range 5 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := p.GetTile(context.Background(), 10, 100+i, 200); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if h := u.hits.Load(); h != 5 {
+		t.Errorf("upstream hits: got %d, must be 5", h)
+	}
+}
+
+func TestProxyCanceledWaiter(t *testing.T) {
+	u := newUpstream(t, time.Millisecond*100)
+	p := newTestProxy(t, u)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+
+	if _, err := p.GetTile(ctx, 10, 1, 1); err == nil {
+		t.Fatal("canceled request must fail")
+	}
+
+	tile, err := p.GetTile(context.Background(), 10, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tile.Data, u.body) {
+		t.Errorf("wrong data %q", tile.Data)
+	}
+
+	if h := u.hits.Load(); h != 1 {
+		t.Errorf("upstream hits: got %d, must be 1", h)
+	}
+
+	if _, err := os.Stat(filepath.Join(cacheDir(p), "z10", "0", "x1", "0", "y1.png")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyErrors(t *testing.T) {
+	u := newUpstream(t, 0)
+	p := newTestProxy(t, u)
+
+	if _, err := p.GetTile(context.Background(), 20, 1, 1); !errors.Is(err, ErrOutOfRange) {
+		t.Errorf("got %v, must be ErrOutOfRange", err)
+	}
+
+	u.set(func(u *upstream) { u.status = http.StatusServiceUnavailable })
+
+	_, err := p.GetTile(context.Background(), 10, 1, 1)
+
+	var upErr *UpstreamError
+	if !errors.As(err, &upErr) || upErr.Status != http.StatusServiceUnavailable {
+		t.Errorf("got %v, must be upstream error with status 503", err)
+	}
+
+	if errors.Is(err, ErrNotFound) {
+		t.Error("upstream 503 must not be ErrNotFound")
+	}
+
+	u.set(func(u *upstream) { u.status = http.StatusNotFound })
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, must be ErrNotFound", err)
+	}
+
+	p.SetMode(ModeOffline)
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 3); !errors.Is(err, ErrOffline) {
+		t.Errorf("got %v, must be ErrOffline", err)
+	}
+}
+
+func TestProxyRevalidate(t *testing.T) {
+	u := newUpstream(t, 0)
+	u.etag = `"v1"`
+
+	p := newTestProxy(t, u)
+	p.timeout = time.Hour
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(cacheDir(p), "z10", "0", "x1", "0", "y1.png")
+	old := time.Now().Add(-time.Hour * 2)
+
+	if err := os.Chtimes(name, old, old); err != nil {
+		t.Fatal(err)
+	}
+
+	tile, err := p.GetTile(context.Background(), 10, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tile.Data, u.body) {
+		t.Errorf("wrong data %q", tile.Data)
+	}
+
+	if h, nm := u.hits.Load(), u.notModified.Load(); h != 2 || nm != 1 {
+		t.Errorf("got %d hits and %d not modified, must be 2 and 1", h, nm)
+	}
+
+	st, err := os.Stat(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if time.Since(st.ModTime()) > time.Minute {
+		t.Errorf("file time is not refreshed: %s", st.ModTime())
+	}
+}
+
+func TestProxyStaleWhileRevalidate(t *testing.T) {
+	u := newUpstream(t, time.Millisecond*50)
+
+	p := mustProxy(t, &LayerDescription{
+		Key:                  t.Name(),
+		MaxZoom:              19,
+		TileType:             "png",
+		Url:                  u.URL + "/{z}/{x}/{y}.png",
+		Timeout:              time.Hour,
+		StaleWhileRevalidate: true,
+	})
+
+	old := u.body
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	name := filepath.Join(cacheDir(p), "z10", "0", "x1", "0", "y1.png")
+	tm := time.Now().Add(-time.Hour * 2)
+
+	if err := os.Chtimes(name, tm, tm); err != nil {
+		t.Fatal(err)
+	}
+
+	newBody := []byte("\x89PNG\r\n\x1a\nnew")
+	u.set(func(u *upstream) { u.body = newBody })
+
+	for range 3 {
+		tile, err := p.GetTile(context.Background(), 10, 1, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if !bytes.Equal(tile.Data, old) {
+			t.Errorf("stale tile must be returned, got %q", tile.Data)
+		}
+	}
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := p.PendingRefreshes(); n != 0 {
+		t.Errorf("pending refreshes after close: %d", n)
+	}
+
+	if h := u.hits.Load(); h != 2 {
+		t.Errorf("upstream hits: got %d, must be 2", h)
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(b, newBody) {
+		t.Errorf("tile is not refreshed, got %q", b)
+	}
+}
+
+func TestRefresherCloseTimeout(t *testing.T) {
+	u := newUpstream(t, time.Millisecond*200)
+	defer u.Close()
+
+	p := mustProxy(t, &LayerDescription{
+		Key:                  t.Name(),
+		MaxZoom:              19,
+		TileType:             "png",
+		Url:                  u.URL + "/{z}/{x}/{y}.png",
+		Timeout:              time.Hour,
+		StaleWhileRevalidate: true,
+	})
+
+	// 40 slow refreshes take 2s with 4 workers
+	for i := range 40 {
+		p.refresher.Add(Tile{X: i, Y: 1, Z: 10})
+	}
+
+	start := time.Now()
+	p.refresher.close(time.Millisecond * 100)
+
+	if d := time.Since(start); d > time.Second {
+		t.Errorf("close took %s", d)
+	}
+
+	if n := p.PendingRefreshes(); n != 0 {
+		t.Errorf("pending refreshes after close: %d", n)
+	}
+
+	if h := u.hits.Load(); h > 8 {
+		t.Errorf("upstream hits: got %d, queued refreshes must be dropped", h)
+	}
+
+	// running downloads are canceled, nothing is written to the cache after close
+	start = time.Now()
+
+	if err := p.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if d := time.Since(start); d > time.Millisecond*100 {
+		t.Errorf("proxy close took %s", d)
+	}
+}
+
+func TestProxyNotFoundCache(t *testing.T) {
+	u := newUpstream(t, 0)
+	u.set(func(u *upstream) { u.status = http.StatusNotFound })
+
+	p := mustProxy(t, &LayerDescription{
+		Key:             t.Name(),
+		MaxZoom:         19,
+		TileType:        "png",
+		Url:             u.URL + "/{z}/{x}/{y}.png",
+		NotFoundTimeout: time.Hour,
+	})
+
+	for range 3 {
+		if _, err := p.GetTile(context.Background(), 10, 1, 1); !errors.Is(err, ErrNotFound) {
+			t.Fatalf("got %v, must be ErrNotFound", err)
+		}
+	}
+
+	if h := u.hits.Load(); h != 1 {
+		t.Errorf("upstream hits: got %d, must be 1", h)
+	}
+
+	n, err := p.PurgeNotFound()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n != 1 {
+		t.Errorf("removed %d markers, must be 1", n)
+	}
+
+	u.set(func(u *upstream) { u.status = 0 })
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if h := u.hits.Load(); h != 2 {
+		t.Errorf("upstream hits: got %d, must be 2", h)
+	}
+}
+
+func TestProxyRetry(t *testing.T) {
+	var hits atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		switch hits.Add(1) {
+		case 1:
+			w.WriteHeader(http.StatusBadGateway)
+		case 2:
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusTooManyRequests)
+		default:
+			_, _ = w.Write(pngTile)
+		}
+	}))
+	defer srv.Close()
+
+	p := mustProxy(t, &LayerDescription{
+		Key:        t.Name(),
+		MaxZoom:    19,
+		TileType:   "png",
+		Url:        srv.URL + "/{z}/{x}/{y}.png",
+		Retries:    3,
+		RetryDelay: time.Millisecond,
+	})
+
+	tile, err := p.GetTile(context.Background(), 10, 1, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tile.Data, pngTile) {
+		t.Errorf("wrong data %q", tile.Data)
+	}
+
+	if h := hits.Load(); h != 3 {
+		t.Errorf("upstream hits: got %d, must be 3", h)
+	}
+}
+
+func TestProxyRetryAfterBlocks(t *testing.T) {
+	var hits atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+		w.Header().Set("Retry-After", "3600")
+		w.WriteHeader(http.StatusTooManyRequests)
+	}))
+	defer srv.Close()
+
+	p := mustProxy(t, &LayerDescription{
+		Key:      t.Name(),
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      srv.URL + "/{z}/{x}/{y}.png",
+		Retries:  3,
+	})
+
+	// the limiter of the host would block other tests getting the same port
+	t.Cleanup(func() {
+		limitersMx.Lock()
+		delete(limiters, upstreamHost(srv.URL))
+		limitersMx.Unlock()
+	})
+
+	for i := range 3 {
+		_, err := p.GetTile(context.Background(), 10, 1, i)
+
+		var upErr *UpstreamError
+		if !errors.As(err, &upErr) {
+			t.Fatalf("got %v, must be upstream error", err)
+		}
+
+		// the layer is offline while upstream asked to wait
+		if i > 0 && !errors.Is(err, ErrOffline) {
+			t.Errorf("got %v, must be ErrOffline", err)
+		}
+	}
+
+	if h := hits.Load(); h != 1 {
+		t.Errorf("upstream hits: got %d, must be 1", h)
+	}
+}
+
+func TestProxyLimiterShared(t *testing.T) {
+	l := &LayerDescription{
+		Key:      t.Name(),
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      "https://{s}.limiter.test/{z}/{x}/{y}{r}.png",
+		Rps:      10,
+		MaxConns: 4,
+	}
+
+	p := mustProxy(t, l)
+	p2 := mustProxy(t, l.Retina())
+
+	other := *l
+	other.Key, other.Rps, other.MaxConns = t.Name()+"_other", 20, 2
+	p3 := mustProxy(t, &other)
+
+	if p.limiter != p2.limiter || p.limiter != p3.limiter {
+		t.Fatal("layers of the same host must share the limiter")
+	}
+
+	// 2x layer doesn't add its own limits, the strictest ones of two layers are used
+	if p.limiter.interval != time.Millisecond*100 || cap(p.limiter.sem) != 2 {
+		t.Errorf("got interval %s, %d conns", p.limiter.interval, cap(p.limiter.sem))
+	}
+
+	// the layer is made again with new limits
+	l.Rps, l.MaxConns = 5, 0
+	mustProxy(t, l)
+
+	if p.limiter.interval != time.Millisecond*200 || cap(p.limiter.sem) != 2 {
+		t.Errorf("got interval %s, %d conns after update", p.limiter.interval, cap(p.limiter.sem))
+	}
+}
+
+func TestProxyMaxConns(t *testing.T) {
+	var cur, maxCur atomic.Int32
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		n := cur.Add(1)
+		defer cur.Add(-1)
+
+		for {
+			m := maxCur.Load()
+			if n <= m || maxCur.CompareAndSwap(m, n) {
+				break
+			}
+		}
+
+		time.Sleep(time.Millisecond * 20)
+		_, _ = w.Write(pngTile)
+	}))
+	defer srv.Close()
+
+	p := mustProxy(t, &LayerDescription{
+		Key:      t.Name(),
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      srv.URL + "/{z}/{x}/{y}.png",
+		MaxConns: 2,
+	})
+
+	wg := new(sync.WaitGroup)
+
+	for i := range 10 {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			if _, err := p.GetTile(context.Background(), 10, 1, i); err != nil {
+				t.Error(err)
+			}
+		}()
+	}
+
+	wg.Wait()
+
+	if m := maxCur.Load(); m > 2 {
+		t.Errorf("max concurrent requests: got %d, must be <= 2", m)
+	}
+}
+
+func TestProxyBreaker(t *testing.T) {
+	u := newUpstream(t, 0)
+	u.set(func(u *upstream) { u.status = http.StatusInternalServerError })
+
+	p := mustProxy(t, &LayerDescription{
+		Key:              t.Name(),
+		MaxZoom:          19,
+		TileType:         "png",
+		Url:              u.URL + "/{z}/{x}/{y}.png",
+		BreakerThreshold: 2,
+		BreakerCooldown:  time.Millisecond * 50,
+	})
+
+	for i := range 2 {
+		var upErr *UpstreamError
+		if _, err := p.GetTile(context.Background(), 10, 1, i); !errors.As(err, &upErr) {
+			t.Fatalf("got %v, must be upstream error", err)
+		}
+	}
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 3); !errors.Is(err, ErrOffline) {
+		t.Fatalf("got %v, must be ErrOffline", err)
+	}
+
+	if _, state := p.State(); state != stateOpen {
+		t.Errorf("state: got %s, must be %s", state, stateOpen)
+	}
+
+	if h := u.hits.Load(); h != 2 {
+		t.Errorf("upstream hits: got %d, must be 2", h)
+	}
+
+	time.Sleep(time.Millisecond * 60)
+	u.set(func(u *upstream) { u.status = 0 })
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 3); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, state := p.State(); state != stateClosed {
+		t.Errorf("state: got %s, must be %s", state, stateClosed)
+	}
+
+	p.SetMode(ModeOffline)
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 4); !errors.Is(err, ErrOffline) {
+		t.Errorf("got %v, must be ErrOffline", err)
+	}
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 3); err != nil {
+		t.Errorf("cached tile must be served offline: %v", err)
+	}
+}
+
+func TestProxyRequestSettings(t *testing.T) {
+	var req *http.Request
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r
+		_, _ = w.Write(pngTile)
+	}))
+	defer srv.Close()
+
+	t.Setenv("TEST_TOKEN", "secret")
+	t.Setenv("TEST_KEY", "key1")
+
+	p := mustProxy(t, &LayerDescription{
+		Key:      t.Name(),
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      srv.URL + "/{z}/{x}/{y}.png?a=1",
+		Headers: map[string]string{
+			"Authorization": "Bearer ${TEST_TOKEN}",
+			"Referer":       "https://example.com/",
+		},
+		QueryEnv: map[string]string{"apikey": "TEST_KEY"},
+	})
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if v := req.Header.Get("Authorization"); v != "Bearer secret" {
+		t.Errorf("wrong Authorization header %s", v)
+	}
+
+	if v := req.Header.Get("Referer"); v != "https://example.com/" {
+		t.Errorf("wrong Referer header %s", v)
+	}
+
+	if v := req.Header.Get("User-Agent"); v != defaultUserAgent {
+		t.Errorf("wrong User-Agent header %s", v)
+	}
+
+	if v := req.URL.Query().Get("apikey"); v != "key1" {
+		t.Errorf("wrong apikey %s", v)
+	}
+
+	if v := req.URL.Query().Get("a"); v != "1" {
+		t.Errorf("wrong a %s", v)
+	}
+
+	if _, err := NewProxy(&LayerDescription{Key: "x", QueryEnv: map[string]string{"k": "NO_SUCH_ENV_VAR"}}, slog.Default(), t.TempDir()); err == nil {
+		t.Error("missing environment variable must be an error")
+	}
+}
+
+func TestProxyTLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(pngTile)
+	}))
+	defer srv.Close()
+
+	l := &LayerDescription{
+		Key:      t.Name(),
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      srv.URL + "/{z}/{x}/{y}.png",
+	}
+
+	if _, err := mustProxy(t, l).GetTile(context.Background(), 10, 1, 1); err == nil {
+		t.Error("unknown certificate must be rejected")
+	}
+
+	ca := filepath.Join(t.TempDir(), "ca.pem")
+	b := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+
+	if err := os.WriteFile(ca, b, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	l.CaFile = ca
+
+	if _, err := mustProxy(t, l).GetTile(context.Background(), 10, 1, 1); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestProxyValidation(t *testing.T) {
+	u := newUpstream(t, 0)
+	noData := []byte("\x89PNG\r\n\x1a\nempty")
+
+	p := mustProxy(t, &LayerDescription{
+		Key:              t.Name(),
+		MaxZoom:          19,
+		TileType:         "png",
+		Url:              u.URL + "/{z}/{x}/{y}.png",
+		NoDataHashes:     []string{contentHash(noData)},
+		NotFoundTimeout:  time.Hour,
+		BreakerThreshold: 1,
+	})
+
+	for i, body := range []string{"<html><body>login</body></html>", "\x89PNG"} {
+		u.set(func(u *upstream) { u.body = []byte(body) })
+
+		_, err := p.GetTile(context.Background(), 10, 1, i)
+
+		var upErr *UpstreamError
+		if !errors.As(err, &upErr) || !errors.Is(err, errInvalidTile) {
+			t.Errorf("%q: got %v, must be invalid tile upstream error", body, err)
+		}
+
+		if _, err := os.Stat(filepath.Join(cacheDir(p), "z10", "0", "x1", "0", fmt.Sprintf("y%d.png", i))); err == nil {
+			t.Errorf("%q: invalid tile is cached", body)
+		}
+	}
+
+	if _, state := p.State(); state != stateClosed {
+		t.Errorf("invalid tiles must not open the breaker, state is %s", state)
+	}
+
+	u.set(func(u *upstream) { u.body = noData })
+
+	for range 2 {
+		if _, err := p.GetTile(context.Background(), 10, 1, 5); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v, must be ErrNotFound", err)
+		}
+	}
+
+	if h := u.hits.Load(); h != 3 {
+		t.Errorf("upstream hits: got %d, must be 3, no data tile must be marked as not found", h)
+	}
+
+	u.set(func(u *upstream) { u.body = pngTile })
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 1); err != nil {
+		t.Error(err)
+	}
+}
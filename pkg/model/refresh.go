@@ -0,0 +1,135 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	refreshWorkers   = 4
+	refreshQueueSize = 1024
+	// refreshCloseTimeout is how long Close waits for queued refreshes, the rest are dropped
+	refreshCloseTimeout = 5 * time.Second
+)
+
+// refresher is a bounded worker pool downloading stale proxy tiles in background.
+type refresher struct {
+	p       *Proxy
+	ch      chan Tile
+	pending atomic.Int64
+	wg      sync.WaitGroup
+	ctx     context.Context
+	cancel  context.CancelFunc
+
+	mx     sync.RWMutex
+	closed bool
+}
+
+func newRefresher(p *Proxy, workers, queueSize int) *refresher {
+	r := &refresher{
+		p:  p,
+		ch: make(chan Tile, queueSize),
+	}
+
+	r.ctx, r.cancel = context.WithCancel(context.Background())
+
+	for range workers {
+		r.wg.Add(1)
+		go r.worker()
+	}
+
+	return r
+}
+
+// Add queues the tile refresh, the job is dropped if the queue is full or the refresher is closed.
+func (r *refresher) Add(t Tile) {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+
+	if r.closed {
+		return
+	}
+
+	r.pending.Add(1)
+
+	select {
+	case r.ch <- t:
+	default:
+		r.pending.Add(-1)
+		r.p.logger.Debug("refresh queue is full")
+	}
+}
+
+func (r *refresher) Pending() int64 {
+	return r.pending.Load()
+}
+
+// Close stops accepting new jobs and waits until queued ones are done, for refreshCloseTimeout at most. Then
+// running downloads are canceled and the rest of the queue is dropped.
+func (r *refresher) Close() {
+	r.close(refreshCloseTimeout)
+}
+
+func (r *refresher) close(timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	r.shutdown(ctx)
+}
+
+// shutdown is Close waiting for queued jobs until ctx is done.
+func (r *refresher) shutdown(ctx context.Context) {
+	r.mx.Lock()
+
+	if r.closed {
+		r.mx.Unlock()
+		return
+	}
+
+	r.closed = true
+	close(r.ch)
+	r.mx.Unlock()
+
+	done := make(chan struct{})
+
+	go func() {
+		r.wg.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-ctx.Done():
+		r.p.logger.Warn("background refreshes are canceled", "pending", r.pending.Load())
+		r.cancel()
+		<-done
+	}
+
+	r.cancel()
+}
+
+func (r *refresher) worker() {
+	defer r.wg.Done()
+
+	for t := range r.ch {
+		if r.ctx.Err() == nil {
+			r.refresh(t)
+		}
+
+		r.pending.Add(-1)
+	}
+}
+
+func (r *refresher) refresh(t Tile) {
+	// the same tile can be queued several times, skip it if it is already refreshed
+	if info, err := r.p.store.Stat(r.ctx, t); err == nil && !info.Missing && info.ModTime.Add(r.p.timeout).After(time.Now()) {
+		return
+	}
+
+	if _, err := r.p.fetch(r.ctx, t, true); err != nil && !errors.Is(err, ErrOffline) && r.ctx.Err() == nil {
+		r.p.logger.Warn("background refresh error", "error", err)
+	}
+}
@@ -0,0 +1,245 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"math"
+	"sync"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/math/f64"
+
+	"github.com/kdudkov/tileproxy/pkg/mapper"
+)
+
+const (
+	// maxRenderTiles limits the number of tiles fetched for one map
+	maxRenderTiles = 400
+	// renderWorkers is the number of tiles fetched at once
+	renderWorkers = 8
+)
+
+// MapRequest is a map image of the box in EPSG:3857 meters, or in EPSG:4326 lon/lat degrees if Geographic is set.
+type MapRequest struct {
+	// BBox is minx, miny, maxx, maxy.
+	BBox       [4]float64
+	Geographic bool
+	Width      int
+	Height     int
+}
+
+// RenderMap renders the source tiles covering the box to the image of the requested size. The zoom is the one
+// with tiles not smaller than the image pixels, within the source zoom range. Lower zooms are used if the map
+// needs too many tiles, ErrTooLarge is returned if even the min zoom needs too many.
+// Tiles of the offline source or failed upstream are left transparent, their number is returned.
+func RenderMap(ctx context.Context, src Source, req MapRequest) (*image.RGBA, int, error) {
+	if req.Width <= 0 || req.Height <= 0 || req.BBox[0] >= req.BBox[2] || req.BBox[1] >= req.BBox[3] {
+		return nil, 0, fmt.Errorf("invalid map request %v", req)
+	}
+
+	ts := mapper.NewTileSystem()
+	tileSize := float64(ts.TileSize())
+
+	// box corners in zoom 0 pixels
+	x0, y0, x1, y1 := req.pixels(ts)
+
+	z := int(math.Ceil(math.Log2(max(float64(req.Width)/(x1-x0), float64(req.Height)/(y1-y0))) - 1e-6))
+	z = max(src.GetMinZoom(), min(z, src.GetMaxZoom()))
+
+	tiles := renderTiles(x0, y0, x1, y1, z, tileSize)
+
+	for z > src.GetMinZoom() && tiles.count() > maxRenderTiles {
+		z--
+		tiles = renderTiles(x0, y0, x1, y1, z, tileSize)
+	}
+
+	dst := image.NewRGBA(image.Rect(0, 0, req.Width, req.Height))
+
+	if tiles.XMin > tiles.XMax || tiles.YMin > tiles.YMax {
+		return dst, 0, nil
+	}
+
+	if n := tiles.count(); n > maxRenderTiles {
+		return nil, 0, fmt.Errorf("%w: %d tiles at zoom %d", ErrTooLarge, n, z)
+	}
+
+	scale := math.Pow(2, float64(z))
+
+	mosaic, skipped, err := fetchMosaic(ctx, src, z, tiles, ts.TileSize())
+
+	if err != nil {
+		return nil, 0, err
+	}
+
+	// mosaic pixel of zoom 0 pixel p is p*scale - offset
+	offX, offY := float64(tiles.XMin)*tileSize, float64(tiles.YMin)*tileSize
+	kx := float64(req.Width) / ((x1 - x0) * scale)
+
+	if !req.Geographic {
+		ky := float64(req.Height) / ((y1 - y0) * scale)
+		m := f64.Aff3{kx, 0, -(x0*scale - offX) * kx, 0, ky, -(y0*scale - offY) * ky}
+		draw.BiLinear.Transform(dst, m, mosaic, mosaic.Bounds(), draw.Src, nil)
+
+		return dst, skipped, nil
+	}
+
+	// latitude is not linear in mercator, so each row is transformed with its own scale
+	dLat := (req.BBox[3] - req.BBox[1]) / float64(req.Height)
+
+	for j := range req.Height {
+		top, bottom := req.BBox[3]-float64(j)*dLat, req.BBox[3]-float64(j+1)*dLat
+
+		if bottom >= maxLat || top <= -maxLat {
+			continue
+		}
+
+		_, ty := ts.LatLon2XY(min(top, maxLat), 0, 0)
+		_, by := ts.LatLon2XY(max(bottom, -maxLat), 0, 0)
+
+		ky := 1 / ((by - ty) * scale)
+		m := f64.Aff3{kx, 0, -(x0*scale - offX) * kx, 0, ky, float64(j) - (ty*scale-offY)*ky}
+		row := dst.SubImage(image.Rect(0, j, req.Width, j+1)).(*image.RGBA)
+		draw.BiLinear.Transform(row, m, mosaic, mosaic.Bounds(), draw.Src, nil)
+	}
+
+	return dst, skipped, nil
+}
+
+// renderTiles returns tiles of the zoom covering the box of zoom 0 pixels.
+func renderTiles(x0, y0, x1, y1 float64, z int, tileSize float64) TileBounds {
+	scale := math.Pow(2, float64(z))
+	n := 1 << z
+
+	return TileBounds{
+		XMin: max(0, int(x0*scale/tileSize)),
+		YMin: max(0, int(y0*scale/tileSize)),
+		XMax: min(n-1, int(math.Ceil(x1*scale/tileSize))-1),
+		YMax: min(n-1, int(math.Ceil(y1*scale/tileSize))-1),
+	}
+}
+
+// pixels returns the box in zoom 0 pixels, latitudes beyond the mercator limit are cut.
+func (r MapRequest) pixels(ts *mapper.TileSystem) (float64, float64, float64, float64) {
+	if r.Geographic {
+		x0, y0 := ts.LatLon2XY(min(r.BBox[3], maxLat), r.BBox[0], 0)
+		x1, y1 := ts.LatLon2XY(max(r.BBox[1], -maxLat), r.BBox[2], 0)
+
+		return x0, y0, x1, y1
+	}
+
+	x0, y0 := ts.Mercator2XY(r.BBox[0], r.BBox[3], 0)
+	x1, y1 := ts.Mercator2XY(r.BBox[2], r.BBox[1], 0)
+
+	return x0, y0, x1, y1
+}
+
+// fetchMosaic gets the tiles in parallel and draws them to one image. Missing tiles are left transparent,
+// as well as tiles of the offline source or failed upstream, they are counted in skipped. Other errors fail
+// the mosaic, the first skipped tile error is returned if all the tiles failed.
+func fetchMosaic(ctx context.Context, src Source, z int, tiles TileBounds, tileSize int) (*image.RGBA, int, error) {
+	mosaic := image.NewRGBA(image.Rect(0, 0, (tiles.XMax-tiles.XMin+1)*tileSize, (tiles.YMax-tiles.YMin+1)*tileSize))
+
+	if b, ok, _ := sourceBounds(src, z); !ok || !b.intersects(tiles) {
+		return mosaic, 0, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		mx       sync.Mutex
+		firstErr error
+		skipErr  error
+		skipped  int
+		drawn    int
+	)
+
+	sem := make(chan struct{}, renderWorkers)
+
+	for y := tiles.YMin; y <= tiles.YMax; y++ {
+		for x := tiles.XMin; x <= tiles.XMax; x++ {
+			wg.Add(1)
+			sem <- struct{}{}
+
+			go func() {
+				defer func() {
+					<-sem
+					wg.Done()
+				}()
+
+				r := image.Rect(0, 0, tileSize, tileSize).Add(image.Pt((x-tiles.XMin)*tileSize, (y-tiles.YMin)*tileSize))
+
+				ok, err := drawTile(ctx, src, z, x, y, mosaic, r)
+
+				mx.Lock()
+				defer mx.Unlock()
+
+				switch {
+				case err == nil:
+					if ok {
+						drawn++
+					}
+				case isTileFailure(err):
+					if skipErr == nil {
+						skipErr = err
+					}
+
+					skipped++
+				case firstErr == nil:
+					firstErr = err
+					cancel()
+				}
+			}()
+		}
+	}
+
+	wg.Wait()
+
+	if firstErr != nil {
+		return nil, 0, firstErr
+	}
+
+	if skipped > 0 && drawn == 0 {
+		return nil, 0, skipErr
+	}
+
+	return mosaic, skipped, nil
+}
+
+// isTileFailure checks if the tile error is the one of the offline source or failed upstream, not an internal one.
+func isTileFailure(err error) bool {
+	var upErr *UpstreamError
+
+	return errors.Is(err, ErrOffline) || errors.As(err, &upErr)
+}
+
+// drawTile draws the tile to the rect of the mosaic, scaling it if the tile has another size.
+// Missing tiles are not drawn and not reported as errors.
+func drawTile(ctx context.Context, src Source, z, x, y int, mosaic *image.RGBA, r image.Rectangle) (bool, error) {
+	td, err := src.GetTile(ctx, z, x, y)
+
+	if errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfRange) || errors.Is(err, ErrOutOfBounds) {
+		return false, nil
+	}
+
+	if err != nil {
+		return false, err
+	}
+
+	img, _, err := decodeTile(td.Data)
+
+	if err != nil {
+		return false, internalError(err)
+	}
+
+	if img.Bounds().Size() == r.Size() {
+		draw.Draw(mosaic, r, img, img.Bounds().Min, draw.Src)
+	} else {
+		draw.ApproxBiLinear.Scale(mosaic, r, img, img.Bounds(), draw.Src, nil)
+	}
+
+	return true, nil
+}
@@ -0,0 +1,205 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"image/color"
+	"testing"
+	"time"
+)
+
+// stripeSource returns red tiles for even x and blue ones for odd x.
+type stripeSource struct {
+	testSource
+
+	red, blue []byte
+}
+
+func (s *stripeSource) GetTile(_ context.Context, _, x, _ int) (*TileData, error) {
+	s.calls.Add(1)
+
+	if x%2 == 0 {
+		return NewTileData("image/png", s.red, time.Now()), nil
+	}
+
+	return NewTileData("image/png", s.blue, time.Now()), nil
+}
+
+func TestRenderMap(t *testing.T) {
+	s := &stripeSource{
+		red:  solidPNG(t, color.RGBA{R: 255, A: 255}),
+		blue: solidPNG(t, color.RGBA{B: 255, A: 255}),
+	}
+
+	const m = 20037508.342789244
+
+	img, _, err := RenderMap(context.Background(), s, MapRequest{BBox: [4]float64{-m, -m, m, m}, Width: 512, Height: 512})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.calls.Load() != 4 {
+		t.Errorf("got %d tiles, want 4 of zoom 1", s.calls.Load())
+	}
+
+	if c := img.RGBAAt(100, 400); c.R != 255 || c.B != 0 {
+		t.Errorf("wrong left color %v", c)
+	}
+
+	if c := img.RGBAAt(400, 100); c.B != 255 || c.R != 0 {
+		t.Errorf("wrong right color %v", c)
+	}
+
+	// half of the world is one zoom 0 tile
+	s.calls.Store(0)
+
+	img, _, err = RenderMap(context.Background(), s, MapRequest{BBox: [4]float64{-m, 0, 0, m}, Width: 128, Height: 128})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.calls.Load() != 1 {
+		t.Errorf("got %d tiles, want 1", s.calls.Load())
+	}
+
+	if c := img.RGBAAt(127, 127); c.R != 255 || c.A != 255 {
+		t.Errorf("wrong color %v", c)
+	}
+}
+
+// deepSource has tiles from zoom 10 only.
+type deepSource struct {
+	stripeSource
+}
+
+func (s *deepSource) GetMinZoom() int { return 10 }
+
+func TestRenderMapTooLarge(t *testing.T) {
+	s := &stripeSource{
+		red:  solidPNG(t, color.RGBA{R: 255, A: 255}),
+		blue: solidPNG(t, color.RGBA{B: 255, A: 255}),
+	}
+
+	const m = 20037508.342789244
+
+	// a bit less than the world would take zoom 5 with 1024 tiles, zoom 4 is used instead
+	img, _, err := RenderMap(context.Background(), s, MapRequest{BBox: [4]float64{-m * 0.99, -m * 0.99, m * 0.99, m * 0.99}, Width: 4096, Height: 256})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.calls.Load(); n != 256 {
+		t.Errorf("got %d tiles, want 256 of zoom 4", n)
+	}
+
+	if c := img.RGBAAt(2048, 128); c.A != 255 {
+		t.Errorf("wrong color %v", c)
+	}
+
+	d := &deepSource{stripeSource: stripeSource{red: s.red, blue: s.blue}}
+
+	if _, _, err := RenderMap(context.Background(), d, MapRequest{BBox: [4]float64{-m, -m, m, m}, Width: 256, Height: 256}); !errors.Is(err, ErrTooLarge) {
+		t.Errorf("got %v, must be ErrTooLarge", err)
+	}
+
+	if n := d.calls.Load(); n != 0 {
+		t.Errorf("got %d tiles, want none", n)
+	}
+}
+
+func TestRenderMapGeographic(t *testing.T) {
+	s := &stripeSource{
+		red:  solidPNG(t, color.RGBA{R: 255, A: 255}),
+		blue: solidPNG(t, color.RGBA{B: 255, A: 255}),
+	}
+
+	img, _, err := RenderMap(context.Background(), s, MapRequest{
+		BBox:       [4]float64{-180, -90, 180, 90},
+		Geographic: true,
+		Width:      360,
+		Height:     180,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// rows beyond the mercator limit are empty
+	if c := img.RGBAAt(10, 2); c.A != 0 {
+		t.Errorf("wrong polar color %v", c)
+	}
+
+	if c := img.RGBAAt(10, 90); c.R != 255 || c.A != 255 {
+		t.Errorf("wrong left color %v", c)
+	}
+
+	if c := img.RGBAAt(350, 90); c.B != 255 || c.A != 255 {
+		t.Errorf("wrong right color %v", c)
+	}
+
+	if _, _, err := RenderMap(context.Background(), s, MapRequest{BBox: [4]float64{10, 0, 0, 10}, Width: 10, Height: 10}); err == nil {
+		t.Error("expected error for an empty box")
+	}
+}
+
+// holeSource returns red tiles for even x and fails odd x tiles with the error.
+type holeSource struct {
+	stripeSource
+
+	err error
+}
+
+func (s *holeSource) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	if x%2 == 1 {
+		return nil, s.err
+	}
+
+	return s.stripeSource.GetTile(ctx, z, x, y)
+}
+
+func TestRenderMapFailedTiles(t *testing.T) {
+	const m = 20037508.342789244
+
+	req := MapRequest{BBox: [4]float64{-m, -m, m, m}, Width: 512, Height: 512}
+	red := solidPNG(t, color.RGBA{R: 255, A: 255})
+
+	for _, err := range []error{ErrNotFound, ErrOutOfBounds, ErrOffline, &UpstreamError{Url: "http://up", Status: 500}} {
+		s := &holeSource{stripeSource: stripeSource{red: red}, err: err}
+
+		img, skipped, rerr := RenderMap(context.Background(), s, req)
+		if rerr != nil {
+			t.Fatalf("%v: got %v", err, rerr)
+		}
+
+		// missing tiles are not failures
+		want := 2
+
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfBounds) {
+			want = 0
+		}
+
+		if skipped != want {
+			t.Errorf("%v: got %d skipped tiles, must be %d", err, skipped, want)
+		}
+
+		if c := img.RGBAAt(100, 400); c.R != 255 {
+			t.Errorf("%v: wrong left color %v", err, c)
+		}
+
+		if c := img.RGBAAt(400, 100); c.A != 0 {
+			t.Errorf("%v: got right color %v, must be transparent", err, c)
+		}
+	}
+
+	s := &holeSource{stripeSource: stripeSource{red: red}, err: internalError(errors.New("disk error"))}
+
+	if _, _, err := RenderMap(context.Background(), s, req); !errors.Is(err, ErrInternal) {
+		t.Errorf("got %v, must be ErrInternal", err)
+	}
+
+	// the map of failed tiles only is the failure
+	o := &errorSource{err: ErrOffline}
+
+	if _, _, err := RenderMap(context.Background(), o, req); !errors.Is(err, ErrOffline) {
+		t.Errorf("got %v, must be ErrOffline", err)
+	}
+}
@@ -0,0 +1,110 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"sync"
+)
+
+// RetinaSuffix is added to the tile y and to the layer key for 2x tiles.
+const RetinaSuffix = "@2x"
+
+var _ Source = &Retina{}
+
+// Retina makes 2x tiles by stitching four child tiles of the source.
+// Above the source max zoom, or where there are no children, the tile itself is upscaled.
+type Retina struct {
+	Source
+}
+
+func NewRetina(src Source) *Retina {
+	return &Retina{Source: src}
+}
+
+func (r *Retina) GetKey() string {
+	return r.Source.GetKey() + RetinaSuffix
+}
+
+func (r *Retina) GetName() string {
+	return r.Source.GetName() + " " + RetinaSuffix
+}
+
+func (r *Retina) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	if z < r.GetMinZoom() || z > r.GetMaxZoom() {
+		return nil, ErrOutOfRange
+	}
+
+	if z < r.Source.GetMaxZoom() {
+		children, err := getChildren(ctx, r.Source, z, x, y)
+
+		if err != nil {
+			return nil, err
+		}
+
+		td, err := mergeChildren(children, 2)
+
+		if !errors.Is(err, ErrNotFound) {
+			return td, err
+		}
+	}
+
+	td, err := r.Source.GetTile(ctx, z, x, y)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return upscale(td, 0, 0, 0, 2)
+}
+
+// Touch passes the use of child tiles the 2x tile is made of to the source.
+func (r *Retina) Touch(t Tile) {
+	if t.Z >= r.Source.GetMaxZoom() {
+		touch(r.Source, t)
+
+		return
+	}
+
+	for i := range 4 {
+		touch(r.Source, Tile{X: t.X*2 + i%2, Y: t.Y*2 + i/2, Z: t.Z + 1})
+	}
+}
+
+func (r *Retina) Unwrap() Source {
+	return r.Source
+}
+
+// getChildren gets four child tiles of the tile at once, missing children are nil.
+func getChildren(ctx context.Context, src Source, z, x, y int) ([4]*TileData, error) {
+	var (
+		children [4]*TileData
+		errs     [4]error
+		wg       sync.WaitGroup
+	)
+
+	for i := range children {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			td, err := src.GetTile(ctx, z+1, 2*x+i%2, 2*y+i/2)
+
+			if errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfBounds) {
+				return
+			}
+
+			children[i], errs[i] = td, err
+		}()
+	}
+
+	wg.Wait()
+
+	for _, err := range errs {
+		if err != nil {
+			return children, err
+		}
+	}
+
+	return children, nil
+}
@@ -0,0 +1,150 @@
+package model
+
+import (
+	"context"
+	"image/color"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRetina(t *testing.T) {
+	r := NewRetina(&imageSource{})
+
+	if k := r.GetKey(); k != "test@2x" {
+		t.Errorf("got key %s, must be test@2x", k)
+	}
+
+	// z1 tiles with x = 1 are missing
+	td, err := r.GetTile(context.Background(), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, _, err := decodeTile(td.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds().Dx() != 512 || img.Bounds().Dy() != 512 {
+		t.Fatalf("wrong tile size %v", img.Bounds())
+	}
+
+	for _, c := range []struct {
+		x, y int
+		c    color.RGBA
+	}{
+		{x: 64, y: 64, c: quadrantColors[0]},
+		{x: 192, y: 192, c: quadrantColors[3]},
+		{x: 64, y: 448, c: quadrantColors[2]},
+		{x: 448, y: 64, c: color.RGBA{}},
+	} {
+		if got := color.RGBAModel.Convert(img.At(c.x, c.y)).(color.RGBA); got != c.c {
+			t.Errorf("%d,%d: got color %v, must be %v", c.x, c.y, got, c.c)
+		}
+	}
+
+	// max zoom tile is upscaled
+	td, err = r.GetTile(context.Background(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	img, _, err = decodeTile(td.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if img.Bounds().Dx() != 512 {
+		t.Errorf("wrong tile size %v", img.Bounds())
+	}
+
+	if got := color.RGBAModel.Convert(img.At(400, 100)).(color.RGBA); got != quadrantColors[1] {
+		t.Errorf("got color %v, must be %v", got, quadrantColors[1])
+	}
+}
+
+func TestRetinaUrl(t *testing.T) {
+	l := &LayerDescription{
+		Key:      t.Name(),
+		MaxZoom:  19,
+		TileType: "png",
+		Url:      "http://example.com/{z}/{x}/{y}{r}.png?scale={scale}",
+	}
+
+	if !l.HasRetina() {
+		t.Fatal("layer must have retina")
+	}
+
+	p := mustProxy(t, l)
+
+	if u := p.GetUrl(1, 2, 3); u != "http://example.com/1/2/3.png?scale=1" {
+		t.Errorf("wrong url %s", u)
+	}
+
+	p2 := mustProxy(t, l.Retina())
+
+	if u := p2.GetUrl(1, 2, 3); u != "http://example.com/1/2/3@2x.png?scale=2" {
+		t.Errorf("wrong url %s", u)
+	}
+
+	if p2.GetKey() != t.Name()+RetinaSuffix {
+		t.Errorf("wrong key %s", p2.GetKey())
+	}
+}
+
+// concurrency counts max concurrent requests.
+type concurrency struct {
+	running atomic.Int32
+	max     atomic.Int32
+}
+
+func (c *concurrency) enter() {
+	n := c.running.Add(1)
+
+	for {
+		m := c.max.Load()
+
+		if n <= m || c.max.CompareAndSwap(m, n) {
+			return
+		}
+	}
+}
+
+func (c *concurrency) exit() {
+	c.running.Add(-1)
+}
+
+// slowSource is a colorSource answering after the delay.
+type slowSource struct {
+	*colorSource
+
+	delay time.Duration
+	conc  *concurrency
+}
+
+func (s *slowSource) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	s.conc.enter()
+	defer s.conc.exit()
+
+	time.Sleep(s.delay)
+
+	return s.colorSource.GetTile(ctx, z, x, y)
+}
+
+func TestRetinaConcurrent(t *testing.T) {
+	s := &slowSource{colorSource: newColorSource(t, "test", color.RGBA{R: 255, A: 255}), delay: time.Millisecond * 100, conc: &concurrency{}}
+	r := NewRetina(s)
+
+	if _, err := r.GetTile(context.Background(), 3, 1, 1); err != nil {
+		t.Fatal(err)
+	}
+
+	if n := s.conc.max.Load(); n != 4 {
+		t.Errorf("children are not fetched at once, %d concurrent requests", n)
+	}
+
+	if n := s.calls.Load(); n != 4 {
+		t.Errorf("got %d calls, want 4", n)
+	}
+}
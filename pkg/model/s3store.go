@@ -0,0 +1,388 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/credentials"
+)
+
+const (
+	metaFetched      = "fetched"
+	metaEtag         = "upstream-etag"
+	metaLastModified = "upstream-last-modified"
+	metaMissing      = "missing"
+)
+
+// S3Config is the S3 compatible object storage used as the layer cache.
+// Endpoint, keys and bucket may refer environment variables as ${NAME}.
+type S3Config struct {
+	Endpoint string `yaml:"endpoint"`
+	Region   string `yaml:"region"`
+	Bucket   string `yaml:"bucket"`
+	// Prefix is prepended to object keys, the layer key by default.
+	Prefix string `yaml:"prefix"`
+	// AccessKey and SecretKey default to AWS_ACCESS_KEY_ID/AWS_SECRET_ACCESS_KEY, aws credentials file or IAM.
+	AccessKey string `yaml:"accessKey"`
+	SecretKey string `yaml:"secretKey"`
+	// Insecure makes plain http connection to the endpoint.
+	Insecure bool `yaml:"insecure"`
+	// Layout is the object keys layout, sasplanet (default) or flat.
+	Layout string `yaml:"layout"`
+}
+
+// objectInfo is the object storage object description, metadata keys are lowercase.
+type objectInfo struct {
+	Key          string
+	Size         int64
+	LastModified time.Time
+	Metadata     map[string]string
+}
+
+// objectStorage is the part of the object storage api used by S3Store.
+// Missing objects are reported as ErrNotFound.
+type objectStorage interface {
+	Get(ctx context.Context, key string) ([]byte, objectInfo, error)
+	Stat(ctx context.Context, key string) (objectInfo, error)
+	Put(ctx context.Context, key string, r io.Reader, size int64, contentType string, meta map[string]string) error
+	// SetMetadata replaces the object metadata keeping its data.
+	SetMetadata(ctx context.Context, key, contentType string, meta map[string]string) error
+	Remove(ctx context.Context, key string) error
+	// List calls fn for all objects with the prefix until it returns false, metadata is not filled.
+	List(ctx context.Context, prefix string, fn func(o objectInfo) bool) error
+}
+
+var _ TileStore = &S3Store{}
+
+// S3Store keeps tiles in S3 compatible object storage, so several tileproxy instances can share the cache.
+// Fetch time and upstream validators are kept in the object metadata, the "tile not exists" marker
+// is an empty object with "missing" metadata at the tile key.
+type S3Store struct {
+	st          objectStorage
+	prefix      string
+	ext         string
+	contentType string
+	tms         bool
+	layout      keyLayout
+}
+
+// NewS3Store creates the store, prefix is used if the config has no prefix.
+func NewS3Store(cfg S3Config, prefix, ext string, tms bool) (*S3Store, error) {
+	st, err := newMinioStorage(cfg)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if cfg.Prefix != "" {
+		prefix = os.ExpandEnv(cfg.Prefix)
+	}
+
+	return newS3Store(st, prefix, cfg.Layout, ext, tms)
+}
+
+func newS3Store(st objectStorage, prefix, layout, ext string, tms bool) (*S3Store, error) {
+	l, err := getLayout(layout)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if prefix != "" && !strings.HasSuffix(prefix, "/") {
+		prefix += "/"
+	}
+
+	ct := mime.TypeByExtension("." + ext)
+
+	if ct == "" {
+		ct = "application/octet-stream"
+	}
+
+	return &S3Store{
+		st:          st,
+		prefix:      prefix,
+		ext:         ext,
+		contentType: ct,
+		tms:         tms,
+		layout:      l,
+	}, nil
+}
+
+func (s *S3Store) key(t Tile) string {
+	if s.tms {
+		t = flipY(t)
+	}
+
+	return s.prefix + s.layout.format(t) + "." + s.ext
+}
+
+func (s *S3Store) Get(ctx context.Context, t Tile) ([]byte, *TileInfo, error) {
+	data, o, err := s.st.Get(ctx, s.key(t))
+
+	if err != nil {
+		return nil, nil, err
+	}
+
+	info := objectTileInfo(o)
+
+	if info.Missing {
+		return nil, info, nil
+	}
+
+	return data, info, nil
+}
+
+func (s *S3Store) Stat(ctx context.Context, t Tile) (*TileInfo, error) {
+	o, err := s.st.Stat(ctx, s.key(t))
+
+	if err != nil {
+		return nil, err
+	}
+
+	return objectTileInfo(o), nil
+}
+
+func objectTileInfo(o objectInfo) *TileInfo {
+	info := &TileInfo{
+		Size:    o.Size,
+		ModTime: o.LastModified,
+		Meta:    TileMeta{ETag: o.Metadata[metaEtag], LastModified: o.Metadata[metaLastModified]},
+		Missing: o.Metadata[metaMissing] != "",
+	}
+
+	if n, err := strconv.ParseInt(o.Metadata[metaFetched], 10, 64); err == nil {
+		info.ModTime = time.Unix(n, 0)
+	}
+
+	return info
+}
+
+func (s *S3Store) Put(ctx context.Context, t Tile, data []byte, meta TileMeta) error {
+	m := map[string]string{metaFetched: strconv.FormatInt(time.Now().Unix(), 10)}
+
+	if meta.ETag != "" {
+		m[metaEtag] = meta.ETag
+	}
+
+	if meta.LastModified != "" {
+		m[metaLastModified] = meta.LastModified
+	}
+
+	return s.st.Put(ctx, s.key(t), bytes.NewReader(data), int64(len(data)), s.contentType, m)
+}
+
+func (s *S3Store) PutMissing(ctx context.Context, t Tile) error {
+	m := map[string]string{metaFetched: strconv.FormatInt(time.Now().Unix(), 10), metaMissing: "1"}
+
+	return s.st.Put(ctx, s.key(t), bytes.NewReader(nil), 0, s.contentType, m)
+}
+
+func (s *S3Store) Touch(ctx context.Context, t Tile) error {
+	key := s.key(t)
+
+	o, err := s.st.Stat(ctx, key)
+
+	if err != nil {
+		return err
+	}
+
+	if o.Metadata[metaMissing] != "" {
+		return ErrNotFound
+	}
+
+	m := make(map[string]string, len(o.Metadata))
+
+	for k, v := range o.Metadata {
+		m[k] = v
+	}
+
+	m[metaFetched] = strconv.FormatInt(time.Now().Unix(), 10)
+
+	return s.st.SetMetadata(ctx, key, s.contentType, m)
+}
+
+func (s *S3Store) Delete(ctx context.Context, t Tile) error {
+	return s.st.Remove(ctx, s.key(t))
+}
+
+// Iterate lists the objects, the list has no metadata, so empty objects are taken for markers
+// and the object time for the fetch time.
+func (s *S3Store) Iterate(ctx context.Context, fn func(t Tile, info *TileInfo) bool) error {
+	return s.st.List(ctx, s.prefix, func(o objectInfo) bool {
+		name, ok := strings.CutSuffix(strings.TrimPrefix(o.Key, s.prefix), "."+s.ext)
+
+		if !ok {
+			return true
+		}
+
+		t, ok := s.layout.parse(name)
+
+		if !ok {
+			return true
+		}
+
+		if s.tms {
+			t = flipY(t)
+		}
+
+		return fn(t, &TileInfo{Size: o.Size, ModTime: o.LastModified, Missing: o.Size == 0})
+	})
+}
+
+func (s *S3Store) Close() error {
+	return nil
+}
+
+// minioStorage is objectStorage on minio client.
+type minioStorage struct {
+	cl     *minio.Client
+	bucket string
+}
+
+func newMinioStorage(cfg S3Config) (*minioStorage, error) {
+	var creds *credentials.Credentials
+
+	if cfg.AccessKey != "" {
+		creds = credentials.NewStaticV4(os.ExpandEnv(cfg.AccessKey), os.ExpandEnv(cfg.SecretKey), "")
+	} else {
+		creds = credentials.NewChainCredentials([]credentials.Provider{
+			&credentials.EnvAWS{},
+			&credentials.EnvMinio{},
+			&credentials.FileAWSCredentials{},
+			&credentials.IAM{},
+		})
+	}
+
+	bucket := os.ExpandEnv(cfg.Bucket)
+
+	if bucket == "" {
+		return nil, errors.New("s3 bucket is not set")
+	}
+
+	cl, err := minio.New(os.ExpandEnv(cfg.Endpoint), &minio.Options{
+		Creds:  creds,
+		Secure: !cfg.Insecure,
+		Region: os.ExpandEnv(cfg.Region),
+	})
+
+	if err != nil {
+		return nil, fmt.Errorf("s3: %w", err)
+	}
+
+	return &minioStorage{cl: cl, bucket: bucket}, nil
+}
+
+func (m *minioStorage) Get(ctx context.Context, key string) ([]byte, objectInfo, error) {
+	obj, err := m.cl.GetObject(ctx, m.bucket, key, minio.GetObjectOptions{})
+
+	if err != nil {
+		return nil, objectInfo{}, minioError(err)
+	}
+
+	defer obj.Close()
+
+	data, err := io.ReadAll(obj)
+
+	if err != nil {
+		return nil, objectInfo{}, minioError(err)
+	}
+
+	st, err := obj.Stat()
+
+	if err != nil {
+		return nil, objectInfo{}, minioError(err)
+	}
+
+	return data, minioObjectInfo(st), nil
+}
+
+func (m *minioStorage) Stat(ctx context.Context, key string) (objectInfo, error) {
+	st, err := m.cl.StatObject(ctx, m.bucket, key, minio.StatObjectOptions{})
+
+	if err != nil {
+		return objectInfo{}, minioError(err)
+	}
+
+	return minioObjectInfo(st), nil
+}
+
+func (m *minioStorage) Put(ctx context.Context, key string, r io.Reader, size int64, contentType string, meta map[string]string) error {
+	_, err := m.cl.PutObject(ctx, m.bucket, key, r, size, minio.PutObjectOptions{
+		ContentType:  contentType,
+		UserMetadata: meta,
+	})
+
+	return minioError(err)
+}
+
+func (m *minioStorage) SetMetadata(ctx context.Context, key, contentType string, meta map[string]string) error {
+	um := make(map[string]string, len(meta)+1)
+
+	for k, v := range meta {
+		um[k] = v
+	}
+
+	um["Content-Type"] = contentType
+
+	_, err := m.cl.CopyObject(ctx,
+		minio.CopyDestOptions{Bucket: m.bucket, Object: key, UserMetadata: um, ReplaceMetadata: true},
+		minio.CopySrcOptions{Bucket: m.bucket, Object: key})
+
+	return minioError(err)
+}
+
+func (m *minioStorage) Remove(ctx context.Context, key string) error {
+	return minioError(m.cl.RemoveObject(ctx, m.bucket, key, minio.RemoveObjectOptions{}))
+}
+
+func (m *minioStorage) List(ctx context.Context, prefix string, fn func(o objectInfo) bool) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	for o := range m.cl.ListObjects(ctx, m.bucket, minio.ListObjectsOptions{Prefix: prefix, Recursive: true}) {
+		if o.Err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+
+			return minioError(o.Err)
+		}
+
+		if !fn(objectInfo{Key: o.Key, Size: o.Size, LastModified: o.LastModified}) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func minioObjectInfo(st minio.ObjectInfo) objectInfo {
+	meta := make(map[string]string, len(st.UserMetadata))
+
+	for k, v := range st.UserMetadata {
+		meta[strings.ToLower(k)] = v
+	}
+
+	return objectInfo{Key: st.Key, Size: st.Size, LastModified: st.LastModified, Metadata: meta}
+}
+
+func minioError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if r := minio.ToErrorResponse(err); r.Code == "NoSuchKey" || r.Code == "NotFound" {
+		return ErrNotFound
+	}
+
+	return err
+}
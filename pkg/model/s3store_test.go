@@ -0,0 +1,164 @@
+package model
+
+import (
+	"context"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// memStorage is in-memory objectStorage.
+type memStorage struct {
+	mx      sync.Mutex
+	objects map[string]memObject
+}
+
+type memObject struct {
+	data []byte
+	info objectInfo
+}
+
+func newMemStorage() *memStorage {
+	return &memStorage{objects: make(map[string]memObject)}
+}
+
+func (m *memStorage) Get(_ context.Context, key string) ([]byte, objectInfo, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	o, ok := m.objects[key]
+
+	if !ok {
+		return nil, objectInfo{}, ErrNotFound
+	}
+
+	return o.data, o.info, nil
+}
+
+func (m *memStorage) Stat(_ context.Context, key string) (objectInfo, error) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	o, ok := m.objects[key]
+
+	if !ok {
+		return objectInfo{}, ErrNotFound
+	}
+
+	return o.info, nil
+}
+
+func (m *memStorage) Put(_ context.Context, key string, r io.Reader, _ int64, _ string, meta map[string]string) error {
+	data, err := io.ReadAll(r)
+
+	if err != nil {
+		return err
+	}
+
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	m.objects[key] = memObject{
+		data: data,
+		info: objectInfo{Key: key, Size: int64(len(data)), LastModified: time.Now(), Metadata: maps.Clone(meta)},
+	}
+
+	return nil
+}
+
+func (m *memStorage) SetMetadata(_ context.Context, key, _ string, meta map[string]string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	o, ok := m.objects[key]
+
+	if !ok {
+		return ErrNotFound
+	}
+
+	o.info.Metadata = maps.Clone(meta)
+	o.info.LastModified = time.Now()
+	m.objects[key] = o
+
+	return nil
+}
+
+func (m *memStorage) Remove(_ context.Context, key string) error {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+
+	delete(m.objects, key)
+
+	return nil
+}
+
+func (m *memStorage) List(_ context.Context, prefix string, fn func(o objectInfo) bool) error {
+	m.mx.Lock()
+	keys := slices.Sorted(maps.Keys(m.objects))
+	m.mx.Unlock()
+
+	for _, k := range keys {
+		if !strings.HasPrefix(k, prefix) {
+			continue
+		}
+
+		info, err := m.Stat(context.Background(), k)
+
+		if err != nil {
+			continue
+		}
+
+		info.Metadata = nil
+
+		if !fn(info) {
+			return nil
+		}
+	}
+
+	return nil
+}
+
+func TestS3StoreKeys(t *testing.T) {
+	st := newMemStorage()
+
+	s, err := newS3Store(st, "layer", StoreFlat, "png", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Put(context.Background(), Tile{X: 3, Y: 1, Z: 2}, pngTile, TileMeta{ETag: `"v1"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	o, err := st.Stat(context.Background(), "layer/2/3/1.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if o.Metadata[metaEtag] != `"v1"` || o.Metadata[metaFetched] == "" {
+		t.Errorf("wrong object metadata %v", o.Metadata)
+	}
+}
+
+// TestS3StoreMinio runs the store tests against real S3 compatible storage, e.g. local MinIO:
+// TEST_S3_ENDPOINT=localhost:9000 TEST_S3_BUCKET=tiles AWS_ACCESS_KEY_ID=... AWS_SECRET_ACCESS_KEY=... go test
+func TestS3StoreMinio(t *testing.T) {
+	endpoint := os.Getenv("TEST_S3_ENDPOINT")
+
+	if endpoint == "" {
+		t.Skip("TEST_S3_ENDPOINT is not set")
+	}
+
+	s, err := NewS3Store(S3Config{Endpoint: endpoint, Bucket: os.Getenv("TEST_S3_BUCKET"), Insecure: true},
+		"test-"+strings.ReplaceAll(time.Now().Format(time.RFC3339Nano), ":", ""), "png", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	testStore(t, s)
+}
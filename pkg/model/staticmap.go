@@ -0,0 +1,120 @@
+package model
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"time"
+
+	"github.com/kdudkov/tileproxy/pkg/mapper"
+)
+
+// StaticMap is a map image with overlays.
+type StaticMap struct {
+	Map      MapRequest
+	Format   string
+	Overlays []Overlay
+}
+
+// CenterMap returns the request of the map of the size around the point at the zoom.
+func CenterMap(lat, lon float64, zoom, width, height int) MapRequest {
+	mx, my := mapper.LatLon2Mercator(max(-maxLat, min(lat, maxLat)), lon)
+	// meters in pixel
+	res := 2 * mapper.MercatorMax / float64(mapper.NewTileSystem().TileSize()<<zoom)
+	w, h := float64(width)*res/2, float64(height)*res/2
+
+	return MapRequest{BBox: [4]float64{mx - w, my - h, mx + w, my + h}, Width: width, Height: height}
+}
+
+// BoundsMap returns the request of the map of the size showing the minlon, minlat, maxlon, maxlat box. The box is
+// widened to the image aspect ratio, so the map is not stretched.
+func BoundsMap(bbox [4]float64, width, height int) MapRequest {
+	x0, y0 := mapper.LatLon2Mercator(max(-maxLat, bbox[1]), bbox[0])
+	x1, y1 := mapper.LatLon2Mercator(min(bbox[3], maxLat), bbox[2])
+
+	cx, cy := (x0+x1)/2, (y0+y1)/2
+	// meters in pixel to fit the box
+	res := max((x1-x0)/float64(width), (y1-y0)/float64(height))
+	w, h := float64(width)*res/2, float64(height)*res/2
+
+	return MapRequest{BBox: [4]float64{cx - w, cy - h, cx + w, cy + h}, Width: width, Height: height}
+}
+
+// StaticMaps renders static maps and keeps them in memory for ttl. Maps are cached by the request, so tile
+// changes are seen after ttl.
+type StaticMaps struct {
+	tr    *Transcoder
+	ttl   time.Duration
+	cache *lruCache[string]
+}
+
+// NewStaticMaps makes the renderer encoding maps with the transcoder, with the cache of cacheSize bytes.
+func NewStaticMaps(tr *Transcoder, cacheSize int64, ttl time.Duration) *StaticMaps {
+	sm := &StaticMaps{tr: tr, ttl: ttl}
+
+	if cacheSize > 0 {
+		sm.cache = newLRUCache[string](cacheSize)
+	}
+
+	return sm
+}
+
+// Render returns the encoded map of the source.
+func (sm *StaticMaps) Render(ctx context.Context, src Source, m *StaticMap) (*TileData, error) {
+	k, err := m.hash(src.GetKey())
+
+	if err != nil {
+		return nil, err
+	}
+
+	if sm.cache != nil {
+		if td := sm.cache.get(k); td != nil {
+			return td, nil
+		}
+	}
+
+	img, skipped, err := RenderMap(ctx, src, m.Map)
+
+	if err != nil {
+		return nil, err
+	}
+
+	DrawOverlays(img, m.Map, m.Overlays)
+
+	td, err := sm.tr.Encode(img, m.Format)
+
+	if err != nil {
+		return nil, err
+	}
+
+	td.ModTime = time.Now()
+
+	if sm.ttl > 0 {
+		td.Expires = td.ModTime.Add(sm.ttl)
+	}
+
+	td = Partial(td, skipped)
+
+	if sm.cache != nil {
+		sm.cache.put(k, td)
+	}
+
+	return td, nil
+}
+
+// hash returns the cache key of the map of the source.
+func (m *StaticMap) hash(key string) (string, error) {
+	b, err := json.Marshal(m)
+
+	if err != nil {
+		return "", err
+	}
+
+	h := sha256.New()
+	h.Write([]byte(key))
+	h.Write([]byte{0})
+	h.Write(b)
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,74 @@
+package model
+
+import (
+	"context"
+	"image/color"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCenterMap(t *testing.T) {
+	req := CenterMap(0, 0, 2, 512, 256)
+
+	// 512 pixels are half of the world at zoom 2
+	if math.Abs(req.BBox[0]+10018754.17) > 0.01 || math.Abs(req.BBox[3]-5009377.09) > 0.01 {
+		t.Errorf("wrong bbox %v", req.BBox)
+	}
+
+	req = BoundsMap([4]float64{-90, -10, 90, 10}, 256, 256)
+
+	// the box is widened to the square
+	if math.Abs(req.BBox[0]+10018754.17) > 0.01 || math.Abs(req.BBox[3]-10018754.17) > 0.01 {
+		t.Errorf("wrong bbox %v", req.BBox)
+	}
+}
+
+func TestStaticMaps(t *testing.T) {
+	s := &stripeSource{
+		red:  solidPNG(t, color.RGBA{R: 255, A: 255}),
+		blue: solidPNG(t, color.RGBA{B: 255, A: 255}),
+	}
+
+	sm := NewStaticMaps(NewTranscoder(85, 1<<20), 1<<20, time.Minute)
+
+	marker := NewOverlay(OverlayMarker)
+	marker.Points = [][2]float64{{0, 0}}
+
+	m := &StaticMap{Map: CenterMap(0, 0, 3, 300, 200), Format: "jpeg", Overlays: []Overlay{marker}}
+
+	td, err := sm.Render(context.Background(), s, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if td.ContentType != "image/jpeg" || td.Expires.IsZero() {
+		t.Errorf("wrong map %s, expires %s", td.ContentType, td.Expires)
+	}
+
+	img, _, err := decodeTile(td.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if b := img.Bounds(); b.Dx() != 300 || b.Dy() != 200 {
+		t.Errorf("wrong size %v", b)
+	}
+
+	calls := s.calls.Load()
+
+	td1, err := sm.Render(context.Background(), s, m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if s.calls.Load() != calls || td1 != td {
+		t.Error("map is not cached")
+	}
+
+	m.Overlays = nil
+
+	if td1, _ = sm.Render(context.Background(), s, m); td1 == td {
+		t.Error("map with other overlays is taken from cache")
+	}
+}
@@ -0,0 +1,92 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const (
+	StoreSASPlanet = "sasplanet"
+	StoreFlat      = "flat"
+	StoreMBTiles   = "mbtiles"
+	StoreS3        = "s3"
+)
+
+// TileStore keeps cached proxy tiles with their upstream metadata and "tile not exists" markers.
+// Tiles are addressed in XYZ scheme, the store converts them to its own layout.
+type TileStore interface {
+	// Get returns the tile data with its info, data is nil for the "tile not exists" marker.
+	// ErrNotFound is returned if there is neither the tile nor the marker.
+	Get(ctx context.Context, t Tile) ([]byte, *TileInfo, error)
+	// Stat is Get without the data.
+	Stat(ctx context.Context, t Tile) (*TileInfo, error)
+	// Put saves the tile, replacing the "tile not exists" marker if there is one.
+	Put(ctx context.Context, t Tile, data []byte, meta TileMeta) error
+	// PutMissing saves the "tile not exists" marker, replacing the tile if there is one.
+	PutMissing(ctx context.Context, t Tile) error
+	// Touch sets the tile fetch time to now, e.g. when upstream answered 304.
+	Touch(ctx context.Context, t Tile) error
+	// Delete removes the tile or the marker, missing tile is not an error.
+	Delete(ctx context.Context, t Tile) error
+	// Iterate calls fn for all stored tiles and markers until it returns false.
+	Iterate(ctx context.Context, fn func(t Tile, info *TileInfo) bool) error
+	Close() error
+}
+
+// TileInfo describes the stored tile.
+type TileInfo struct {
+	Size int64
+	// ModTime is the time the tile was fetched or revalidated.
+	ModTime time.Time
+	// AccessTime is the saved last use time, zero if the store doesn't keep it.
+	AccessTime time.Time
+	Meta       TileMeta
+	// Missing is set for the "tile not exists" marker.
+	Missing bool
+}
+
+// newStore creates the store configured for the layer, cacheDir is the tileserver cache directory.
+func newStore(l *LayerDescription, cacheDir string) (TileStore, error) {
+	ext := strings.ToLower(l.TileType)
+
+	switch strings.ToLower(l.Store) {
+	case "", StoreSASPlanet:
+		return NewSASPlanetStore(storePath(l.StorePath, filepath.Join(cacheDir, "tiles", l.Key)), ext, l.Tms), nil
+	case StoreFlat:
+		return NewFlatStore(storePath(l.StorePath, filepath.Join(cacheDir, "tiles", l.Key)), ext, l.Tms), nil
+	case StoreMBTiles:
+		return NewMBTilesStore(storePath(l.StorePath, filepath.Join(cacheDir, "tiles", l.Key+".mbtiles")), MBTilesInfo{
+			Name:    l.Name,
+			Format:  ext,
+			MinZoom: l.MinZoom,
+			MaxZoom: l.MaxZoom,
+		})
+	case StoreS3:
+		if l.S3 == nil {
+			return nil, errors.New("no s3 config for s3 store")
+		}
+
+		return NewS3Store(*l.S3, l.Key, ext, l.Tms)
+	default:
+		return nil, fmt.Errorf("unknown store %q", l.Store)
+	}
+}
+
+func storePath(path, def string) string {
+	if path == "" {
+		return def
+	}
+
+	return path
+}
+
+// flipY converts y between XYZ and TMS schemes.
+func flipY(t Tile) Tile {
+	t.Y = 1<<t.Z - t.Y - 1
+
+	return t
+}
@@ -0,0 +1,323 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testStores(t *testing.T) map[string]TileStore {
+	dir := t.TempDir()
+
+	mb, err := NewMBTilesStore(filepath.Join(dir, "test.mbtiles"), MBTilesInfo{Name: "test", Format: "png", MaxZoom: 19})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() { _ = mb.Close() })
+
+	return map[string]TileStore{
+		StoreSASPlanet: NewSASPlanetStore(filepath.Join(dir, "sas"), "png", false),
+		StoreFlat:      NewFlatStore(filepath.Join(dir, "flat"), "png", true),
+		"noext":        NewSASPlanetStore(filepath.Join(dir, "noext"), "", false),
+		StoreMBTiles:   mb,
+		StoreS3:        &S3Store{st: newMemStorage(), prefix: "test/", ext: "png", layout: sasLayout},
+		"s3-noext":     &S3Store{st: newMemStorage(), prefix: "test/", layout: sasLayout},
+	}
+}
+
+func TestStores(t *testing.T) {
+	for name, s := range testStores(t) {
+		t.Run(name, func(t *testing.T) {
+			testStore(t, s)
+		})
+	}
+}
+
+func testStore(t *testing.T, s TileStore) {
+	ctx := context.Background()
+
+	t1 := Tile{X: 3, Y: 1, Z: 2}
+	t2 := Tile{X: 0, Y: 2, Z: 2}
+
+	if _, _, err := s.Get(ctx, t1); !errors.Is(err, ErrNotFound) {
+		t.Fatalf("got %v, must be ErrNotFound", err)
+	}
+
+	if err := s.Put(ctx, t1, pngTile, TileMeta{ETag: `"v1"`}); err != nil {
+		t.Fatal(err)
+	}
+
+	data, info, err := s.Get(ctx, t1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(data, pngTile) || info.Missing || info.Size != int64(len(pngTile)) || info.Meta.ETag != `"v1"` {
+		t.Errorf("wrong tile %q %+v", data, info)
+	}
+
+	if err := s.Touch(ctx, t1); err != nil {
+		t.Error(err)
+	}
+
+	if err := s.Touch(ctx, t2); !errors.Is(err, ErrNotFound) {
+		t.Errorf("touch of missing tile: got %v, must be ErrNotFound", err)
+	}
+
+	if err := s.PutMissing(ctx, t2); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Stat(ctx, t2); err != nil || !info.Missing {
+		t.Errorf("got %+v %v, must be not exists marker", info, err)
+	}
+
+	atime := time.Now().Add(-time.Hour).Truncate(time.Second)
+	a, keepsAccess := s.(accessTimeStore)
+
+	if keepsAccess {
+		// the marker and the absent tile are skipped
+		if err := a.SetAccessTimes(ctx, map[Tile]time.Time{t1: atime, t2: atime, {X: 9, Y: 9, Z: 9}: atime}); err != nil {
+			t.Error(err)
+		}
+	}
+
+	found := make(map[Tile]bool)
+
+	var gotAtime, markerAtime time.Time
+
+	if err := s.Iterate(ctx, func(t Tile, info *TileInfo) bool {
+		found[t] = info.Missing
+
+		switch t {
+		case t1:
+			gotAtime = info.AccessTime
+		case t2:
+			markerAtime = info.AccessTime
+		}
+
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if len(found) != 2 || found[t1] || !found[t2] {
+		t.Errorf("wrong iterated tiles %v", found)
+	}
+
+	if keepsAccess && (!gotAtime.Equal(atime) || !markerAtime.IsZero()) {
+		t.Errorf("got access times %v %v, must be %v and zero", gotAtime, markerAtime, atime)
+	}
+
+	if err := s.Put(ctx, t2, pngTile, TileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if info, err := s.Stat(ctx, t2); err != nil || info.Missing {
+		t.Errorf("got %+v %v, marker must be replaced", info, err)
+	}
+
+	for _, tile := range []Tile{t1, t2} {
+		if err := s.Delete(ctx, tile); err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := s.Stat(ctx, tile); !errors.Is(err, ErrNotFound) {
+			t.Errorf("got %v after delete, must be ErrNotFound", err)
+		}
+	}
+}
+
+func TestFlatStoreLayout(t *testing.T) {
+	dir := t.TempDir()
+	s := NewFlatStore(dir, "png", true)
+
+	if err := s.Put(context.Background(), Tile{X: 3, Y: 1, Z: 2}, pngTile, TileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "2", "3", "2.png")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStoreNoExt(t *testing.T) {
+	dir := t.TempDir()
+	s := NewSASPlanetStore(dir, "", false)
+
+	if err := s.Put(context.Background(), Tile{X: 3, Y: 1, Z: 2}, pngTile, TileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	// the name of SAS.Planet caches made before, the same as S3 keys
+	if _, err := os.Stat(filepath.Join(dir, "z2", "0", "x3", "0", "y1.")); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestFileStoreAccessFile(t *testing.T) {
+	ctx := context.Background()
+	dir := t.TempDir()
+	s := NewSASPlanetStore(dir, "png", false)
+
+	t1, t2 := Tile{X: 1, Y: 1, Z: 3}, Tile{X: 2, Y: 1, Z: 3}
+
+	for _, tile := range []Tile{t1, t2} {
+		if err := s.Put(ctx, tile, pngTile, TileMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	atime := time.Now().Add(-time.Hour).Truncate(time.Second)
+
+	for range 3 {
+		if err := s.SetAccessTimes(ctx, map[Tile]time.Time{t1: atime, t2: atime}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	lines := func() int {
+		b, err := os.ReadFile(filepath.Join(dir, accessFile))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return bytes.Count(b, []byte("\n"))
+	}
+
+	// times are appended, not rewritten
+	if n := lines(); n != 6 {
+		t.Errorf("got %d lines, must be 6", n)
+	}
+
+	// the access time of the replaced tile is forgotten
+	if err := s.Put(ctx, t2, pngTile, TileMeta{}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	s = NewSASPlanetStore(dir, "png", false)
+	defer s.Close()
+
+	atimes := make(map[Tile]time.Time)
+
+	if err := s.Iterate(ctx, func(t Tile, info *TileInfo) bool {
+		atimes[t] = info.AccessTime
+		return true
+	}); err != nil {
+		t.Fatal(err)
+	}
+
+	if !atimes[t1].Equal(atime) || !atimes[t2].IsZero() {
+		t.Errorf("got access times %v", atimes)
+	}
+
+	// the file is compacted when most of its lines are overwritten
+	for range minCompactLines {
+		if err := s.SetAccessTimes(ctx, map[Tile]time.Time{t1: atime}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if n := lines(); n > minCompactLines/2 {
+		t.Errorf("got %d lines, must be compacted", n)
+	}
+
+	if got := readAccessFile(filepath.Join(dir, accessFile)); len(got) != 1 || got[t1] != atime.Unix() {
+		t.Errorf("got access times %v", got)
+	}
+}
+
+func TestMBTilesStoreServed(t *testing.T) {
+	u := newUpstream(t, 0)
+	name := filepath.Join(t.TempDir(), "cache.mbtiles")
+
+	p := mustProxy(t, &LayerDescription{
+		Key:       t.Name(),
+		Name:      "cache",
+		MinZoom:   1,
+		MaxZoom:   19,
+		TileType:  "png",
+		Url:       u.URL + "/{z}/{x}/{y}.png",
+		Store:     StoreMBTiles,
+		StorePath: name,
+	})
+
+	defer p.Close()
+
+	if _, err := p.GetTile(context.Background(), 10, 1, 2); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLayer("cache", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if l.GetName() != "cache" || l.GetMinZoom() != 1 || l.GetMaxZoom() != 19 {
+		t.Errorf("wrong layer %s", l)
+	}
+
+	tile, err := l.GetTile(context.Background(), 10, 1, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !bytes.Equal(tile.Data, pngTile) {
+		t.Errorf("wrong data %q", tile.Data)
+	}
+}
+
+func TestMBTilesStoreSeeded(t *testing.T) {
+	ctx := context.Background()
+	name := filepath.Join(t.TempDir(), "seeded.mbtiles")
+
+	s, err := NewMBTilesStore(name, MBTilesInfo{Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// tiles of the file made by another tool have no tile_info rows
+	if _, err := s.db.Exec("INSERT INTO tiles (zoom_level, tile_column, tile_row, tile_data) VALUES (1, 0, 0, ?)", pngTile); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	seeded := time.Now().Add(-time.Hour * 48).Truncate(time.Second)
+
+	if err := os.Chtimes(name, seeded, seeded); err != nil {
+		t.Fatal(err)
+	}
+
+	s, err = NewMBTilesStore(name, MBTilesInfo{Format: "png"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer s.Close()
+
+	tile := Tile{X: 0, Y: 1, Z: 1}
+
+	if err := s.SetAccessTimes(ctx, map[Tile]time.Time{tile: time.Now()}); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, info, err := s.Get(ctx, tile); err != nil || !info.ModTime.Equal(seeded) {
+		t.Errorf("got %+v %v, must be fetched at %v", info, err, seeded)
+	}
+
+	if info, err := s.Stat(ctx, tile); err != nil || !info.ModTime.Equal(seeded) {
+		t.Errorf("got %+v %v, must be fetched at %v", info, err, seeded)
+	}
+}
@@ -1,5 +1,11 @@
 package model
 
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"time"
+)
+
 type Tile struct {
 	X int
 	Y int
@@ -18,3 +24,39 @@ func (t *Tile) InRect(t1, t2 *Tile) bool {
 
 	return x1 >= xmin && x1 < xmax && y1 >= ymin && y1 < ymax
 }
+
+// TileData is a tile image with the information needed for http caching.
+type TileData struct {
+	ContentType string
+	Data        []byte
+	ModTime     time.Time
+	// Expires is the time the tile becomes stale, zero time means it never does.
+	Expires time.Time
+	// Hash is the hex sha256 of Data.
+	Hash string
+}
+
+// TileMeta holds upstream cache validators stored with a cached tile.
+type TileMeta struct {
+	ETag         string `json:"etag,omitempty"`
+	LastModified string `json:"last_modified,omitempty"`
+}
+
+func (m TileMeta) IsEmpty() bool {
+	return m.ETag == "" && m.LastModified == ""
+}
+
+func NewTileData(contentType string, data []byte, modTime time.Time) *TileData {
+	return &TileData{
+		ContentType: contentType,
+		Data:        data,
+		ModTime:     modTime,
+		Hash:        contentHash(data),
+	}
+}
+
+func contentHash(data []byte) string {
+	h := sha256.Sum256(data)
+
+	return hex.EncodeToString(h[:])
+}
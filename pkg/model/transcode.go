@@ -0,0 +1,112 @@
+package model
+
+import (
+	"fmt"
+	"image"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+// ImageFormats maps tile image formats to their content types.
+var ImageFormats = map[string]string{
+	"png":  "image/png",
+	"jpeg": "image/jpeg",
+	"webp": "image/webp",
+}
+
+// Transcoder re-encodes tiles to other image formats. Results are cached by the source tile hash and the format,
+// so a changed tile is transcoded again.
+type Transcoder struct {
+	quality int
+	cache   *lruCache[transcodeKey]
+}
+
+type transcodeKey struct {
+	hash   string
+	format string
+}
+
+// NewTranscoder makes the transcoder with the jpeg quality and the cache of cacheSize bytes.
+func NewTranscoder(quality int, cacheSize int64) *Transcoder {
+	tr := &Transcoder{quality: quality}
+
+	if cacheSize > 0 {
+		tr.cache = newLRUCache[transcodeKey](cacheSize)
+	}
+
+	return tr
+}
+
+// Transcode returns the tile encoded in the format, the tile that is already in it is returned as is.
+func (tr *Transcoder) Transcode(td *TileData, format string) (*TileData, error) {
+	ct, ok := ImageFormats[format]
+
+	if !ok {
+		return nil, fmt.Errorf("unsupported format %s", format)
+	}
+
+	if td.ContentType == ct {
+		return td, nil
+	}
+
+	k := transcodeKey{hash: td.Hash, format: format}
+
+	if tr.cache != nil {
+		if res := tr.cache.get(k); res != nil {
+			return res, nil
+		}
+	}
+
+	img, _, err := decodeTile(td.Data)
+
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	res, err := tr.Encode(img, format)
+
+	if err != nil {
+		return nil, err
+	}
+
+	res.ModTime = td.ModTime
+	res.Expires = td.Expires
+
+	if tr.cache != nil {
+		tr.cache.put(k, res)
+	}
+
+	return res, nil
+}
+
+// Encode encodes the image in the format with the transcoder jpeg quality.
+func (tr *Transcoder) Encode(img image.Image, format string) (*TileData, error) {
+	if _, ok := ImageFormats[format]; !ok {
+		return nil, fmt.Errorf("unsupported format %s", format)
+	}
+
+	// jpeg has no alpha, transparent parts are made white instead of black
+	if format == "jpeg" && !opaque(img) {
+		dst := image.NewRGBA(img.Bounds())
+		draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+		draw.Draw(dst, dst.Bounds(), img, img.Bounds().Min, draw.Over)
+		img = dst
+	}
+
+	data, ct, err := encodeImage(img, format, tr.quality)
+
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	return NewTileData(ct, data, time.Time{}), nil
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+
+	return false
+}
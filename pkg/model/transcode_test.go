@@ -0,0 +1,64 @@
+package model
+
+import (
+	"image/color"
+	"testing"
+	"time"
+)
+
+func TestTranscode(t *testing.T) {
+	tr := NewTranscoder(80, 1<<20)
+	src := NewTileData("image/png", solidPNG(t, color.RGBA{R: 255, A: 255}), time.Now())
+
+	if td, err := tr.Transcode(src, "png"); err != nil || td != src {
+		t.Errorf("png tile must be returned as is, got %v", err)
+	}
+
+	for _, c := range []struct {
+		format string
+		ct     string
+	}{
+		{format: "webp", ct: "image/webp"},
+		{format: "jpeg", ct: "image/jpeg"},
+	} {
+		td, err := tr.Transcode(src, c.format)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if td.ContentType != c.ct {
+			t.Errorf("got content type %s, must be %s", td.ContentType, c.ct)
+		}
+
+		_, f, err := decodeTile(td.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if f != c.format {
+			t.Errorf("got format %s, must be %s", f, c.format)
+		}
+
+		if got := tileColor(t, td, 10, 10); got.R < 250 || got.G > 5 {
+			t.Errorf("got color %v", got)
+		}
+
+		if td2, _ := tr.Transcode(src, c.format); td2 != td {
+			t.Errorf("%s tile must be cached", c.format)
+		}
+	}
+
+	// transparent parts are white in jpeg
+	td, err := tr.Transcode(NewTileData("image/png", solidPNG(t, color.RGBA{}), time.Now()), "jpeg")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tileColor(t, td, 10, 10); got.R < 250 || got.B < 250 {
+		t.Errorf("got color %v, must be white", got)
+	}
+
+	if _, err := tr.Transcode(src, "gif"); err == nil {
+		t.Error("gif must be unsupported")
+	}
+}
@@ -0,0 +1,295 @@
+package model
+
+import (
+	"context"
+	"errors"
+	"image"
+	"io"
+	"time"
+
+	"golang.org/x/image/draw"
+)
+
+var _ Source = &Underzoom{}
+
+// extentChecker is a source that can quickly check if it has any tiles in the range.
+type extentChecker interface {
+	hasTiles(ctx context.Context, z, xmin, ymin, xmax, ymax int) (bool, error)
+}
+
+// Underzoom makes tiles below the source min zoom by downsampling four child tiles, recursively.
+type Underzoom struct {
+	Source
+
+	levels  int
+	cache   *lruCache[Tile]
+	checker extentChecker
+	// layer is set to write the made tiles to its overviews table
+	layer *Layer
+}
+
+// NewUnderzoom extends the source min zoom by levels, made tiles are kept in memory cache of cacheSize bytes.
+func NewUnderzoom(src Source, levels int, cacheSize int64) *Underzoom {
+	u := &Underzoom{Source: src, levels: levels}
+
+	if cacheSize > 0 {
+		u.cache = newLRUCache[Tile](cacheSize)
+	}
+
+	if c, ok := Unwrap(src).(extentChecker); ok {
+		u.checker = c
+	}
+
+	return u
+}
+
+func (u *Underzoom) GetMinZoom() int {
+	return max(0, u.Source.GetMinZoom()-u.levels)
+}
+
+func (u *Underzoom) GetTile(ctx context.Context, z, x, y int) (*TileData, error) {
+	minZoom := u.Source.GetMinZoom()
+
+	if z >= minZoom {
+		return u.Source.GetTile(ctx, z, x, y)
+	}
+
+	if z < u.GetMinZoom() {
+		return nil, ErrOutOfRange
+	}
+
+	t := Tile{X: x, Y: y, Z: z}
+
+	if u.cache != nil {
+		if td := u.cache.get(t); td != nil {
+			return td, nil
+		}
+	}
+
+	if u.checker != nil {
+		d := minZoom - z
+
+		ok, err := u.checker.hasTiles(ctx, minZoom, x<<d, y<<d, (x+1)<<d-1, (y+1)<<d-1)
+
+		if err != nil {
+			return nil, internalError(err)
+		}
+
+		if !ok {
+			return nil, ErrNotFound
+		}
+	}
+
+	var children [4]*TileData
+
+	for i := range children {
+		td, err := u.GetTile(ctx, z+1, 2*x+i%2, 2*y+i/2)
+
+		if errors.Is(err, ErrNotFound) || errors.Is(err, ErrOutOfBounds) {
+			continue
+		}
+
+		if err != nil {
+			return nil, err
+		}
+
+		children[i] = td
+	}
+
+	td, err := mergeChildren(children, 1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if u.layer != nil {
+		if err := u.layer.PutOverview(ctx, z, x, y, td.Data); err != nil {
+			return nil, internalError(err)
+		}
+	}
+
+	if u.cache != nil {
+		u.cache.put(t, td)
+	}
+
+	return td, nil
+}
+
+// mergeChildren makes the tile of scale times child tile size from its children in z, x, y order,
+// missing children are left transparent. The tile is jpeg if all children are jpeg, png otherwise.
+func mergeChildren(children [4]*TileData, scale int) (*TileData, error) {
+	var dst *image.RGBA
+	var modTime, expires time.Time
+
+	format := "jpeg"
+
+	for i, td := range children {
+		if td == nil {
+			format = "png"
+			continue
+		}
+
+		img, f, err := decodeTile(td.Data)
+
+		if err != nil {
+			return nil, internalError(err)
+		}
+
+		if f != "jpeg" {
+			format = "png"
+		}
+
+		if dst == nil {
+			dst = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx()*scale, img.Bounds().Dy()*scale))
+		}
+
+		w, h := dst.Bounds().Dx()/2, dst.Bounds().Dy()/2
+		r := image.Rect(i%2*w, i/2*h, (i%2+1)*w, (i/2+1)*h)
+
+		draw.ApproxBiLinear.Scale(dst, r, img, img.Bounds(), draw.Src, nil)
+
+		if td.ModTime.After(modTime) {
+			modTime = td.ModTime
+		}
+
+		if !td.Expires.IsZero() && (expires.IsZero() || td.Expires.Before(expires)) {
+			expires = td.Expires
+		}
+	}
+
+	if dst == nil {
+		return nil, ErrNotFound
+	}
+
+	data, ct, err := encodeTile(dst, format)
+
+	if err != nil {
+		return nil, internalError(err)
+	}
+
+	td := NewTileData(ct, data, modTime)
+	td.Expires = expires
+
+	return td, nil
+}
+
+// Bounds returns bounds of the tiles the source has, or the parents of its min zoom tiles below it.
+func (u *Underzoom) Bounds(z int) (TileBounds, bool, error) {
+	minZoom := u.Source.GetMinZoom()
+
+	if z >= minZoom {
+		return sourceBounds(u.Source, z)
+	}
+
+	b, ok, err := sourceBounds(u.Source, minZoom)
+
+	return b.zoomOut(minZoom - z), ok, err
+}
+
+func (u *Underzoom) Unwrap() Source {
+	return u.Source
+}
+
+func (u *Underzoom) Invalidate() {
+	if u.cache != nil {
+		u.cache.Invalidate()
+	}
+}
+
+func (u *Underzoom) Close() error {
+	u.Invalidate()
+
+	if c, ok := u.Source.(io.Closer); ok {
+		return c.Close()
+	}
+
+	return nil
+}
+
+// BuildOverviews writes tiles down to minZoom made from the higher zoom tiles into the overviews table
+// of the mbtiles file. Zoom levels are built one by one, progress is called after each tile.
+func BuildOverviews(ctx context.Context, path string, minZoom int, progress func(z, n, total int)) error {
+	for {
+		l, err := NewLayer(path, path)
+
+		if err != nil {
+			return err
+		}
+
+		if l.GetMinZoom() <= minZoom {
+			return l.Close()
+		}
+
+		if err := l.buildOverviews(ctx, l.GetMinZoom()-1, progress); err != nil {
+			_ = l.Close()
+
+			return err
+		}
+
+		if err := l.Close(); err != nil {
+			return err
+		}
+	}
+}
+
+func (l *Layer) buildOverviews(ctx context.Context, z int, progress func(z, n, total int)) error {
+	tiles, err := l.parentTiles(ctx, z)
+
+	if err != nil {
+		return err
+	}
+
+	if len(tiles) == 0 {
+		return errors.New("no tiles to build overviews from")
+	}
+
+	u := NewUnderzoom(l, 1, 0)
+	u.layer = l
+
+	for i, t := range tiles {
+		if _, err := u.GetTile(ctx, t.Z, t.X, t.Y); err != nil && !errors.Is(err, ErrNotFound) {
+			return err
+		}
+
+		if progress != nil {
+			progress(z, i+1, len(tiles))
+		}
+	}
+
+	return nil
+}
+
+// parentTiles returns xyz tiles at zoom z having children in the layer.
+func (l *Layer) parentTiles(ctx context.Context, z int) ([]Tile, error) {
+	q := "SELECT DISTINCT tile_column/2, tile_row/2 FROM tiles WHERE zoom_level=?1"
+
+	if l.overviews {
+		q += " UNION SELECT DISTINCT tile_column/2, tile_row/2 FROM overviews WHERE zoom_level=?1"
+	}
+
+	rows, err := l.db.QueryContext(ctx, q, z+1)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer rows.Close() //nolint:errcheck
+
+	var res []Tile
+
+	for rows.Next() {
+		t := Tile{Z: z}
+
+		if err := rows.Scan(&t.X, &t.Y); err != nil {
+			return nil, err
+		}
+
+		if l.tms {
+			t.Y = 1<<z - t.Y - 1
+		}
+
+		res = append(res, t)
+	}
+
+	return res, rows.Err()
+}
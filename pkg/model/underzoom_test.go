@@ -0,0 +1,172 @@
+package model
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"image"
+	"image/color"
+	"image/png"
+	"path/filepath"
+	"testing"
+)
+
+func solidPNG(t *testing.T, c color.Color) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, 256, 256))
+
+	for py := range 256 {
+		for px := range 256 {
+			img.Set(px, py, c)
+		}
+	}
+
+	var buf bytes.Buffer
+
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+// testMBTiles creates mbtiles file with z2 tiles 0,0 - 1,1 of quadrantColors.
+func testMBTiles(t *testing.T) string {
+	name := filepath.Join(t.TempDir(), "test.mbtiles")
+
+	s, err := NewMBTilesStore(name, MBTilesInfo{Name: "test", Format: "png", MinZoom: 2, MaxZoom: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range quadrantColors {
+		if err := s.Put(context.Background(), Tile{X: i % 2, Y: i / 2, Z: 2}, solidPNG(t, c), TileMeta{}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return name
+}
+
+func TestUnderzoom(t *testing.T) {
+	l, err := NewLayer("test", testMBTiles(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	u := NewUnderzoom(l, 2, 1<<20)
+
+	if z := u.GetMinZoom(); z != 0 {
+		t.Errorf("min zoom: got %d, must be 0", z)
+	}
+
+	td, err := u.GetTile(context.Background(), 1, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i, c := range quadrantColors {
+		if got := tileColor(t, td, 64+i%2*128, 64+i/2*128); got != c {
+			t.Errorf("quadrant %d: got color %v, must be %v", i, got, c)
+		}
+	}
+
+	td, err = u.GetTile(context.Background(), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// z0 top left quadrant is z1 tile 0,0, the rest is empty
+	if got := tileColor(t, td, 100, 100); got != quadrantColors[3] {
+		t.Errorf("got color %v, must be %v", got, quadrantColors[3])
+	}
+
+	if got := tileColor(t, td, 200, 200); got.A != 0 {
+		t.Errorf("got color %v, must be transparent", got)
+	}
+
+	if _, err := u.GetTile(context.Background(), 1, 1, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, must be ErrNotFound", err)
+	}
+}
+
+func TestBuildOverviews(t *testing.T) {
+	name := testMBTiles(t)
+
+	if err := BuildOverviews(context.Background(), name, 0, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	l, err := NewLayer("test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	if z := l.GetMinZoom(); z != 0 {
+		t.Errorf("min zoom: got %d, must be 0", z)
+	}
+
+	td, err := l.GetTile(context.Background(), 0, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if got := tileColor(t, td, 100, 100); got != quadrantColors[3] {
+		t.Errorf("got color %v, must be %v", got, quadrantColors[3])
+	}
+
+	if _, err := l.GetTile(context.Background(), 1, 1, 1); !errors.Is(err, ErrNotFound) {
+		t.Errorf("got %v, must be ErrNotFound", err)
+	}
+}
+
+func TestPutOverview(t *testing.T) {
+	name := testMBTiles(t)
+
+	l, err := NewLayer("test", name)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := l.PutOverview(context.Background(), 1, 0, 0, solidPNG(t, quadrantColors[0])); err != nil {
+		t.Fatal(err)
+	}
+
+	if z := l.GetMinZoom(); z != 2 {
+		t.Errorf("min zoom: got %d, must be 2 until the file is opened again", z)
+	}
+
+	tiles, err := l.parentTiles(context.Background(), 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(tiles) != 1 || tiles[0] != (Tile{Z: 0}) {
+		t.Errorf("got parent tiles %v", tiles)
+	}
+
+	if err := l.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if l, err = NewLayer("test", name); err != nil {
+		t.Fatal(err)
+	}
+
+	defer l.Close()
+
+	if z := l.GetMinZoom(); z != 1 {
+		t.Errorf("min zoom: got %d, must be 1", z)
+	}
+
+	if _, err := l.GetTile(context.Background(), 1, 0, 0); err != nil {
+		t.Error(err)
+	}
+}
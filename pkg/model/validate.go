@@ -0,0 +1,47 @@
+package model
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+var errInvalidTile = errors.New("invalid tile")
+
+// validate checks upstream tile data before it gets to the cache. "No data" tiles are ErrNotFound.
+func (p *Proxy) validate(data []byte) error {
+	if len(data) == 0 || len(data) < p.minSize {
+		return fmt.Errorf("%w: size %d is too small", errInvalidTile, len(data))
+	}
+
+	if p.maxSize > 0 && len(data) > p.maxSize {
+		return fmt.Errorf("%w: size %d is too big", errInvalidTile, len(data))
+	}
+
+	if !matchType(p.ext, data) {
+		return fmt.Errorf("%w: not a %s image", errInvalidTile, p.ext)
+	}
+
+	if len(p.noDataHashes) > 0 && slices.Contains(p.noDataHashes, contentHash(data)) {
+		return fmt.Errorf("%w: no data tile", ErrNotFound)
+	}
+
+	return nil
+}
+
+// matchType checks image magic bytes for the tile type.
+func matchType(ext string, data []byte) bool {
+	switch ext {
+	case "png":
+		return bytes.HasPrefix(data, []byte("\x89PNG\r\n\x1a\n"))
+	case "jpg", "jpeg":
+		return bytes.HasPrefix(data, []byte{0xff, 0xd8, 0xff})
+	case "webp":
+		return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+	default:
+		return strings.HasPrefix(http.DetectContentType(data), "image/")
+	}
+}